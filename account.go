@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+	"petclinic/mail"
+)
+
+// Lifetimes of the links sent by email
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+var mailer mail.Mailer
+
+// initMailer picks the mail transport from the environment: SMTP when
+// SMTP_ADDR is set, otherwise .eml files in MAIL_DIR, otherwise the console.
+func initMailer() {
+	from := getenvDefault("MAIL_FROM", "Pet Clinic <no-reply@petclinic.local>")
+	switch {
+	case os.Getenv("SMTP_ADDR") != "":
+		mailer = mail.NewSMTP(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+		logger.Info("Sending mail through SMTP server %s", os.Getenv("SMTP_ADDR"))
+	case os.Getenv("MAIL_DIR") != "":
+		mailer = mail.NewFile(os.Getenv("MAIL_DIR"), from)
+		logger.Info("Writing mail to %s", os.Getenv("MAIL_DIR"))
+	default:
+		mailer = mail.NewConsole(from)
+		logger.Info("Printing mail to the console")
+	}
+}
+
+// requireEmailVerification reports whether unverified accounts are refused
+// at login (REQUIRE_EMAIL_VERIFICATION=true)
+func requireEmailVerification() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+type tokenRequest struct {
+	Token string `json:"token"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// sendVerificationEmail issues a new verification token for u and mails
+// the link
+func sendVerificationEmail(ctx context.Context, u data.UserRow) error {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	if err := data.CreateUserToken(DB, u.ID, data.TokenVerifyEmail, hash, time.Now().Add(verifyEmailTTL)); err != nil {
+		return err
+	}
+	link := tokenLink("VERIFY_EMAIL_URL", "http://localhost:8080/auth/verify-email", token)
+	return mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Welcome to Pet Clinic.\n\nConfirm your email address by opening this link within %d hours:\n\n%s\n",
+			int(verifyEmailTTL.Hours()), link),
+	})
+}
+
+// respondNewAccount finishes a sign-up: it mails a verification link and
+// either signs the user in or, when verification is required, asks them to
+// check their inbox first
+func respondNewAccount(w http.ResponseWriter, r *http.Request, u data.UserRow, status int) {
+	if err := sendVerificationEmail(r.Context(), u); err != nil {
+		logger.Error("Failed to send verification email to %s: %v", u.Email, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if requireEmailVerification() {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "check your email to verify your address"})
+		return
+	}
+	res, err := loginResult(u)
+	if err != nil {
+		logger.Error("Failed to generate token for user %s: %v", u.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// VerifyEmail redeems a verification token, sent either as JSON body or,
+// when the link in the email is opened, as ?token=
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if r.Method == http.MethodGet {
+		req.Token = r.URL.Query().Get("token")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("Invalid verification request: %v", err)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		writeError(w, r, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := data.VerifyEmail(DB, actorOf(r), hashSecretToken(req.Token))
+	if err != nil {
+		if errors.Is(err, data.ErrTokenInvalid) {
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		logger.Error("Failed to verify email: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Verified email address of user %s (ID: %d)", u.Email, u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "email address verified"})
+}
+
+// ResendVerification mails a new verification link. The response is the
+// same whether or not the address belongs to an account.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req emailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeError(w, r, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := data.FindUserByEmail(DB, req.Email)
+	switch {
+	case err == nil && !u.EmailVerified:
+		if err := sendVerificationEmail(r.Context(), u); err != nil {
+			logger.Error("Failed to send verification email to %s: %v", u.Email, err)
+		}
+	case err != nil:
+		logger.Debug("Verification requested for unknown email %s", req.Email)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ForgotPassword mails a password reset link. The response is the same
+// whether or not the address belongs to an account.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req emailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		writeError(w, r, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := data.FindUserByEmail(DB, req.Email)
+	if err != nil {
+		logger.Info("Password reset requested for unknown email %s", req.Email)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, hash, err := newSecretToken()
+	if err == nil {
+		err = data.CreateUserToken(DB, u.ID, data.TokenResetPassword, hash, time.Now().Add(resetPasswordTTL))
+	}
+	if err != nil {
+		logger.Error("Failed to create reset token for user %d: %v", u.ID, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	link := tokenLink("PASSWORD_RESET_URL", "http://localhost:8080/auth/reset-password", token)
+	err = mailer.Send(r.Context(), mail.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Pet Clinic account.\n\n"+
+			"Choose a new password within %d minutes using this link:\n\n%s\n\n"+
+			"If it was not you, ignore this email; your password stays the same.\n",
+			int(resetPasswordTTL.Minutes()), link),
+	})
+	if err != nil {
+		logger.Error("Failed to send reset email to %s: %v", u.Email, err)
+	}
+	logger.Info("Password reset requested for user %d", u.ID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password using a reset token
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("Invalid reset request: %v", err)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		writeError(w, r, "token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	target, err := data.UserForToken(DB, data.TokenResetPassword, hashSecretToken(req.Token))
+	if err != nil {
+		if errors.Is(err, data.ErrTokenInvalid) {
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		logger.Error("Failed to look up reset token: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if !checkNewPassword(w, r, req.Password, target.Email, "password") {
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		logger.Error("Failed to hash password: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	u, err := data.ResetPassword(DB, actorOf(r), hashSecretToken(req.Token), hash)
+	if err != nil {
+		if errors.Is(err, data.ErrTokenInvalid) {
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		logger.Error("Failed to reset password: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Password reset for user %s (ID: %d)", u.Email, u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "password updated"})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// API keys look like pck_<prefix>_<secret>. The prefix is stored in clear to
+// find the key; only the SHA-256 of the secret is stored.
+const apiKeyPrefix = "pck_"
+
+// apiKeyAreas are the first path segments API keys can be scoped to. A key
+// needs "<area>:read" for GET requests and "<area>:write" for the rest.
+var apiKeyAreas = []string{
+	"owners", "pets", "vets", "visits", "services", "invoices", "inventory",
+	"prescriptions", "lab", "species", "breeds", "files",
+}
+
+func validAPIKeyScope(scope string) bool {
+	area, access, ok := strings.Cut(scope, ":")
+	if !ok || (access != "read" && access != "write") {
+		return false
+	}
+	for _, a := range apiKeyAreas {
+		if a == area {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScope returns the scope a request needs
+func requiredScope(r *http.Request) string {
+	area, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return area + ":read"
+	}
+	return area + ":write"
+}
+
+// newAPIKey returns a new key, its prefix and the hash stored for it
+func newAPIKey() (key, prefix, hash string, err error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(b)
+	secret, hash, err := newSecretToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	return apiKeyPrefix + prefix + "_" + secret, prefix, hash, nil
+}
+
+// authenticateAPIKey checks an "ApiKey" authorization and the key's scope
+// for the request. API keys act as staff but never as admin, and have no
+// user id.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, raw string) (*http.Request, bool) {
+	prefix, secret, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(raw, apiKeyPrefix) {
+		logger.WarnCtx(r.Context(), "Auth: malformed API key - %s %s", r.Method, r.URL.Path)
+		writeError(w, r, "invalid api key", http.StatusUnauthorized)
+		return r, false
+	}
+
+	k, err := data.FindActiveAPIKey(DB, prefix)
+	if err != nil && err != sql.ErrNoRows {
+		logger.ErrorCtx(r.Context(), "Failed to look up API key %s: %v", prefix, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return r, false
+	}
+	if err == sql.ErrNoRows || subtle.ConstantTimeCompare([]byte(hashSecretToken(secret)), []byte(k.SecretHash)) != 1 {
+		logger.WarnCtx(r.Context(), "Auth: unknown, expired or revoked API key %s", prefix)
+		writeError(w, r, "invalid api key", http.StatusUnauthorized)
+		return r, false
+	}
+
+	ctx := context.WithValue(r.Context(), logger.CtxUserEmailKey, "api-key:"+k.Name)
+	ctx = context.WithValue(ctx, ctxRoleKey, data.RoleStaff)
+	ctx = context.WithValue(ctx, ctxAPIKeyIDKey, k.ID)
+	ctx = context.WithValue(ctx, ctxClinicKey, data.Tenant(k.ClinicID))
+	r = r.WithContext(ctx)
+
+	scope := requiredScope(r)
+	granted := false
+	for _, s := range k.Scopes {
+		if s == scope {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		logger.WarnCtx(r.Context(), "Auth: API key %s lacks scope %s for %s %s", prefix, scope, r.Method, r.URL.Path)
+		writeError(w, r, "api key lacks scope "+scope, http.StatusForbidden)
+		return r, false
+	}
+
+	if err := data.TouchAPIKey(DB, k.ID); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to record use of API key %s: %v", prefix, err)
+	}
+	return r, true
+}
+
+// -------------------- Admin --------------------
+
+type apiKey struct {
+	ID         int        `json:"id"`
+	ClinicID   int        `json:"clinic_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  *int       `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// Key is only returned when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func apiKeyFromRow(k data.APIKeyRow) apiKey {
+	return apiKey{
+		ID:         k.ID,
+		ClinicID:   k.ClinicID,
+		Name:       k.Name,
+		Prefix:     apiKeyPrefix + k.Prefix,
+		Scopes:     k.Scopes,
+		CreatedBy:  k.CreatedBy,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+	}
+}
+
+func GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListAPIKeys(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch API keys: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	keys := make([]apiKey, len(rows))
+	for i, k := range rows {
+		keys[i] = apiKeyFromRow(k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func GetAPIKeyByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	k, err := data.GetAPIKeyByID(DB, tenantOf(r), id)
+	if err != nil {
+		dataError(w, r, err, "api key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeyFromRow(k))
+}
+
+// CreateAPIKey issues a key. The full key is in the response only; it
+// cannot be shown again.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, r, "name is required and must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, r, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, s := range req.Scopes {
+		if !validAPIKeyScope(s) {
+			writeError(w, r, "invalid scope "+strconv.Quote(s)+"; use <area>:read or <area>:write with area one of "+
+				strings.Join(apiKeyAreas, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, r, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, prefix, hash, err := newAPIKey()
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to generate API key: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	createdBy, _ := r.Context().Value(logger.CtxUserIDKey).(int)
+	k, err := data.CreateAPIKey(DB, tenantOf(r), actorOf(r), req.Name, prefix, hash, req.Scopes, createdBy, req.ExpiresAt)
+	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
+		logger.ErrorCtx(r.Context(), "Failed to create API key: %v", err)
+		writeError(w, r, "failed to create api key", http.StatusInternalServerError)
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Created API key %s (%s) with scopes %v", k.Name, k.Prefix, k.Scopes)
+	res := apiKeyFromRow(k)
+	res.Key = key
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := data.RevokeAPIKey(DB, tenantOf(r), actorOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to revoke API key %d: %v", id, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, r, "api key not found or already revoked", http.StatusNotFound)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Revoked API key %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// actorOf is who makes the changes of a request, as recorded in the audit
+// trail
+func actorOf(r *http.Request) data.Actor {
+	a := data.Actor{RequestID: requestIDOf(r)}
+	if id, ok := r.Context().Value(ctxAPIKeyIDKey).(int); ok {
+		a.APIKeyID = id
+		return a
+	}
+	a.UserID, _ = r.Context().Value(logger.CtxUserIDKey).(int)
+	return a
+}
+
+// GetAuditEvents returns the history of ?entity= (one of
+// data.AuditEntityTypes), or of one record of it with &id=
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	entity := q.Get("entity")
+	if !slices.Contains(data.AuditEntityTypes, entity) {
+		writeError(w, r, "entity must be one of "+strings.Join(data.AuditEntityTypes, ", "), http.StatusBadRequest)
+		return
+	}
+	id := 0
+	if v := q.Get("id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, "invalid id", http.StatusBadRequest)
+			return
+		}
+		id = n
+	}
+
+	rows, err := data.ListAuditEvents(DB, tenantOf(r), entity, id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch audit events of %s %d: %v", entity, id, err)
+		dataError(w, r, err, "audit event")
+		return
+	}
+	events := make([]AuditEvent, len(rows))
+	for i, e := range rows {
+		events[i] = AuditEvent{ID: e.ID, ActorID: e.ActorID, ActorEmail: e.ActorEmail, APIKeyID: e.APIKeyID,
+			Action: e.Action, EntityType: e.EntityType, EntityID: e.EntityID, ClinicID: e.ClinicID,
+			Before: e.Before, After: e.After, RequestID: e.RequestID, CreatedAt: e.CreatedAt}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 
 	"encoding/json"
 	"errors"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
@@ -18,9 +22,15 @@ import (
 )
 
 type User struct {
-	ID           int    `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"-"`
+	ID            int       `json:"id"`
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	OwnerID       *int      `json:"owner_id,omitempty"`
+	EmailVerified bool      `json:"email_verified"`
+	MFAEnabled    bool      `json:"mfa_enabled"`
+	Active        bool      `json:"active"`
+	CreatedAt     time.Time `json:"created_at"`
+	ClinicID      *int      `json:"clinic_id"`
 }
 
 type registerRequest struct {
@@ -37,13 +47,6 @@ type authResponse struct {
 	Token string `json:"token"`
 }
 
-func getJWTSecret() []byte {
-	if v := os.Getenv("JWT_SECRET"); v != "" {
-		return []byte(v)
-	}
-	return []byte("dev_secret_change_me")
-}
-
 func hashPassword(plain string) (string, error) {
 	h, err := bcrypt.GenerateFromPassword([]byte(plain), bcrypt.DefaultCost)
 	return string(h), err
@@ -53,30 +56,100 @@ func checkPassword(hash, plain string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain))
 }
 
-func generateToken(userID int, email string) (string, error) {
+// newSecretToken returns a random token and the hash that is stored for it
+func newSecretToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	tok := hex.EncodeToString(b)
+	return tok, hashSecretToken(tok), nil
+}
+
+func hashSecretToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenLink appends token to the URL configured in envKey, falling back
+// to def
+func tokenLink(envKey, def, token string) string {
+	base := getenvDefault(envKey, def)
+	u, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + token
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Token types carried in the "typ" claim. Session tokens have none; the
+// others are only accepted by the login steps they belong to.
+const (
+	tokenMFAChallenge = "mfa"
+	tokenMFAEnroll    = "mfa_enroll"
+)
+
+func generateToken(u data.UserRow) (string, error) {
+	return signToken(u, "", 4*time.Hour)
+}
+
+func signToken(u data.UserRow, typ string, ttl time.Duration) (string, error) {
 	claims := jwt.MapClaims{
-		"sub":   userID,
-		"email": email,
-		"exp":   time.Now().Add(4 * time.Hour).Unix(),
+		"sub":   u.ID,
+		"email": u.Email,
+		"role":  u.Role,
+		"exp":   time.Now().Add(ttl).Unix(),
 		"iat":   time.Now().Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(getJWTSecret())
+	if u.OwnerID != nil {
+		claims["owner_id"] = *u.OwnerID
+	}
+	if u.ClinicID != nil {
+		claims["clinic_id"] = *u.ClinicID
+	}
+	if typ != "" {
+		claims["typ"] = typ
+	}
+	token := jwt.NewWithClaims(jwtKeys.signing.Method, claims)
+	token.Header["kid"] = jwtKeys.signing.ID
+	return token.SignedString(jwtKeys.signing.Private)
+}
+
+// parseToken verifies a token's signature and expiry and returns its claims
+func parseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, jwtKeyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
 }
 
+// Register creates a pending account in clinic DEFAULT_CLINIC_ID. It reaches
+// no records until an admin of the clinic gives it a role.
 func Register(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Handling user registration request")
 
 	var req registerRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Warn("Invalid registration request: %v", err)
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
 		return
 	}
 
 	if req.Email == "" || req.Password == "" {
 		logger.Warn("Registration attempt with empty email or password")
-		http.Error(w, "email and password are required", http.StatusBadRequest)
+		writeError(w, r, "email and password are required", http.StatusBadRequest)
+		return
+	}
+	if !checkNewPassword(w, r, req.Password, req.Email, "password") {
 		return
 	}
 
@@ -84,27 +157,26 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	hash, err := hashPassword(req.Password)
 	if err != nil {
 		logger.Error("Failed to hash password: %v", err)
-		http.Error(w, "failed to process request", http.StatusInternalServerError)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
 		return
 	}
 
 	logger.Debug("Creating user in database: %s", req.Email)
-	user, err := data.CreateUser(DB, req.Email, hash)
+	user, err := data.CreateUser(DB, actorOf(r), defaultClinicID, req.Email, hash)
 
 	if err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			logger.Warn("Registration attempt with existing email: %s", req.Email)
+			writeError(w, r, "email already registered", http.StatusConflict)
+			return
+		}
 		logger.Error("Failed to create user %s: %v", req.Email, err)
-		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		dataError(w, r, err, "user")
 		return
 	}
 
 	logger.Info("Successfully registered user: %s (ID: %d)", req.Email, user.ID)
-	tok, err := generateToken(user.ID, req.Email)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(authResponse{Token: tok})
+	respondNewAccount(w, r, user, http.StatusOK)
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -113,13 +185,26 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Warn("Invalid login request: %v", err)
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
 		return
 	}
 
 	if req.Email == "" || req.Password == "" {
 		logger.Warn("Login attempt with empty email or password")
-		http.Error(w, "email and password are required", http.StatusBadRequest)
+		writeError(w, r, "email and password are required", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	until, err := loginLocked(accountKey(req.Email), ipKey(ip))
+	if err != nil {
+		logger.Error("Failed to check login lockout for %s: %v", req.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		logger.Warn("Login refused - locked out: %s from %s", req.Email, ip)
+		writeLockedOut(w, r, until)
 		return
 	}
 
@@ -127,91 +212,225 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	user, err := data.FindUserByEmail(DB, req.Email)
 	if err != nil {
 		logger.Warn("Login failed - user not found: %s", req.Email)
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		dummyPasswordCheck(req.Password)
+		recordLoginFailure(req.Email, ip)
+		writeError(w, r, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	logger.Debug("Verifying password for user: %s", req.Email)
 	if err := checkPassword(user.PasswordHash, req.Password); err != nil {
 		logger.Warn("Login failed - invalid password for user: %s", req.Email)
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		recordLoginFailure(req.Email, ip)
+		writeError(w, r, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	// With two-factor authentication the count is only reset once the
+	// second step succeeds, so a known password cannot be used to keep
+	// guessing codes
+	if !user.TOTPEnabled {
+		if _, err := data.ClearLoginFailures(DB, accountKey(req.Email)); err != nil {
+			logger.Error("Failed to clear login failures for %s: %v", req.Email, err)
+		}
+	}
 
-	logger.Debug("Generating JWT token for user: %s (ID: %d)", req.Email, user.ID)
-	token, err := generateToken(user.ID, user.Email)
-	if err != nil {
-		logger.Error("Failed to generate token for user %s: %v", req.Email, err)
-		http.Error(w, "failed to process request", http.StatusInternalServerError)
+	if !user.Active {
+		logger.Warn("Login refused - account deactivated: %s", req.Email)
+		writeError(w, r, "account is deactivated", http.StatusForbidden)
 		return
 	}
 
-	logger.Info("Successful login for user: %s", req.Email)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(authResponse{Token: token})
+	if requireEmailVerification() && !user.EmailVerified {
+		logger.Warn("Login refused - email not verified for user: %s", req.Email)
+		writeError(w, r, "email address not verified", http.StatusForbidden)
+		return
+	}
+
+	respondLogin(w, r, user)
 }
 
 type ctxKey string
 
-const ctxUserIDKey ctxKey = "user_id"
+const (
+	ctxUserIDKey    ctxKey = "user_id"
+	ctxRoleKey      ctxKey = "role"
+	ctxOwnerIDKey   ctxKey = "owner_id"
+	ctxTokenTypeKey ctxKey = "token_type"
+	ctxAPIKeyIDKey  ctxKey = "api_key_id"
+	ctxClinicKey    ctxKey = "clinic"
+)
 
+// AuthMiddleware admits staff, admin and super-admin accounts, and
+// integrations holding an API key with the scope the request needs. Owner
+// accounts only have access to the /me endpoints behind OwnerMiddleware.
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	staff := requireRole(next, data.RoleStaff, data.RoleAdmin, data.RoleSuperAdmin)
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "Auth: Processing %s %s", r.Method, r.URL.Path)
-
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			logger.WarnCtx(r.Context(), "Auth: Missing authorization header - %s %s", r.Method, r.URL.Path)
-			http.Error(w, "missing authorization header", http.StatusUnauthorized)
+		if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+			r, ok := authenticateAPIKey(w, r, key)
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
+		staff(w, r)
+	}
+}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			logger.WarnCtx(r.Context(), "Auth: Invalid authorization header format - %s %s", r.Method, r.URL.Path)
-			http.Error(w, "invalid authorization header format", http.StatusUnauthorized)
-			return
-		}
+// UserMiddleware admits any signed-in account, owners and pending accounts
+// included
+func UserMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(next, data.RoleStaff, data.RoleAdmin, data.RoleOwner, data.RolePending, data.RoleSuperAdmin)
+}
 
-		tokenString := parts[1]
-		logger.DebugCtx(r.Context(), "Validating JWT token")
+// AdminMiddleware admits the admins of a clinic and super-admins
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(next, data.RoleAdmin, data.RoleSuperAdmin)
+}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return getJWTSecret(), nil
-		})
+// SuperAdminMiddleware admits super-admins only, for settings that apply to
+// every clinic
+func SuperAdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(next, data.RoleSuperAdmin)
+}
 
-		if err != nil || !token.Valid {
-			logger.WarnCtx(r.Context(), "Invalid JWT token: %v", err)
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+func requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticate(w, r)
+		if !ok || !sessionToken(w, r) {
 			return
 		}
+		role, _ := r.Context().Value(ctxRoleKey).(string)
+		for _, allowed := range roles {
+			if role == allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		logger.WarnCtx(r.Context(), "Auth: role %q may not access %s %s", role, r.Method, r.URL.Path)
+		writeError(w, r, "forbidden", http.StatusForbidden)
+	}
+}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			logger.WarnCtx(r.Context(), "Invalid token claims")
-			http.Error(w, "invalid token claims", http.StatusUnauthorized)
+// OwnerMiddleware admits owner accounts and puts their owner id in the
+// request context
+func OwnerMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticate(w, r)
+		if !ok || !sessionToken(w, r) {
 			return
 		}
+		if _, isOwner := r.Context().Value(ctxOwnerIDKey).(int); !isOwner {
+			logger.WarnCtx(r.Context(), "Auth: %s %s requires an owner account", r.Method, r.URL.Path)
+			writeError(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
 
-		userID, ok := claims["sub"].(float64)
+// MFAEnrollMiddleware admits any signed-in user, including those holding
+// the enrollment-only token issued when their role requires two-factor
+// authentication they have not set up yet
+func MFAEnrollMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticate(w, r)
 		if !ok {
-			logger.WarnCtx(r.Context(), "Invalid user ID in token")
-			http.Error(w, "invalid user ID in token", http.StatusUnauthorized)
 			return
 		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// sessionToken refuses enrollment-only tokens outside the enrollment
+// endpoints
+func sessionToken(w http.ResponseWriter, r *http.Request) bool {
+	if typ, _ := r.Context().Value(ctxTokenTypeKey).(string); typ != "" {
+		logger.WarnCtx(r.Context(), "Auth: %q token used for %s %s", typ, r.Method, r.URL.Path)
+		writeError(w, r, "two-factor authentication must be set up first", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authenticate validates the bearer token and returns the request with the
+// user in its context. On failure it has already written the response.
+func authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	logger.DebugCtx(r.Context(), "Auth: Processing %s %s", r.Method, r.URL.Path)
 
-		// Extract optional email
-		var ctxWithUser = r.Context()
-		if em, ok := claims["email"].(string); ok && em != "" {
-			ctxWithUser = context.WithValue(ctxWithUser, logger.CtxUserEmailKey, em)
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		logger.WarnCtx(r.Context(), "Auth: Missing authorization header - %s %s", r.Method, r.URL.Path)
+		writeError(w, r, "missing authorization header", http.StatusUnauthorized)
+		return r, false
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		logger.WarnCtx(r.Context(), "Auth: Invalid authorization header format - %s %s", r.Method, r.URL.Path)
+		writeError(w, r, "invalid authorization header format", http.StatusUnauthorized)
+		return r, false
+	}
+
+	tokenString := parts[1]
+	logger.DebugCtx(r.Context(), "Validating JWT token")
+
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JWT token: %v", err)
+		writeError(w, r, "invalid token", http.StatusUnauthorized)
+		return r, false
+	}
+
+	// MFA challenge tokens are only good for /auth/login/mfa
+	typ, _ := claims["typ"].(string)
+	if typ != "" && typ != tokenMFAEnroll {
+		logger.WarnCtx(r.Context(), "Auth: %q token used for %s %s", typ, r.Method, r.URL.Path)
+		writeError(w, r, "invalid token", http.StatusUnauthorized)
+		return r, false
+	}
+
+	userID, ok := claims["sub"].(float64)
+	if !ok {
+		logger.WarnCtx(r.Context(), "Invalid user ID in token")
+		writeError(w, r, "invalid user ID in token", http.StatusUnauthorized)
+		return r, false
+	}
+
+	// The account is looked up on every request, so deactivation and role
+	// changes apply to tokens already issued
+	u, err := data.GetUserByID(DB, int(userID))
+	if err != nil && err != sql.ErrNoRows {
+		logger.ErrorCtx(r.Context(), "Auth: failed to load user %d: %v", int(userID), err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return r, false
+	}
+	if err == sql.ErrNoRows || !u.Active {
+		logger.WarnCtx(r.Context(), "Auth: token of deleted or deactivated user %d", int(userID))
+		writeError(w, r, "account is deactivated", http.StatusUnauthorized)
+		return r, false
+	}
+
+	ctxWithUser := context.WithValue(r.Context(), logger.CtxUserEmailKey, u.Email)
+	ctxWithUser = context.WithValue(ctxWithUser, ctxRoleKey, u.Role)
+	ctxWithUser = context.WithValue(ctxWithUser, ctxTokenTypeKey, typ)
+	if u.Role == data.RoleOwner {
+		if u.OwnerID == nil {
+			logger.WarnCtx(r.Context(), "Owner account %d without owner ID", u.ID)
+			writeError(w, r, "invalid token claims", http.StatusUnauthorized)
+			return r, false
 		}
-		// Add user ID to context
-		userIDInt := int(userID)
-		logger.DebugCtx(r.Context(), "Successfully authenticated user ID: %d", userIDInt)
-		ctxWithUser = context.WithValue(ctxWithUser, logger.CtxUserIDKey, userIDInt)
-		next.ServeHTTP(w, r.WithContext(ctxWithUser))
+		ctxWithUser = context.WithValue(ctxWithUser, ctxOwnerIDKey, *u.OwnerID)
+	}
+	tenant, ok := resolveTenant(w, r, u, claims)
+	if !ok {
+		return r, false
 	}
+	ctxWithUser = context.WithValue(ctxWithUser, ctxClinicKey, tenant)
+	// Add user ID to context
+	userIDInt := int(userID)
+	logger.DebugCtx(r.Context(), "Successfully authenticated user ID: %d (%s)", userIDInt, u.Role)
+	ctxWithUser = context.WithValue(ctxWithUser, logger.CtxUserIDKey, userIDInt)
+	return r.WithContext(ctxWithUser), true
 }
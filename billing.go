@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// -------------------- Service catalog --------------------
+
+func serviceFromRow(s data.ServiceRow) Service {
+	return Service{
+		ID:             s.ID,
+		Code:           s.Code,
+		Name:           s.Name,
+		Kind:           s.Kind,
+		UnitPriceCents: s.UnitPriceCents,
+		TaxRateBP:      s.TaxRateBP,
+		Active:         s.Active,
+	}
+}
+
+// validateService checks a catalog service and returns its invalid fields
+func validateService(s Service) []FieldError {
+	var errs []FieldError
+	if s.Code == "" {
+		errs = append(errs, FieldError{Field: "code", Code: "required", Message: "is required"})
+	}
+	if s.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Code: "required", Message: "is required"})
+	}
+	if !data.ValidServiceKind(s.Kind) {
+		errs = append(errs, FieldError{Field: "kind", Code: "invalid", Message: "must be procedure, medication or consumable"})
+	}
+	if s.UnitPriceCents < 0 {
+		errs = append(errs, FieldError{Field: "unit_price_cents", Code: "negative", Message: "must not be negative"})
+	}
+	if s.TaxRateBP < 0 || s.TaxRateBP > 10000 {
+		errs = append(errs, FieldError{Field: "tax_rate_bp", Code: "out_of_range", Message: "must be from 0 to 10000"})
+	}
+	return errs
+}
+
+func GetServices(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Fetching service catalog")
+	rows, err := data.ListServices(DB)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch services: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	services := make([]Service, len(rows))
+	for i, s := range rows {
+		services[i] = serviceFromRow(s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services)
+}
+
+func GetServiceByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid service ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	s, err := data.GetServiceByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "service")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serviceFromRow(s))
+}
+
+func CreateService(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Creating catalog service")
+	s := Service{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rejectInvalid(w, r, validateService(s)) {
+		return
+	}
+
+	id, err := data.CreateService(DB, actorOf(r), data.ServiceInput{
+		Code:           s.Code,
+		Name:           s.Name,
+		Kind:           s.Kind,
+		UnitPriceCents: s.UnitPriceCents,
+		TaxRateBP:      s.TaxRateBP,
+		Active:         s.Active,
+	})
+	if err != nil {
+		dataError(w, r, err, "service")
+		return
+	}
+
+	s.ID = id
+	logger.InfoCtx(r.Context(), "Successfully created service with ID: %d", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func UpdateService(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid service ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetServiceByID(DB, id); err != nil {
+		dataError(w, r, err, "service")
+		return
+	}
+
+	s := Service{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rejectInvalid(w, r, validateService(s)) {
+		return
+	}
+
+	err = data.UpdateService(DB, actorOf(r), id, data.ServiceInput{
+		Code:           s.Code,
+		Name:           s.Name,
+		Kind:           s.Kind,
+		UnitPriceCents: s.UnitPriceCents,
+		TaxRateBP:      s.TaxRateBP,
+		Active:         s.Active,
+	})
+	if err != nil {
+		dataError(w, r, err, "service")
+		return
+	}
+
+	s.ID = id
+	logger.InfoCtx(r.Context(), "Successfully updated service ID: %d", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func DeleteService(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid service ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.DeleteService(DB, actorOf(r), id); err != nil {
+		dataError(w, r, err, "service")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Successfully deleted service with ID: %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// -------------------- Invoices --------------------
+
+type createInvoiceRequest struct {
+	VisitID       int           `json:"visit_id"`
+	Currency      string        `json:"currency"`
+	DiscountCents int64         `json:"discount_cents"`
+	Lines         []InvoiceLine `json:"lines"`
+}
+
+type updateInvoiceRequest struct {
+	DiscountCents int64 `json:"discount_cents"`
+}
+
+func invoiceFromRow(ri data.InvoiceRow) Invoice {
+	inv := Invoice{
+		ID:            ri.ID,
+		OwnerID:       ri.OwnerID,
+		VisitID:       ri.VisitID,
+		Status:        ri.Status,
+		Currency:      ri.Currency,
+		SubtotalCents: ri.SubtotalCents,
+		TaxCents:      ri.TaxCents,
+		DiscountCents: ri.DiscountCents,
+		TotalCents:    ri.TotalCents,
+		PaidCents:     ri.PaidCents,
+		CreatedAt:     ri.CreatedAt,
+		IssuedAt:      ri.IssuedAt,
+	}
+	for _, l := range ri.Lines {
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			ID:             l.ID,
+			ServiceID:      l.ServiceID,
+			Kind:           l.Kind,
+			Description:    l.Description,
+			Quantity:       l.Quantity,
+			UnitPriceCents: l.UnitPriceCents,
+			TaxRateBP:      l.TaxRateBP,
+			DiscountCents:  l.DiscountCents,
+			NetCents:       l.NetCents,
+			TaxCents:       l.TaxCents,
+		})
+	}
+	return inv
+}
+
+// invoiceLineInput checks an invoice line and returns its invalid fields,
+// named with prefix (such as "lines[0].")
+func invoiceLineInput(l InvoiceLine, prefix string) (data.InvoiceLineInput, []FieldError) {
+	in := data.InvoiceLineInput{
+		Kind:           l.Kind,
+		Description:    l.Description,
+		Quantity:       l.Quantity,
+		UnitPriceCents: l.UnitPriceCents,
+		TaxRateBP:      l.TaxRateBP,
+		DiscountCents:  l.DiscountCents,
+	}
+	var errs []FieldError
+	if l.Quantity < 0 {
+		errs = append(errs, FieldError{Field: prefix + "quantity", Code: "negative", Message: "must not be negative"})
+	}
+	if l.DiscountCents < 0 {
+		errs = append(errs, FieldError{Field: prefix + "discount_cents", Code: "negative", Message: "must not be negative"})
+	}
+	if l.ServiceID != nil {
+		in.ServiceID = *l.ServiceID
+		return in, errs
+	}
+	if !data.ValidServiceKind(l.Kind) {
+		errs = append(errs, FieldError{Field: prefix + "kind", Code: "invalid",
+			Message: "must be procedure, medication or consumable on lines without service_id"})
+	}
+	if l.Description == "" {
+		errs = append(errs, FieldError{Field: prefix + "description", Code: "required",
+			Message: "is required on lines without service_id"})
+	}
+	if l.UnitPriceCents < 0 {
+		errs = append(errs, FieldError{Field: prefix + "unit_price_cents", Code: "negative", Message: "must not be negative"})
+	}
+	quantity := l.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	if l.DiscountCents > int64(quantity)*l.UnitPriceCents {
+		errs = append(errs, FieldError{Field: prefix + "discount_cents", Code: "too_large", Message: "must not exceed quantity times unit_price_cents"})
+	}
+	if l.TaxRateBP < 0 || l.TaxRateBP > 10000 {
+		errs = append(errs, FieldError{Field: prefix + "tax_rate_bp", Code: "out_of_range", Message: "must be from 0 to 10000"})
+	}
+	return in, errs
+}
+
+// invoiceDiscountError checks an invoice-level discount
+func invoiceDiscountError(discountCents int64) []FieldError {
+	if discountCents < 0 {
+		return []FieldError{{Field: "discount_cents", Code: "negative", Message: "must not be negative"}}
+	}
+	return nil
+}
+
+// writeInvoiceError maps billing errors from the data package to responses
+func writeInvoiceError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, r, "invoice, visit or service not found", http.StatusNotFound)
+	case errors.Is(err, data.ErrInvoiceState), errors.Is(err, data.ErrInsufficientStock):
+		writeError(w, r, err.Error(), http.StatusConflict)
+	case errors.Is(err, data.ErrDiscountTooLarge):
+		// Line discounts are checked up front, so this is the invoice's
+		// discount against its total, or a catalog service's line
+		rejectInvalid(w, r, []FieldError{{Field: "discount_cents", Code: "too_large", Message: "must not exceed the amount it applies to"}})
+	case errors.Is(err, data.ErrNegativeAmount):
+		rejectInvalid(w, r, []FieldError{{Field: "lines", Code: "negative", Message: "prices and discounts must not be negative"}})
+	case tenantError(w, r, err):
+	case errors.Is(err, data.ErrConflict), errors.Is(err, data.ErrForeignKey), errors.Is(err, data.ErrUnavailable):
+		dataError(w, r, err, "invoice")
+	default:
+		logger.ErrorCtx(r.Context(), "Failed to %s: %v", action, err)
+		writeError(w, r, "failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+func GetInvoices(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Fetching all invoices")
+	rows, err := data.ListInvoices(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch invoices: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	invoices := make([]Invoice, len(rows))
+	for i, ri := range rows {
+		invoices[i] = invoiceFromRow(ri)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+func GetInvoiceByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	ri, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		dataError(w, r, err, "invoice")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceFromRow(ri))
+}
+
+// CreateInvoice generates a draft invoice from a visit. The invoice is billed
+// to the owner of the visited pet.
+func CreateInvoice(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Creating new invoice")
+	var req createInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.VisitID == 0 {
+		writeError(w, r, "visit_id is required", http.StatusBadRequest)
+		return
+	}
+
+	in := data.InvoiceInput{VisitID: req.VisitID, Currency: req.Currency, DiscountCents: req.DiscountCents}
+	errs := invoiceDiscountError(req.DiscountCents)
+	for i, l := range req.Lines {
+		li, lineErrs := invoiceLineInput(l, fmt.Sprintf("lines[%d].", i))
+		errs = append(errs, lineErrs...)
+		in.Lines = append(in.Lines, li)
+	}
+	if rejectInvalid(w, r, errs) {
+		return
+	}
+
+	id, err := data.CreateInvoiceFromVisit(DB, tenantOf(r), actorOf(r), in)
+	if err != nil {
+		writeInvoiceError(w, r, err, "create invoice")
+		return
+	}
+	ri, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Successfully created invoice with ID: %d for visit %d", id, req.VisitID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invoiceFromRow(ri))
+}
+
+// UpdateInvoice changes the invoice-level discount of a draft invoice
+func UpdateInvoice(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req updateInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rejectInvalid(w, r, invoiceDiscountError(req.DiscountCents)) {
+		return
+	}
+
+	if err := data.SetInvoiceDiscount(DB, tenantOf(r), actorOf(r), id, req.DiscountCents); err != nil {
+		writeInvoiceError(w, r, err, "update invoice")
+		return
+	}
+	ri, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceFromRow(ri))
+}
+
+// AddInvoiceLine adds a procedure, medication or consumable line to a draft invoice
+func AddInvoiceLine(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var l InvoiceLine
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in, errs := invoiceLineInput(l, "")
+	if rejectInvalid(w, r, errs) {
+		return
+	}
+
+	if err := data.AddInvoiceLine(DB, tenantOf(r), actorOf(r), id, in); err != nil {
+		writeInvoiceError(w, r, err, "add invoice line")
+		return
+	}
+	ri, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invoiceFromRow(ri))
+}
+
+// IssueInvoice finalises a draft invoice so it counts towards the owner's
+// balance. Issued invoices become paid once payments cover the total.
+func IssueInvoice(w http.ResponseWriter, r *http.Request) {
+	transitionInvoice(w, r, data.InvoiceIssued, data.InvoiceDraft)
+}
+
+// VoidInvoice cancels a draft or issued invoice
+func VoidInvoice(w http.ResponseWriter, r *http.Request) {
+	transitionInvoice(w, r, data.InvoiceVoid, data.InvoiceDraft, data.InvoiceIssued)
+}
+
+// transitionInvoice moves an invoice to status `to` when it is currently in
+// one of the `from` statuses
+func transitionInvoice(w http.ResponseWriter, r *http.Request, to string, from ...string) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.TransitionInvoice(DB, tenantOf(r), actorOf(r), id, to, from...); err != nil {
+		writeInvoiceError(w, r, err, "update invoice status")
+		return
+	}
+	ri, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Invoice %d is now %s", id, to)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceFromRow(ri))
+}
+
+// GetOwnerInvoices lists an owner's invoices together with the outstanding balance
+func GetOwnerInvoices(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid owner ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetOwnerByID(DB, tenantOf(r), id, false); err != nil {
+		dataError(w, r, err, "owner")
+		return
+	}
+
+	rows, err := data.ListInvoicesByOwner(DB, tenantOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch invoices for owner %d: %v", id, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	balance, err := data.OwnerBalance(DB, tenantOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to compute balance for owner %d: %v", id, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	invoices := make([]Invoice, len(rows))
+	for i, ri := range rows {
+		invoices[i] = invoiceFromRow(ri)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"owner_id":      id,
+		"balance_cents": balance,
+		"invoices":      invoices,
+	})
+}
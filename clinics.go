@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Clinic struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// defaultClinicID is the clinic self-registered and single sign-on accounts
+// join (DEFAULT_CLINIC_ID, 1 by default)
+var defaultClinicID = 1
+
+// initClinics reads the clinic new accounts are created in
+func initClinics() error {
+	v := getenvDefault("DEFAULT_CLINIC_ID", "1")
+	id, err := strconv.Atoi(v)
+	if err != nil || id <= 0 {
+		return fmt.Errorf("DEFAULT_CLINIC_ID %q is not a clinic id", v)
+	}
+	defaultClinicID = id
+	return nil
+}
+
+// tenantOf returns the clinic the authenticated request is limited to.
+// Only super-admins who have not picked a clinic get data.AllClinics.
+func tenantOf(r *http.Request) data.Tenant {
+	t, _ := r.Context().Value(ctxClinicKey).(data.Tenant)
+	return t
+}
+
+// resolveTenant works out the clinic of a request from the token's
+// clinic_id claim, which must still match the account. Super-admins have no
+// clinic and may pick one with the X-Clinic-ID header. On failure it has
+// already written the response.
+func resolveTenant(w http.ResponseWriter, r *http.Request, u data.UserRow, claims jwt.MapClaims) (data.Tenant, bool) {
+	if u.Role == data.RoleSuperAdmin {
+		h := strings.TrimSpace(r.Header.Get("X-Clinic-ID"))
+		if h == "" {
+			return data.AllClinics, true
+		}
+		id, err := strconv.Atoi(h)
+		if err != nil || id <= 0 {
+			writeError(w, r, "invalid X-Clinic-ID", http.StatusBadRequest)
+			return data.AllClinics, false
+		}
+		if _, err := data.GetClinicByID(DB, id); err != nil {
+			if errors.Is(err, data.ErrNotFound) {
+				writeError(w, r, "clinic not found", http.StatusBadRequest)
+			} else {
+				dataError(w, r, err, "clinic")
+			}
+			return data.AllClinics, false
+		}
+		return data.Tenant(id), true
+	}
+
+	claim, _ := claims["clinic_id"].(float64)
+	if u.ClinicID == nil || int(claim) != *u.ClinicID {
+		logger.WarnCtx(r.Context(), "Auth: clinic of token does not match user %d", u.ID)
+		writeError(w, r, "invalid token claims", http.StatusUnauthorized)
+		return data.AllClinics, false
+	}
+	return data.Tenant(*u.ClinicID), true
+}
+
+// tenantError answers errors about the clinic a record belongs to. It
+// reports false for any other error.
+func tenantError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, data.ErrClinicRequired):
+		writeError(w, r, "choose a clinic with the X-Clinic-ID header", http.StatusBadRequest)
+	case errors.Is(err, data.ErrOtherClinic):
+		logger.WarnCtx(r.Context(), "Rejected reference across clinics: %v", err)
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
+
+func clinicFromRow(c data.ClinicRow) Clinic {
+	return Clinic{ID: c.ID, Name: c.Name, CreatedAt: c.CreatedAt}
+}
+
+// -------------------- Super-admin --------------------
+
+func GetClinics(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListClinics(DB)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch clinics: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	clinics := make([]Clinic, len(rows))
+	for i, c := range rows {
+		clinics[i] = clinicFromRow(c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clinics)
+}
+
+func GetClinicByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	c, err := data.GetClinicByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "clinic")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clinicFromRow(c))
+}
+
+// clinicName decodes and checks the body of a create or update request
+func clinicName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req Clinic
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return "", false
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 100 {
+		writeError(w, r, "name is required and must be at most 100 characters", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+func CreateClinic(w http.ResponseWriter, r *http.Request) {
+	name, ok := clinicName(w, r)
+	if !ok {
+		return
+	}
+	c, err := data.CreateClinic(DB, actorOf(r), name)
+	if err != nil {
+		dataError(w, r, err, "clinic")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Created clinic %d (%s)", c.ID, c.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(clinicFromRow(c))
+}
+
+func UpdateClinic(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	name, ok := clinicName(w, r)
+	if !ok {
+		return
+	}
+	c, err := data.UpdateClinic(DB, actorOf(r), id, name)
+	if err != nil {
+		dataError(w, r, err, "clinic")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Renamed clinic %d to %s", c.ID, c.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clinicFromRow(c))
+}
@@ -0,0 +1,69 @@
+// Command breachedlist turns a breached-password list into the range files
+// read by BREACHED_PASSWORDS_DIR.
+//
+//	go run ./cmd/breachedlist -out breached < passwords.txt
+//
+// Input lines are either plain passwords or, with -hashes, full SHA-1 hashes
+// as "HASH" or "HASH:COUNT" (the Pwned Passwords download format).
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"petclinic/password"
+)
+
+func main() {
+	out := flag.String("out", "breached", "directory to write range files to")
+	hashes := flag.Bool("hashes", false, "input lines are SHA-1 hashes, optionally with :COUNT")
+	flag.Parse()
+
+	counts := map[string]string{}
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		h, count := password.Hash(line), "1"
+		if *hashes {
+			var ok bool
+			h, count, ok = strings.Cut(strings.TrimSpace(line), ":")
+			if !ok {
+				count = "1"
+			}
+			h = strings.ToUpper(h)
+			if len(h) != 40 {
+				log.Fatalf("not a SHA-1 hash: %q", line)
+			}
+		}
+		counts[h] = count
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	ranges := map[string][]string{}
+	for h, c := range counts {
+		p := h[:password.PrefixLen]
+		ranges[p] = append(ranges[p], h[password.PrefixLen:]+":"+c)
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	for p, lines := range ranges {
+		sort.Strings(lines)
+		if err := os.WriteFile(filepath.Join(*out, p), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("wrote %d hashes in %d range files to %s\n", len(counts), len(ranges), *out)
+}
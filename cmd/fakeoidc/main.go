@@ -0,0 +1,43 @@
+// Command fakeoidc runs a local OpenID Connect provider so staff single
+// sign-on can be exercised without a corporate identity provider.
+//
+//	go run ./cmd/fakeoidc
+//
+// Point the clinic at it with OIDC_ISSUER=http://localhost:8091,
+// OIDC_CLIENT_ID=petclinic and OIDC_CLIENT_SECRET=fake-secret. It knows
+// admin@clinic.test (group clinic-admins), vet@clinic.test (clinic-staff)
+// and guest@clinic.test (no clinic group).
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"petclinic/oidc"
+)
+
+func getenvDefault(k, d string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return d
+}
+
+func main() {
+	addr := getenvDefault("FAKE_OIDC_ADDR", ":8091")
+	issuer := getenvDefault("FAKE_OIDC_ISSUER", "http://localhost:8091")
+
+	p, err := oidc.NewFakeProvider(issuer,
+		getenvDefault("OIDC_CLIENT_ID", "petclinic"),
+		getenvDefault("OIDC_CLIENT_SECRET", "fake-secret"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.AddUser(oidc.FakeUser{Subject: "u-admin", Email: "admin@clinic.test", EmailVerified: true, Name: "Alex Admin", Groups: []string{"clinic-admins"}})
+	p.AddUser(oidc.FakeUser{Subject: "u-vet", Email: "vet@clinic.test", EmailVerified: true, Name: "Vera Vet", Groups: []string{"clinic-staff"}})
+	p.AddUser(oidc.FakeUser{Subject: "u-guest", Email: "guest@clinic.test", EmailVerified: true, Name: "Gus Guest"})
+
+	log.Printf("fake OIDC provider %s listening on %s", issuer, addr)
+	log.Fatal(http.ListenAndServe(addr, p))
+}
@@ -0,0 +1,34 @@
+// Command fakeprocessor runs a local fake of the card processor API so the
+// card payment flow can be exercised end to end without a real account.
+//
+//	CARD_PROCESSOR_WEBHOOK_SECRET=whsec go run ./cmd/fakeprocessor
+//
+// Point the clinic at it with CARD_PROCESSOR_URL=http://localhost:8090.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"petclinic/payment"
+)
+
+func getenvDefault(k, d string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return d
+}
+
+func main() {
+	addr := getenvDefault("FAKE_PROCESSOR_ADDR", ":8090")
+	webhookURL := getenvDefault("FAKE_PROCESSOR_WEBHOOK_URL", "http://localhost:8080/payments/webhook")
+	secret := os.Getenv("CARD_PROCESSOR_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("CARD_PROCESSOR_WEBHOOK_SECRET must be set")
+	}
+
+	log.Printf("fake card processor listening on %s, webhooks to %s", addr, webhookURL)
+	log.Fatal(http.ListenAndServe(addr, payment.NewFakeProcessor(webhookURL, secret)))
+}
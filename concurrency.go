@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Owners, pets, vets and visits are served with an ETag holding their
+// version. Changes may send it back in If-Match so that an edit based on a
+// stale copy fails with 412 instead of overwriting someone else's change.
+// With IF_MATCH_REQUIRED=true a missing If-Match is answered with 428.
+
+var ifMatchRequired bool
+
+func initPreconditions() error {
+	v := getenvDefault("IF_MATCH_REQUIRED", "false")
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("IF_MATCH_REQUIRED %q is not a boolean", v)
+	}
+	ifMatchRequired = b
+	return nil
+}
+
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", etag(version))
+}
+
+// etagMatches reports whether a list of entity tags such as an If-Match
+// header names version. Weak tags compare by their value.
+func etagMatches(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch checks the If-Match header of a change against the version
+// the record is at. On failure it has already written the response.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		if ifMatchRequired {
+			writeError(w, r, "send If-Match with the ETag of the record you are changing", http.StatusPreconditionRequired)
+			return false
+		}
+		return true
+	}
+	if !etagMatches(h, version) {
+		setETag(w, version)
+		writeError(w, r, "record was changed since you read it; fetch it again", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// notModified sets the ETag of a fetched record and answers 304 when the
+// client's If-None-Match already names it
+func notModified(w http.ResponseWriter, r *http.Request, version int) bool {
+	setETag(w, version)
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
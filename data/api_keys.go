@@ -0,0 +1,138 @@
+package data
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIKeyRow is a key used by an integration instead of a user login. Only
+// the SHA-256 of the secret part is stored; the prefix identifies the key.
+// A key works within one clinic.
+type APIKeyRow struct {
+	ID         int
+	ClinicID   int
+	Name       string
+	Prefix     string
+	SecretHash string
+	Scopes     []string
+	CreatedBy  *int
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+const apiKeyColumns = "id, clinic_id, name, prefix, secret_hash, scopes, created_by, created_at, expires_at, last_used_at, revoked_at"
+
+func scanAPIKey(s rowScanner) (APIKeyRow, error) {
+	var k APIKeyRow
+	var createdBy sql.NullInt64
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := s.Scan(&k.ID, &k.ClinicID, &k.Name, &k.Prefix, &k.SecretHash, pq.Array(&k.Scopes), &createdBy,
+		&k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if createdBy.Valid {
+		v := int(createdBy.Int64)
+		k.CreatedBy = &v
+	}
+	k.ExpiresAt = timePtr(expiresAt)
+	k.LastUsedAt = timePtr(lastUsedAt)
+	k.RevokedAt = timePtr(revokedAt)
+	return k, err
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	v := t.Time
+	return &v
+}
+
+// CreateAPIKey stores a new key for the tenant's clinic. expiresAt may be
+// nil for keys that do not expire.
+func CreateAPIKey(db *sql.DB, t Tenant, a Actor, name, prefix, secretHash string, scopes []string, createdBy int, expiresAt *time.Time) (APIKeyRow, error) {
+	if t == AllClinics {
+		return APIKeyRow{}, ErrClinicRequired
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return APIKeyRow{}, err
+	}
+	defer tx.Rollback()
+
+	k, err := scanAPIKey(tx.QueryRow(`INSERT INTO api_keys(name, prefix, secret_hash, scopes, created_by, expires_at, clinic_id)
+		VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING `+apiKeyColumns,
+		name, prefix, secretHash, pq.Array(scopes), nullableID(createdBy), expiresAt, t))
+	if err != nil {
+		return k, err
+	}
+	if err := audit(tx, a, AuditCreate, "api_keys", k.ID, nil); err != nil {
+		return k, err
+	}
+	return k, tx.Commit()
+}
+
+func ListAPIKeys(db *sql.DB, t Tenant) ([]APIKeyRow, error) {
+	rows, err := db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE "+inTenant("clinic_id", 1)+" ORDER BY id", t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKeyRow
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func GetAPIKeyByID(db *sql.DB, t Tenant, id int) (APIKeyRow, error) {
+	k, err := scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1 AND "+inTenant("clinic_id", 2), id, t))
+	return k, classify(err)
+}
+
+// FindActiveAPIKey returns the key with prefix unless it is revoked or
+// expired
+func FindActiveAPIKey(db *sql.DB, prefix string) (APIKeyRow, error) {
+	return scanAPIKey(db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE prefix = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)`, prefix))
+}
+
+// TouchAPIKey records a use of the key. It writes at most once a minute per
+// key so busy integrations do not turn every request into an update. As
+// bookkeeping of requests it is not audited.
+func TouchAPIKey(db *sql.DB, id int) error {
+	_, err := db.Exec(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`, id)
+	return err
+}
+
+// RevokeAPIKey stops a key from working. It reports false when the key does
+// not exist or was already revoked.
+func RevokeAPIKey(db *sql.DB, t Tenant, a Actor, id int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	err = audited(tx, a, AuditUpdate, "api_keys", id, func() error {
+		res, err := tx.Exec("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL AND "+inTenant("clinic_id", 2), id, t)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
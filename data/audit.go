@@ -0,0 +1,329 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Every change to a record of the clinic (owners, pets, vets, visits and
+// their prescriptions and lab work, invoices and payments, stock, portal
+// invitations), to an account (users, their MFA and API keys) or to what the
+// clinics share (the service, species, breed and reference range catalogs,
+// the clinics themselves and the MFA policy) is recorded in audit_events, in
+// the transaction of the change: who made it, in which request, and the
+// fields it changed with their values before and after. Secrets such as
+// password hashes are recorded only as changed, never by value.
+
+// Actor is who makes a change. UserID is 0 for API keys and APIKeyID 0 for
+// users; both are 0 for background jobs.
+type Actor struct {
+	UserID    int
+	APIKeyID  int
+	RequestID string
+}
+
+// Audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// auditEntities names the entity type recorded for each audited table
+var auditEntities = map[string]string{
+	"owners":               "owner",
+	"pets":                 "pet",
+	"vets":                 "vet",
+	"visits":               "visit",
+	"prescriptions":        "prescription",
+	"lab_orders":           "lab_order",
+	"lab_results":          "lab_result",
+	"invoices":             "invoice",
+	"invoice_lines":        "invoice_line",
+	"payments":             "payment",
+	"stock_locations":      "stock_location",
+	"stock_items":          "stock_item",
+	"stock_batches":        "stock_batch",
+	"stock_movements":      "stock_movement",
+	"users":                "user",
+	"user_recovery_codes":  "recovery_code",
+	"api_keys":             "api_key",
+	"owner_invitations":    "owner_invitation",
+	"services":             "service",
+	"species":              "species",
+	"breeds":               "breed",
+	"lab_reference_ranges": "lab_reference_range",
+	"clinics":              "clinic",
+	"mfa_policy":           "mfa_policy",
+}
+
+// AuditEntityTypes are the entity types audit events are recorded for
+var AuditEntityTypes = []string{
+	"owner", "pet", "vet", "visit", "prescription", "lab_order", "lab_result",
+	"invoice", "invoice_line", "payment", "stock_location", "stock_item", "stock_batch",
+	"stock_movement", "user", "recovery_code", "api_key", "owner_invitation",
+	"service", "species", "breed", "lab_reference_range", "clinic", "mfa_policy",
+}
+
+// auditParents names, for the audited tables without a clinic_id column,
+// the column pointing at the row of another table whose clinic they are of.
+// Tables that are neither, such as the catalogs, are audited with no clinic.
+var auditParents = map[string]struct{ column, table string }{
+	"prescriptions":       {"visit_id", "visits"},
+	"lab_orders":          {"visit_id", "visits"},
+	"lab_results":         {"order_id", "lab_orders"},
+	"invoices":            {"owner_id", "owners"},
+	"invoice_lines":       {"invoice_id", "invoices"},
+	"payments":            {"invoice_id", "invoices"},
+	"stock_movements":     {"batch_id", "stock_batches"},
+	"user_recovery_codes": {"user_id", "users"},
+	"owner_invitations":   {"owner_id", "owners"},
+}
+
+// auditSecrets are the columns recorded as "redacted" instead of their value
+var auditSecrets = map[string]bool{
+	"password_hash": true,
+	"totp_secret":   true,
+	"secret_hash":   true,
+	"code_hash":     true,
+	"token_hash":    true,
+}
+
+// AuditEventRow is one row of audit_events
+type AuditEventRow struct {
+	ID         int
+	ActorID    *int
+	ActorEmail string
+	APIKeyID   *int
+	Action     string
+	EntityType string
+	EntityID   int
+	ClinicID   *int
+	Before     json.RawMessage
+	After      json.RawMessage
+	RequestID  string
+	CreatedAt  time.Time
+}
+
+// snapshot locks row id of table and returns its columns, or nil when it
+// does not exist
+func snapshot(tx *sql.Tx, table string, id int) (map[string]interface{}, error) {
+	var b []byte
+	err := tx.QueryRow("SELECT to_jsonb(t) FROM "+table+" t WHERE t.id = $1 FOR UPDATE", id).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var row map[string]interface{}
+	return row, json.Unmarshal(b, &row)
+}
+
+// audited runs change on row id of table and records it as action by a
+func audited(tx *sql.Tx, a Actor, action, table string, id int, change func() error) error {
+	before, err := snapshot(tx, table, id)
+	if err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return audit(tx, a, action, table, id, before)
+}
+
+// auditedRows runs change, which may touch any of the rows of table matching
+// where (arguments from placeholder 1), and records each row it changed as
+// action by a
+func auditedRows(tx *sql.Tx, a Actor, action, table, where string, args []interface{}, change func() error) error {
+	rows, err := tx.Query("SELECT id FROM "+table+" WHERE "+where+" FOR UPDATE", args...)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	before := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		if before[i], err = snapshot(tx, table, id); err != nil {
+			return err
+		}
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if err := audit(tx, a, action, table, id, before[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// audit records that a changed row id of table, which looked like before
+// (nil for a new row). Only the columns that changed are kept; an update
+// that changed nothing is not recorded.
+func audit(tx *sql.Tx, a Actor, action, table string, id int, before map[string]interface{}) error {
+	after, err := snapshot(tx, table, id)
+	if err != nil {
+		return err
+	}
+	from, to := diffRows(before, after)
+	if from == nil && to == nil {
+		return nil
+	}
+	row := after
+	if row == nil {
+		row = before
+	}
+	clinic, err := auditClinic(tx, table, row)
+	if err != nil {
+		return err
+	}
+	redact(from)
+	redact(to)
+	_, err = tx.Exec(`INSERT INTO audit_events(actor_id, api_key_id, action, entity_type, entity_id, clinic_id, before, after, request_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		nullableID(a.UserID), nullableID(a.APIKeyID), action, auditEntities[table], id, nullableID(clinic),
+		jsonOrNull(from), jsonOrNull(to), a.RequestID)
+	return err
+}
+
+// auditClinic returns the clinic row of table belongs to, following
+// auditParents for tables without a clinic_id column. It is 0 for accounts
+// of no clinic, i.e. superadmins.
+func auditClinic(tx *sql.Tx, table string, row map[string]interface{}) (int, error) {
+	for {
+		if clinic, ok := row["clinic_id"]; ok {
+			id, _ := clinic.(float64)
+			return int(id), nil
+		}
+		parent, ok := auditParents[table]
+		if !ok {
+			return 0, nil
+		}
+		id, _ := row[parent.column].(float64)
+		var b []byte
+		err := tx.QueryRow("SELECT to_jsonb(t) FROM "+parent.table+" t WHERE t.id = $1", int(id)).Scan(&b)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		row = nil
+		if err := json.Unmarshal(b, &row); err != nil {
+			return 0, err
+		}
+		table = parent.table
+	}
+}
+
+// redact replaces the values of the auditSecrets columns of a diff, keeping
+// whether they were set
+func redact(diff map[string]interface{}) {
+	for k, v := range diff {
+		if auditSecrets[k] && v != nil {
+			diff[k] = "redacted"
+		}
+	}
+}
+
+// diffRows returns the columns of before and after whose values differ.
+// The version column, which every change bumps, is left out.
+func diffRows(before, after map[string]interface{}) (from, to map[string]interface{}) {
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	delete(keys, "version")
+	for k := range keys {
+		b, inBefore := before[k]
+		v, inAfter := after[k]
+		if inBefore && inAfter && reflect.DeepEqual(b, v) {
+			continue
+		}
+		if before != nil {
+			if from == nil {
+				from = map[string]interface{}{}
+			}
+			from[k] = b
+		}
+		if after != nil {
+			if to == nil {
+				to = map[string]interface{}{}
+			}
+			to[k] = v
+		}
+	}
+	return from, to
+}
+
+// jsonOrNull encodes m for a JSONB column, with nil as NULL
+func jsonOrNull(m map[string]interface{}) interface{} {
+	if m == nil {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
+
+// ListAuditEvents returns the history of one record of entityType in t,
+// oldest first. id 0 lists every record of the entity type. Events of
+// superadmin accounts belong to no clinic and are listed for AllClinics only.
+func ListAuditEvents(db *sql.DB, t Tenant, entityType string, id int) ([]AuditEventRow, error) {
+	rows, err := db.Query(`SELECT a.id, a.actor_id, COALESCE(u.email, ''), a.api_key_id, a.action, a.entity_type,
+		a.entity_id, a.clinic_id, a.before, a.after, COALESCE(a.request_id, ''), a.created_at
+		FROM audit_events a LEFT JOIN users u ON u.id = a.actor_id
+		WHERE a.entity_type = $1 AND ($2 = 0 OR a.entity_id = $2) AND `+inTenant("a.clinic_id", 3)+`
+		ORDER BY a.created_at, a.id`, entityType, id, t)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+	res := []AuditEventRow{}
+	for rows.Next() {
+		var e AuditEventRow
+		var actorID, apiKeyID, clinicID sql.NullInt64
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &actorID, &e.ActorEmail, &apiKeyID, &e.Action, &e.EntityType,
+			&e.EntityID, &clinicID, &before, &after, &e.RequestID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			v := int(actorID.Int64)
+			e.ActorID = &v
+		}
+		if apiKeyID.Valid {
+			v := int(apiKeyID.Int64)
+			e.APIKeyID = &v
+		}
+		if clinicID.Valid {
+			v := int(clinicID.Int64)
+			e.ClinicID = &v
+		}
+		e.Before, e.After = before, after
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tenant is the clinic queries are limited to. AllClinics lifts the limit;
+// only super-admins and background jobs use it.
+type Tenant int
+
+const AllClinics Tenant = 0
+
+// Value binds the tenant as a query argument: NULL for AllClinics
+func (t Tenant) Value() (driver.Value, error) {
+	if t == AllClinics {
+		return nil, nil
+	}
+	return int64(t), nil
+}
+
+// ErrClinicRequired is returned when a record that belongs to a clinic is
+// created without one, which only happens for super-admins who have not
+// picked a clinic
+var ErrClinicRequired = errors.New("choose a clinic to create this record in")
+
+// ErrOtherClinic is returned when a referenced owner, pet or vet does not
+// exist in the clinic of the record that refers to it
+var ErrOtherClinic = errors.New("referenced record does not exist in this clinic")
+
+// inTenant is the condition that limits col to the tenant bound to
+// placeholder n
+func inTenant(col string, n int) string {
+	return fmt.Sprintf("($%d::int IS NULL OR %s = $%d)", n, col, n)
+}
+
+type ClinicRow struct {
+	ID        int
+	Name      string
+	CreatedAt time.Time
+}
+
+func ListClinics(db *sql.DB) ([]ClinicRow, error) {
+	rows, err := db.Query("SELECT id, name, created_at FROM clinics ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ClinicRow{}
+	for rows.Next() {
+		var c ClinicRow
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+func GetClinicByID(db *sql.DB, id int) (ClinicRow, error) {
+	var c ClinicRow
+	err := db.QueryRow("SELECT id, name, created_at FROM clinics WHERE id = $1", id).Scan(&c.ID, &c.Name, &c.CreatedAt)
+	return c, classify(err)
+}
+
+func CreateClinic(db *sql.DB, a Actor, name string) (ClinicRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ClinicRow{}, classify(err)
+	}
+	defer tx.Rollback()
+
+	var c ClinicRow
+	err = tx.QueryRow("INSERT INTO clinics(name) VALUES($1) RETURNING id, name, created_at", name).
+		Scan(&c.ID, &c.Name, &c.CreatedAt)
+	if err == nil {
+		err = audit(tx, a, AuditCreate, "clinics", c.ID, nil)
+	}
+	if err != nil {
+		return ClinicRow{}, classify(err)
+	}
+	return c, classify(tx.Commit())
+}
+
+func UpdateClinic(db *sql.DB, a Actor, id int, name string) (ClinicRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ClinicRow{}, classify(err)
+	}
+	defer tx.Rollback()
+
+	var c ClinicRow
+	err = audited(tx, a, AuditUpdate, "clinics", id, func() error {
+		return tx.QueryRow("UPDATE clinics SET name = $1 WHERE id = $2 RETURNING id, name, created_at", name, id).
+			Scan(&c.ID, &c.Name, &c.CreatedAt)
+	})
+	if err != nil {
+		return ClinicRow{}, classify(err)
+	}
+	return c, classify(tx.Commit())
+}
+
+// clinicOf returns the clinic of a row of an owner, pet, vet or visit table,
+// or sql.ErrNoRows when it does not exist in the tenant or is deleted
+func clinicOf(q querier, table string, id int, t Tenant) (int, error) {
+	var c int
+	err := q.QueryRow("SELECT clinic_id FROM "+table+" WHERE id = $1 AND deleted_at IS NULL AND "+inTenant("clinic_id", 2), id, t).Scan(&c)
+	return c, err
+}
+
+// ExistsInTenant reports whether a row of an owner, pet, vet or visit table
+// exists in the tenant
+func ExistsInTenant(db *sql.DB, t Tenant, table string, id int) (bool, error) {
+	_, err := clinicOf(db, table, id, t)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// referenceInClinic returns ErrOtherClinic unless the row exists in clinic
+func referenceInClinic(q querier, table string, id, clinic int) error {
+	_, err := clinicOf(q, table, id, Tenant(clinic))
+	if err == sql.ErrNoRows {
+		return ErrOtherClinic
+	}
+	return err
+}
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
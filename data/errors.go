@@ -0,0 +1,78 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of failure of the data functions, such as those of owners, pets,
+// users and the catalogs. Their errors wrap one of these together with the
+// database error, so errors.Is works with either, e.g. with ErrNotFound or
+// sql.ErrNoRows.
+var (
+	ErrNotFound = errors.New("record not found")
+	ErrConflict = errors.New("record conflicts with an existing one")
+	// ErrInUse is the ErrConflict of deleting a record others still refer to
+	ErrInUse       = fmt.Errorf("%w: it is still referenced", ErrConflict)
+	ErrForeignKey  = errors.New("referenced record does not exist")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// classify wraps err with the kind of failure it is: no rows, a unique or
+// foreign key violation, or a lost or refused connection. Other errors are
+// returned as they are.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pqErr *pq.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &pqErr):
+		switch code := string(pqErr.Code); {
+		case code == "23505":
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case code == "23503":
+			return fmt.Errorf("%w: %w", ErrForeignKey, err)
+		case strings.HasPrefix(code, "08"), strings.HasPrefix(code, "53"), strings.HasPrefix(code, "57P"):
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// classifyDelete is classify for deletes, where a foreign key violation
+// means another record still refers to the one being deleted
+func classifyDelete(err error) error {
+	c := classify(err)
+	if errors.Is(c, ErrForeignKey) {
+		return fmt.Errorf("%w: %w", ErrInUse, err)
+	}
+	return c
+}
+
+// affected turns an update or delete that matched no row into sql.ErrNoRows,
+// for classify to report as ErrNotFound
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrIdempotencyKeyMismatch is returned when a key is sent again with a
+	// different request
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key already used for a different request")
+	// ErrIdempotencyKeyInProgress is returned while the first request with
+	// a key is still being served
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// idempotencyStaleAfter is how long a claim may stay without a response
+// before a retry of the same request may take it over, so a server that
+// died mid-request does not block the key for the whole window
+const idempotencyStaleAfter = 5 * time.Minute
+
+// StoredResponse is the response recorded for an idempotency key, with the
+// headers to send again when it is replayed
+type StoredResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    []byte
+}
+
+// ClaimIdempotencyKey reserves key within scope for a request with the given
+// fingerprint until window has passed. It returns nil when the caller now
+// holds the key and must serve the request, and the stored response when the
+// same request was already served. Concurrent claims of one key are settled
+// by the primary key: only one of them wins, the others see it in progress.
+func ClaimIdempotencyKey(db *sql.DB, scope, key, fingerprint string, window time.Duration) (*StoredResponse, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		var claimed bool
+		err := db.QueryRow(`INSERT INTO idempotency_keys(scope, idempotency_key, fingerprint, expires_at)
+			VALUES ($1, $2, $3, now() + $4 * INTERVAL '1 second')
+			ON CONFLICT (scope, idempotency_key) DO UPDATE
+			SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = NULL, body = NULL,
+			    created_at = now(), expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at < now()
+			   OR (idempotency_keys.status IS NULL AND idempotency_keys.fingerprint = EXCLUDED.fingerprint
+			       AND idempotency_keys.created_at < now() - $5 * INTERVAL '1 second')
+			RETURNING true`,
+			scope, key, fingerprint, window.Seconds(), idempotencyStaleAfter.Seconds()).Scan(&claimed)
+		if err == nil {
+			return nil, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, classify(err)
+		}
+
+		var stored StoredResponse
+		var storedFingerprint string
+		var status sql.NullInt64
+		var headers []byte
+		err = db.QueryRow(`SELECT fingerprint, status, headers, body FROM idempotency_keys
+			WHERE scope = $1 AND idempotency_key = $2`, scope, key).
+			Scan(&storedFingerprint, &status, &headers, &stored.Body)
+		if err == sql.ErrNoRows {
+			// released between the two statements; claim again
+			continue
+		}
+		if err != nil {
+			return nil, classify(err)
+		}
+		switch {
+		case storedFingerprint != fingerprint:
+			return nil, ErrIdempotencyKeyMismatch
+		case !status.Valid:
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		stored.Status = int(status.Int64)
+		if headers != nil {
+			if err := json.Unmarshal(headers, &stored.Headers); err != nil {
+				return nil, err
+			}
+		}
+		return &stored, nil
+	}
+	return nil, ErrIdempotencyKeyInProgress
+}
+
+// SaveIdempotentResponse records the response to the request holding key so
+// that retries are answered with it
+func SaveIdempotentResponse(db *sql.DB, scope, key string, resp StoredResponse) error {
+	headers, err := json.Marshal(resp.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE idempotency_keys SET status = $3, headers = $4, body = $5
+		WHERE scope = $1 AND idempotency_key = $2`,
+		scope, key, resp.Status, headers, resp.Body)
+	return classify(err)
+}
+
+// ReleaseIdempotencyKey gives up a claim without a response, for requests
+// that failed in a way a retry may not, so the retry runs again
+func ReleaseIdempotencyKey(db *sql.DB, scope, key string) error {
+	_, err := db.Exec(`DELETE FROM idempotency_keys
+		WHERE scope = $1 AND idempotency_key = $2 AND status IS NULL`, scope, key)
+	return classify(err)
+}
+
+// PurgeIdempotencyKeys deletes keys whose window has passed
+func PurgeIdempotencyKeys(db *sql.DB) (int64, error) {
+	res, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at < now()")
+	if err != nil {
+		return 0, classify(err)
+	}
+	return res.RowsAffected()
+}
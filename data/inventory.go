@@ -0,0 +1,534 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stock movement reasons
+const (
+	MovementReceive      = "receive"
+	MovementPrescription = "prescription"
+	MovementInvoice      = "invoice"
+	MovementAdjustment   = "adjustment"
+	MovementInvoiceVoid  = "invoice_void"
+)
+
+// ErrInsufficientStock is returned when a decrement would drive stock negative
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// Stock locations, items and their batches belong to one clinic; a clinic
+// only sees and moves its own stock.
+
+type StockLocationRow struct {
+	ID       int
+	Name     string
+	ClinicID int
+}
+
+type StockItemRow struct {
+	ID               int
+	SKU              string
+	Name             string
+	Unit             string
+	ReorderThreshold int
+	ServiceID        *int
+	ClinicID         int
+}
+
+type StockItemInput struct {
+	SKU              string
+	Name             string
+	Unit             string
+	ReorderThreshold int
+	ServiceID        int
+}
+
+type StockBatchRow struct {
+	ID         int
+	ItemID     int
+	LocationID int
+	BatchNo    string
+	ExpiresOn  *time.Time
+	Quantity   int
+	ReceivedAt time.Time
+	ClinicID   int
+}
+
+type StockBatchInput struct {
+	ItemID     int
+	LocationID int
+	BatchNo    string
+	ExpiresOn  *time.Time
+	Quantity   int
+}
+
+// StockLevelRow is the usable (unexpired) quantity of an item at a location
+type StockLevelRow struct {
+	ItemID     int
+	LocationID int
+	Quantity   int
+}
+
+// LowStockRow is an item whose usable quantity is at or below its reorder threshold
+type LowStockRow struct {
+	Item     StockItemRow
+	Quantity int
+	Levels   []StockLevelRow
+}
+
+// -------------------- Locations --------------------
+
+func ListStockLocations(db *sql.DB, t Tenant) ([]StockLocationRow, error) {
+	rows, err := db.Query("SELECT id, name, clinic_id FROM stock_locations WHERE "+inTenant("clinic_id", 1)+" ORDER BY name", t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []StockLocationRow{}
+	for rows.Next() {
+		var l StockLocationRow
+		if err := rows.Scan(&l.ID, &l.Name, &l.ClinicID); err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, rows.Err()
+}
+
+func CreateStockLocation(db *sql.DB, t Tenant, a Actor, name string) (int, error) {
+	if t == AllClinics {
+		return 0, ErrClinicRequired
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	if err := tx.QueryRow("INSERT INTO stock_locations(name, clinic_id) VALUES($1, $2) RETURNING id", name, t).Scan(&id); err != nil {
+		return 0, err
+	}
+	if err := audit(tx, a, AuditCreate, "stock_locations", id, nil); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// stockInClinic returns ErrOtherClinic unless row id of a stock table
+// exists in clinic
+func stockInClinic(q querier, table string, id, clinic int) error {
+	var found int
+	err := q.QueryRow("SELECT id FROM "+table+" WHERE id = $1 AND clinic_id = $2", id, clinic).Scan(&found)
+	if err == sql.ErrNoRows {
+		return ErrOtherClinic
+	}
+	return err
+}
+
+// -------------------- Items --------------------
+
+const stockItemColumns = "id, sku, name, unit, reorder_threshold, service_id, clinic_id"
+
+func scanStockItem(s rowScanner) (StockItemRow, error) {
+	var it StockItemRow
+	var serviceID sql.NullInt64
+	err := s.Scan(&it.ID, &it.SKU, &it.Name, &it.Unit, &it.ReorderThreshold, &serviceID, &it.ClinicID)
+	if serviceID.Valid {
+		v := int(serviceID.Int64)
+		it.ServiceID = &v
+	}
+	return it, err
+}
+
+func nullableID(id int) sql.NullInt64 {
+	if id == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(id), Valid: true}
+}
+
+func ListStockItems(db *sql.DB, t Tenant) ([]StockItemRow, error) {
+	rows, err := db.Query("SELECT "+stockItemColumns+" FROM stock_items WHERE "+inTenant("clinic_id", 1)+" ORDER BY sku", t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []StockItemRow{}
+	for rows.Next() {
+		it, err := scanStockItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, it)
+	}
+	return res, rows.Err()
+}
+
+func GetStockItemByID(db *sql.DB, t Tenant, id int) (StockItemRow, error) {
+	return scanStockItem(db.QueryRow("SELECT "+stockItemColumns+" FROM stock_items WHERE id = $1 AND "+inTenant("clinic_id", 2), id, t))
+}
+
+func CreateStockItem(db *sql.DB, t Tenant, a Actor, in StockItemInput) (int, error) {
+	if t == AllClinics {
+		return 0, ErrClinicRequired
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO stock_items(sku,name,unit,reorder_threshold,service_id,clinic_id) VALUES($1,$2,$3,$4,$5,$6) RETURNING id",
+		in.SKU, in.Name, in.Unit, in.ReorderThreshold, nullableID(in.ServiceID), t,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if err := audit(tx, a, AuditCreate, "stock_items", id, nil); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func UpdateStockItem(db *sql.DB, t Tenant, a Actor, id int, in StockItemInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "stock_items", id, func() error {
+		return affected(tx.Exec(
+			"UPDATE stock_items SET sku = $1, name = $2, unit = $3, reorder_threshold = $4, service_id = $5 WHERE id = $6 AND "+inTenant("clinic_id", 7),
+			in.SKU, in.Name, in.Unit, in.ReorderThreshold, nullableID(in.ServiceID), id, t,
+		))
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StockLevels returns the usable quantity of an item of t per location
+func StockLevels(db *sql.DB, t Tenant, itemID int) ([]StockLevelRow, error) {
+	rows, err := db.Query(`SELECT item_id, location_id, SUM(quantity) FROM stock_batches
+		WHERE item_id = $1 AND `+inTenant("clinic_id", 2)+` AND (expires_on IS NULL OR expires_on >= CURRENT_DATE)
+		GROUP BY item_id, location_id ORDER BY location_id`, itemID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []StockLevelRow{}
+	for rows.Next() {
+		var l StockLevelRow
+		if err := rows.Scan(&l.ItemID, &l.LocationID, &l.Quantity); err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, rows.Err()
+}
+
+// -------------------- Batches and movements --------------------
+
+const stockBatchColumns = "id, item_id, location_id, batch_no, expires_on, quantity, received_at, clinic_id"
+
+func scanStockBatch(s rowScanner) (StockBatchRow, error) {
+	var b StockBatchRow
+	var expires sql.NullTime
+	err := s.Scan(&b.ID, &b.ItemID, &b.LocationID, &b.BatchNo, &expires, &b.Quantity, &b.ReceivedAt, &b.ClinicID)
+	if expires.Valid {
+		t := expires.Time
+		b.ExpiresOn = &t
+	}
+	return b, err
+}
+
+// ReceiveStock books a new batch of an item of t into a location of the
+// same clinic
+func ReceiveStock(db *sql.DB, t Tenant, a Actor, in StockBatchInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The item must exist in the tenant; sql.ErrNoRows otherwise
+	var clinic int
+	err = tx.QueryRow("SELECT clinic_id FROM stock_items WHERE id = $1 AND "+inTenant("clinic_id", 2), in.ItemID, t).Scan(&clinic)
+	if err != nil {
+		return 0, err
+	}
+	if err := stockInClinic(tx, "stock_locations", in.LocationID, clinic); err != nil {
+		return 0, err
+	}
+
+	var expires sql.NullTime
+	if in.ExpiresOn != nil {
+		expires = sql.NullTime{Time: *in.ExpiresOn, Valid: true}
+	}
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO stock_batches(item_id,location_id,batch_no,expires_on,quantity,clinic_id) VALUES($1,$2,$3,$4,$5,$6) RETURNING id",
+		in.ItemID, in.LocationID, in.BatchNo, expires, in.Quantity, clinic,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if err := audit(tx, a, AuditCreate, "stock_batches", id, nil); err != nil {
+		return 0, err
+	}
+	if err := recordMovement(tx, a, in.ItemID, id, in.LocationID, in.Quantity, MovementReceive, in.BatchNo); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// AdjustStock corrects the quantity of a batch of t, e.g. after a stock
+// count or for breakage. The batch never goes below zero.
+func AdjustStock(db *sql.DB, t Tenant, a Actor, batchID, delta int, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	b, err := scanStockBatch(tx.QueryRow("SELECT "+stockBatchColumns+" FROM stock_batches WHERE id = $1 AND "+inTenant("clinic_id", 2)+" FOR UPDATE", batchID, t))
+	if err != nil {
+		return err
+	}
+	if b.Quantity+delta < 0 {
+		return ErrInsufficientStock
+	}
+	err = audited(tx, a, AuditUpdate, "stock_batches", batchID, func() error {
+		_, err := tx.Exec("UPDATE stock_batches SET quantity = quantity + $1 WHERE id = $2", delta, batchID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := recordMovement(tx, a, b.ItemID, b.ID, b.LocationID, delta, MovementAdjustment, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// consumeStock takes quantity units of an item out of the unexpired batches
+// of clinic, earliest expiry first. With locationID 0 any location may be
+// used. Batches are locked for the rest of the transaction, so concurrent
+// consumers queue behind each other instead of overdrawing.
+func consumeStock(tx *sql.Tx, a Actor, clinic, itemID, locationID, quantity int, reason, reference string) error {
+	rows, err := tx.Query(`SELECT id, location_id, quantity FROM stock_batches
+		WHERE item_id = $1 AND ($2 = 0 OR location_id = $2) AND clinic_id = $3 AND quantity > 0
+		AND (expires_on IS NULL OR expires_on >= CURRENT_DATE)
+		ORDER BY expires_on NULLS LAST, id
+		FOR UPDATE`, itemID, locationID, clinic)
+	if err != nil {
+		return err
+	}
+	type take struct{ batchID, locationID, qty int }
+	var takes []take
+	remaining := quantity
+	for rows.Next() && remaining > 0 {
+		var id, loc, qty int
+		if err := rows.Scan(&id, &loc, &qty); err != nil {
+			rows.Close()
+			return err
+		}
+		n := qty
+		if n > remaining {
+			n = remaining
+		}
+		takes = append(takes, take{id, loc, n})
+		remaining -= n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%w: item %d is short by %d", ErrInsufficientStock, itemID, remaining)
+	}
+
+	for _, t := range takes {
+		err := audited(tx, a, AuditUpdate, "stock_batches", t.batchID, func() error {
+			_, err := tx.Exec("UPDATE stock_batches SET quantity = quantity - $1 WHERE id = $2", t.qty, t.batchID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := recordMovement(tx, a, itemID, t.batchID, t.locationID, -t.qty, reason, reference); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumeInvoiceStock decrements the stock of the invoice's clinic for
+// invoice lines whose catalog service is linked to a stock item. Quantities
+// already dispensed through prescriptions on the same visit are not taken
+// twice.
+func consumeInvoiceStock(tx *sql.Tx, a Actor, invoiceID int) error {
+	var clinic int
+	err := tx.QueryRow("SELECT o.clinic_id FROM invoices i JOIN owners o ON o.id = i.owner_id WHERE i.id = $1", invoiceID).Scan(&clinic)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT si.id, SUM(l.quantity) - COALESCE((
+			SELECT SUM(p.quantity) FROM prescriptions p
+			WHERE p.item_id = si.id AND p.visit_id = i.visit_id), 0)
+		FROM invoice_lines l
+		JOIN invoices i ON i.id = l.invoice_id
+		JOIN stock_items si ON si.service_id = l.service_id AND si.clinic_id = $2
+		WHERE l.invoice_id = $1
+		GROUP BY si.id, i.visit_id`, invoiceID, clinic)
+	if err != nil {
+		return err
+	}
+	needs := map[int]int{}
+	for rows.Next() {
+		var itemID, qty int
+		if err := rows.Scan(&itemID, &qty); err != nil {
+			rows.Close()
+			return err
+		}
+		if qty > 0 {
+			needs[itemID] = qty
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ref := fmt.Sprintf("invoice:%d", invoiceID)
+	for itemID, qty := range needs {
+		if err := consumeStock(tx, a, clinic, itemID, 0, qty, MovementInvoice, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returnInvoiceStock puts the stock consumeInvoiceStock took for an invoice
+// back into the batches it came from. Nothing is returned twice, and an
+// invoice that was never issued took nothing.
+func returnInvoiceStock(tx *sql.Tx, a Actor, invoiceID int) error {
+	ref := fmt.Sprintf("invoice:%d", invoiceID)
+	rows, err := tx.Query(`SELECT item_id, batch_id, location_id, -SUM(delta) FROM stock_movements
+		WHERE reference = $1 AND reason IN ($2, $3)
+		GROUP BY item_id, batch_id, location_id HAVING SUM(delta) < 0
+		ORDER BY batch_id`, ref, MovementInvoice, MovementInvoiceVoid)
+	if err != nil {
+		return err
+	}
+	type give struct{ itemID, batchID, locationID, qty int }
+	var gives []give
+	for rows.Next() {
+		var g give
+		if err := rows.Scan(&g.itemID, &g.batchID, &g.locationID, &g.qty); err != nil {
+			rows.Close()
+			return err
+		}
+		gives = append(gives, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range gives {
+		err := audited(tx, a, AuditUpdate, "stock_batches", g.batchID, func() error {
+			_, err := tx.Exec("UPDATE stock_batches SET quantity = quantity + $1 WHERE id = $2", g.qty, g.batchID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := recordMovement(tx, a, g.itemID, g.batchID, g.locationID, g.qty, MovementInvoiceVoid, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordMovement(tx *sql.Tx, a Actor, itemID, batchID, locationID, delta int, reason, reference string) error {
+	var id int
+	err := tx.QueryRow(
+		"INSERT INTO stock_movements(item_id,batch_id,location_id,delta,reason,reference) VALUES($1,$2,$3,$4,$5,$6) RETURNING id",
+		itemID, batchID, locationID, delta, reason, reference,
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+	return audit(tx, a, AuditCreate, "stock_movements", id, nil)
+}
+
+// -------------------- Reports --------------------
+
+// LowStock lists the items of t whose usable quantity is at or below their
+// reorder threshold
+func LowStock(db *sql.DB, t Tenant) ([]LowStockRow, error) {
+	rows, err := db.Query(`SELECT si.id, si.sku, si.name, si.unit, si.reorder_threshold, si.service_id, si.clinic_id,
+			COALESCE(SUM(b.quantity), 0) AS qty
+		FROM stock_items si
+		LEFT JOIN stock_batches b ON b.item_id = si.id AND (b.expires_on IS NULL OR b.expires_on >= CURRENT_DATE)
+		WHERE `+inTenant("si.clinic_id", 1)+`
+		GROUP BY si.id
+		HAVING COALESCE(SUM(b.quantity), 0) <= si.reorder_threshold
+		ORDER BY si.sku`, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []LowStockRow{}
+	for rows.Next() {
+		var r LowStockRow
+		var serviceID sql.NullInt64
+		if err := rows.Scan(&r.Item.ID, &r.Item.SKU, &r.Item.Name, &r.Item.Unit, &r.Item.ReorderThreshold, &serviceID, &r.Item.ClinicID, &r.Quantity); err != nil {
+			return nil, err
+		}
+		if serviceID.Valid {
+			v := int(serviceID.Int64)
+			r.Item.ServiceID = &v
+		}
+		res = append(res, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if res[i].Levels, err = StockLevels(db, t, res[i].Item.ID); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// ExpiringBatches lists the batches of t with stock left that expire within
+// the given number of days, including batches that have already expired
+func ExpiringBatches(db *sql.DB, t Tenant, withinDays int) ([]StockBatchRow, error) {
+	rows, err := db.Query(`SELECT `+stockBatchColumns+` FROM stock_batches
+		WHERE quantity > 0 AND expires_on IS NOT NULL AND expires_on <= CURRENT_DATE + $1::int AND `+inTenant("clinic_id", 2)+`
+		ORDER BY expires_on, id`, withinDays, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []StockBatchRow{}
+	for rows.Next() {
+		b, err := scanStockBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrInvitationInvalid is returned for invitation tokens that are unknown,
+// expired or already used
+var ErrInvitationInvalid = errors.New("invitation is invalid or has expired")
+
+type InvitationRow struct {
+	ID        int
+	OwnerID   int
+	CreatedBy *int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// CreateOwnerInvitation stores a one-time invitation for an owner record,
+// created by user a. Only the hash of the token is kept; earlier unused
+// invitations for the same owner stop working.
+func CreateOwnerInvitation(db *sql.DB, a Actor, ownerID int, tokenHash string, expiresAt time.Time) (InvitationRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return InvitationRow{}, classify(err)
+	}
+	defer tx.Rollback()
+
+	open := "owner_id = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP"
+	err = auditedRows(tx, a, AuditUpdate, "owner_invitations", open, []interface{}{ownerID}, func() error {
+		_, err := tx.Exec("UPDATE owner_invitations SET expires_at = CURRENT_TIMESTAMP WHERE "+open, ownerID)
+		return err
+	})
+	if err != nil {
+		return InvitationRow{}, classify(err)
+	}
+	inv := InvitationRow{OwnerID: ownerID, ExpiresAt: expiresAt}
+	err = tx.QueryRow(
+		"INSERT INTO owner_invitations(owner_id,token_hash,created_by,expires_at) VALUES($1,$2,$3,$4) RETURNING id, created_at",
+		ownerID, tokenHash, nullableID(a.UserID), expiresAt,
+	).Scan(&inv.ID, &inv.CreatedAt)
+	if err != nil {
+		return InvitationRow{}, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "owner_invitations", inv.ID, nil); err != nil {
+		return InvitationRow{}, classify(err)
+	}
+	if a.UserID != 0 {
+		inv.CreatedBy = &a.UserID
+	}
+	return inv, classify(tx.Commit())
+}
+
+// AcceptOwnerInvitation redeems an invitation by creating an owner account
+// linked to the invited owner record
+func AcceptOwnerInvitation(db *sql.DB, a Actor, tokenHash, email, passwordHash string) (UserRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserRow{}, err
+	}
+	defer tx.Rollback()
+
+	var id, ownerID, clinicID int
+	err = tx.QueryRow(`SELECT i.id, i.owner_id, o.clinic_id FROM owner_invitations i JOIN owners o ON o.id = i.owner_id
+		WHERE i.token_hash = $1 AND i.used_at IS NULL AND i.expires_at > CURRENT_TIMESTAMP FOR UPDATE OF i`, tokenHash).Scan(&id, &ownerID, &clinicID)
+	if err == sql.ErrNoRows {
+		return UserRow{}, ErrInvitationInvalid
+	}
+	if err != nil {
+		return UserRow{}, err
+	}
+
+	u, err := scanUser(tx.QueryRow("INSERT INTO users(email, password_hash, role, owner_id, clinic_id) VALUES($1,$2,$3,$4,$5) RETURNING "+userColumns,
+		email, passwordHash, RoleOwner, ownerID, clinicID))
+	if err != nil {
+		return UserRow{}, err
+	}
+	if err := audit(tx, a, AuditCreate, "users", u.ID, nil); err != nil {
+		return UserRow{}, err
+	}
+	if _, err := tx.Exec("UPDATE owner_invitations SET used_at = CURRENT_TIMESTAMP, user_id = $1 WHERE id = $2", u.ID, id); err != nil {
+		return UserRow{}, err
+	}
+	return u, tx.Commit()
+}
@@ -0,0 +1,399 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Invoice statuses. An invoice starts as a draft, is issued to the owner,
+// and ends either paid or void.
+const (
+	InvoiceDraft  = "draft"
+	InvoiceIssued = "issued"
+	InvoicePaid   = "paid"
+	InvoiceVoid   = "void"
+)
+
+var (
+	// ErrInvoiceState is returned when an invoice is not in a status that
+	// allows the requested change
+	ErrInvoiceState = errors.New("invoice status does not allow this change")
+	// ErrDiscountTooLarge is returned when a discount exceeds the amount it applies to
+	ErrDiscountTooLarge = errors.New("discount exceeds amount")
+	// ErrNegativeAmount is returned for a negative price or discount
+	ErrNegativeAmount = errors.New("prices and discounts must not be negative")
+)
+
+type InvoiceLineRow struct {
+	ID             int
+	InvoiceID      int
+	ServiceID      *int
+	Kind           string
+	Description    string
+	Quantity       int
+	UnitPriceCents int64
+	TaxRateBP      int
+	DiscountCents  int64
+	NetCents       int64
+	TaxCents       int64
+}
+
+type InvoiceRow struct {
+	ID            int
+	OwnerID       int
+	VisitID       *int
+	Status        string
+	Currency      string
+	SubtotalCents int64
+	TaxCents      int64
+	DiscountCents int64
+	TotalCents    int64
+	PaidCents     int64
+	CreatedAt     time.Time
+	IssuedAt      *time.Time
+	Lines         []InvoiceLineRow
+}
+
+// InvoiceLineInput describes a line to bill. When ServiceID is set the kind,
+// description, unit price and tax rate are taken from the price catalog;
+// otherwise the line is billed as given.
+type InvoiceLineInput struct {
+	ServiceID      int
+	Kind           string
+	Description    string
+	Quantity       int
+	UnitPriceCents int64
+	TaxRateBP      int
+	DiscountCents  int64
+}
+
+type InvoiceInput struct {
+	VisitID       int
+	Currency      string
+	DiscountCents int64
+	Lines         []InvoiceLineInput
+}
+
+// PriceLine returns the net amount and tax for a line, in minor units.
+// Tax is charged on the discounted net amount and rounded half up.
+func PriceLine(quantity int, unitPriceCents, discountCents int64, taxRateBP int) (net, tax int64, err error) {
+	if quantity < 0 || unitPriceCents < 0 || discountCents < 0 {
+		return 0, 0, ErrNegativeAmount
+	}
+	gross := int64(quantity) * unitPriceCents
+	if discountCents > gross {
+		return 0, 0, ErrDiscountTooLarge
+	}
+	net = gross - discountCents
+	tax = (net*int64(taxRateBP) + 5000) / 10000
+	return net, tax, nil
+}
+
+const invoiceColumns = "id, owner_id, visit_id, status, currency, subtotal_cents, tax_cents, discount_cents, total_cents, paid_cents, created_at, issued_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvoice(s rowScanner) (InvoiceRow, error) {
+	var inv InvoiceRow
+	var visitID sql.NullInt64
+	var issuedAt sql.NullTime
+	err := s.Scan(&inv.ID, &inv.OwnerID, &visitID, &inv.Status, &inv.Currency,
+		&inv.SubtotalCents, &inv.TaxCents, &inv.DiscountCents, &inv.TotalCents,
+		&inv.PaidCents, &inv.CreatedAt, &issuedAt)
+	if err != nil {
+		return inv, err
+	}
+	if visitID.Valid {
+		v := int(visitID.Int64)
+		inv.VisitID = &v
+	}
+	if issuedAt.Valid {
+		t := issuedAt.Time
+		inv.IssuedAt = &t
+	}
+	return inv, nil
+}
+
+func listInvoices(db *sql.DB, where string, args ...interface{}) ([]InvoiceRow, error) {
+	rows, err := db.Query("SELECT "+invoiceColumns+" FROM invoices "+where+" ORDER BY created_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []InvoiceRow{}
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, inv)
+	}
+	return res, rows.Err()
+}
+
+// invoiceInTenant limits invoices to those of owners in the tenant bound to
+// placeholder n
+func invoiceInTenant(n int) string {
+	return fmt.Sprintf("($%d::int IS NULL OR owner_id IN (SELECT id FROM owners WHERE clinic_id = $%d))", n, n)
+}
+
+func ListInvoices(db *sql.DB, t Tenant) ([]InvoiceRow, error) {
+	return listInvoices(db, "WHERE "+invoiceInTenant(1), t)
+}
+
+func ListInvoicesByOwner(db *sql.DB, t Tenant, ownerID int) ([]InvoiceRow, error) {
+	return listInvoices(db, "WHERE owner_id = $1 AND "+invoiceInTenant(2), ownerID, t)
+}
+
+// GetInvoiceByID returns an invoice together with its lines
+func GetInvoiceByID(db *sql.DB, t Tenant, id int) (InvoiceRow, error) {
+	inv, err := scanInvoice(db.QueryRow("SELECT "+invoiceColumns+" FROM invoices WHERE id=$1 AND "+invoiceInTenant(2), id, t))
+	if err != nil {
+		return inv, classify(err)
+	}
+	rows, err := db.Query(`SELECT id, invoice_id, service_id, kind, description, quantity,
+		unit_price_cents, tax_rate_bp, discount_cents, net_cents, tax_cents
+		FROM invoice_lines WHERE invoice_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return inv, classify(err)
+	}
+	defer rows.Close()
+	inv.Lines = []InvoiceLineRow{}
+	for rows.Next() {
+		var l InvoiceLineRow
+		var serviceID sql.NullInt64
+		if err := rows.Scan(&l.ID, &l.InvoiceID, &serviceID, &l.Kind, &l.Description, &l.Quantity,
+			&l.UnitPriceCents, &l.TaxRateBP, &l.DiscountCents, &l.NetCents, &l.TaxCents); err != nil {
+			return inv, classify(err)
+		}
+		if serviceID.Valid {
+			s := int(serviceID.Int64)
+			l.ServiceID = &s
+		}
+		inv.Lines = append(inv.Lines, l)
+	}
+	return inv, classify(rows.Err())
+}
+
+// CreateInvoiceFromVisit creates a draft invoice billed to the owner of the
+// visited pet, with the given lines, in a single transaction
+func CreateInvoiceFromVisit(db *sql.DB, t Tenant, a Actor, in InvoiceInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	err = tx.QueryRow(`SELECT p.owner_id FROM visits v JOIN pets p ON p.id = v.pet_id
+		WHERE v.id = $1 AND v.deleted_at IS NULL AND `+inTenant("v.clinic_id", 2), in.VisitID, t).
+		Scan(&ownerID)
+	if err != nil {
+		return 0, err
+	}
+
+	currency := in.Currency
+	if currency == "" {
+		currency = "USD"
+	}
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO invoices(owner_id,visit_id,status,currency,discount_cents) VALUES($1,$2,$3,$4,$5) RETURNING id",
+		ownerID, in.VisitID, InvoiceDraft, currency, in.DiscountCents,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, l := range in.Lines {
+		if err := insertInvoiceLine(tx, a, id, l); err != nil {
+			return 0, err
+		}
+	}
+	if err := recomputeInvoiceTotals(tx, id); err != nil {
+		return 0, err
+	}
+	if err := audit(tx, a, AuditCreate, "invoices", id, nil); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// AddInvoiceLine appends a line to a draft invoice and recomputes its totals
+func AddInvoiceLine(db *sql.DB, t Tenant, a Actor, invoiceID int, in InvoiceLineInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockInvoiceInStatus(tx, t, invoiceID, InvoiceDraft); err != nil {
+		return err
+	}
+	err = audited(tx, a, AuditUpdate, "invoices", invoiceID, func() error {
+		if err := insertInvoiceLine(tx, a, invoiceID, in); err != nil {
+			return err
+		}
+		return recomputeInvoiceTotals(tx, invoiceID)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetInvoiceDiscount changes the invoice-level discount of a draft invoice
+func SetInvoiceDiscount(db *sql.DB, t Tenant, a Actor, invoiceID int, discountCents int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockInvoiceInStatus(tx, t, invoiceID, InvoiceDraft); err != nil {
+		return err
+	}
+	err = audited(tx, a, AuditUpdate, "invoices", invoiceID, func() error {
+		if _, err := tx.Exec("UPDATE invoices SET discount_cents = $1 WHERE id = $2", discountCents, invoiceID); err != nil {
+			return err
+		}
+		return recomputeInvoiceTotals(tx, invoiceID)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TransitionInvoice moves an invoice to status `to` if its current status is
+// one of `from`
+func TransitionInvoice(db *sql.DB, t Tenant, a Actor, invoiceID int, to string, from ...string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockInvoiceInStatus(tx, t, invoiceID, from...); err != nil {
+		return err
+	}
+	if to == InvoiceVoid {
+		var paid int64
+		if err := tx.QueryRow("SELECT paid_cents FROM invoices WHERE id = $1", invoiceID).Scan(&paid); err != nil {
+			return err
+		}
+		if paid != 0 {
+			return fmt.Errorf("%w: refund payments before voiding", ErrInvoiceState)
+		}
+	}
+	err = audited(tx, a, AuditUpdate, "invoices", invoiceID, func() error {
+		if to == InvoiceIssued {
+			// Issuing commits the billed medications and consumables, so
+			// their stock is taken in the same transaction
+			if err := consumeInvoiceStock(tx, a, invoiceID); err != nil {
+				return err
+			}
+		}
+		if to == InvoiceVoid {
+			// Voiding an issued invoice puts back the stock issuing took
+			if err := returnInvoiceStock(tx, a, invoiceID); err != nil {
+				return err
+			}
+		}
+		return setInvoiceStatus(tx, invoiceID, to)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setInvoiceStatus(tx *sql.Tx, invoiceID int, status string) error {
+	stmt := "UPDATE invoices SET status = $1 WHERE id = $2"
+	if status == InvoiceIssued {
+		stmt = "UPDATE invoices SET status = $1, issued_at = CURRENT_TIMESTAMP WHERE id = $2"
+	}
+	_, err := tx.Exec(stmt, status, invoiceID)
+	return err
+}
+
+// OwnerBalance returns the amount the owner still owes on issued invoices,
+// net of partial payments
+func OwnerBalance(db *sql.DB, t Tenant, ownerID int) (int64, error) {
+	var balance int64
+	err := db.QueryRow(
+		"SELECT COALESCE(SUM(total_cents - paid_cents), 0) FROM invoices WHERE owner_id = $1 AND status = $2 AND "+invoiceInTenant(3),
+		ownerID, InvoiceIssued, t,
+	).Scan(&balance)
+	return balance, err
+}
+
+func lockInvoiceInStatus(tx *sql.Tx, t Tenant, invoiceID int, allowed ...string) error {
+	var status string
+	if err := tx.QueryRow("SELECT status FROM invoices WHERE id = $1 AND "+invoiceInTenant(2)+" FOR UPDATE", invoiceID, t).Scan(&status); err != nil {
+		return err
+	}
+	for _, s := range allowed {
+		if s == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invoice is %s", ErrInvoiceState, status)
+}
+
+func insertInvoiceLine(tx *sql.Tx, a Actor, invoiceID int, in InvoiceLineInput) error {
+	var serviceID sql.NullInt64
+	if in.ServiceID != 0 {
+		err := tx.QueryRow("SELECT kind, name, unit_price_cents, tax_rate_bp FROM services WHERE id = $1 AND active", in.ServiceID).
+			Scan(&in.Kind, &in.Description, &in.UnitPriceCents, &in.TaxRateBP)
+		if err != nil {
+			return fmt.Errorf("service %d: %w", in.ServiceID, err)
+		}
+		serviceID = sql.NullInt64{Int64: int64(in.ServiceID), Valid: true}
+	}
+	if in.Quantity == 0 {
+		in.Quantity = 1
+	}
+
+	net, tax, err := PriceLine(in.Quantity, in.UnitPriceCents, in.DiscountCents, in.TaxRateBP)
+	if err != nil {
+		return err
+	}
+	var id int
+	err = tx.QueryRow(`INSERT INTO invoice_lines(invoice_id, service_id, kind, description, quantity,
+		unit_price_cents, tax_rate_bp, discount_cents, net_cents, tax_cents)
+		VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id`,
+		invoiceID, serviceID, in.Kind, in.Description, in.Quantity,
+		in.UnitPriceCents, in.TaxRateBP, in.DiscountCents, net, tax).Scan(&id)
+	if err != nil {
+		return err
+	}
+	return audit(tx, a, AuditCreate, "invoice_lines", id, nil)
+}
+
+func recomputeInvoiceTotals(tx *sql.Tx, invoiceID int) error {
+	var subtotal, tax, discount int64
+	err := tx.QueryRow(`SELECT COALESCE(SUM(net_cents), 0), COALESCE(SUM(tax_cents), 0)
+		FROM invoice_lines WHERE invoice_id = $1`, invoiceID).Scan(&subtotal, &tax)
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT discount_cents FROM invoices WHERE id = $1", invoiceID).Scan(&discount); err != nil {
+		return err
+	}
+	if discount < 0 {
+		return ErrNegativeAmount
+	}
+	if discount > subtotal+tax {
+		return ErrDiscountTooLarge
+	}
+	_, err = tx.Exec(
+		"UPDATE invoices SET subtotal_cents = $1, tax_cents = $2, total_cents = $3 WHERE id = $4",
+		subtotal, tax, subtotal+tax-discount, invoiceID,
+	)
+	return err
+}
@@ -0,0 +1,371 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"petclinic/lab"
+)
+
+// Lab order panels and statuses
+const (
+	LabPanelBloodwork  = "bloodwork"
+	LabPanelUrinalysis = "urinalysis"
+
+	LabOrdered   = "ordered"
+	LabCompleted = "completed"
+	LabCancelled = "cancelled"
+)
+
+// AnySpecies is the species of a reference range that applies when no
+// species-specific range exists
+const AnySpecies = "*"
+
+// ErrUnknownAccession is returned when an imported file references orders
+// that do not exist
+var ErrUnknownAccession = errors.New("unknown lab accession")
+
+type LabOrderRow struct {
+	ID        int
+	VisitID   int
+	Panel     string
+	Notes     string
+	Accession string
+	Status    string
+	OrderedBy *int
+	RawFile   string
+	CreatedAt time.Time
+	Results   []LabResultRow
+}
+
+type LabOrderInput struct {
+	VisitID   int
+	Panel     string
+	Notes     string
+	OrderedBy int
+}
+
+type LabResultRow struct {
+	ID        int
+	OrderID   int
+	Analyte   string
+	Value     string
+	Unit      string
+	RefLow    *float64
+	RefHigh   *float64
+	Flag      string
+	CreatedAt time.Time
+}
+
+type ReferenceRangeRow struct {
+	ID      int
+	Analyte string
+	Species string
+	Unit    string
+	Low     *float64
+	High    *float64
+}
+
+type ReferenceRangeInput struct {
+	Analyte string
+	Species string
+	Unit    string
+	Low     *float64
+	High    *float64
+}
+
+// ValidLabPanel reports whether panel is a known lab panel
+func ValidLabPanel(panel string) bool {
+	return panel == LabPanelBloodwork || panel == LabPanelUrinalysis
+}
+
+// -------------------- Orders --------------------
+
+const labOrderColumns = "id, visit_id, panel, notes, accession, status, ordered_by, raw_file, created_at"
+
+func scanLabOrder(s rowScanner) (LabOrderRow, error) {
+	var o LabOrderRow
+	var orderedBy sql.NullInt64
+	err := s.Scan(&o.ID, &o.VisitID, &o.Panel, &o.Notes, &o.Accession, &o.Status, &orderedBy, &o.RawFile, &o.CreatedAt)
+	if orderedBy.Valid {
+		v := int(orderedBy.Int64)
+		o.OrderedBy = &v
+	}
+	return o, err
+}
+
+// CreateLabOrder creates an order and assigns it the accession number the
+// analyzer will echo back with the results
+func CreateLabOrder(db *sql.DB, t Tenant, a Actor, in LabOrderInput) (LabOrderRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return LabOrderRow{}, classify(err)
+	}
+	defer tx.Rollback()
+
+	// The visit must exist in the tenant; sql.ErrNoRows otherwise
+	if _, err := clinicOf(tx, "visits", in.VisitID, t); err != nil {
+		return LabOrderRow{}, classify(err)
+	}
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO lab_orders(visit_id,panel,notes,status,ordered_by) VALUES($1,$2,$3,$4,$5) RETURNING id",
+		in.VisitID, in.Panel, in.Notes, LabOrdered, nullableID(in.OrderedBy),
+	).Scan(&id)
+	if err != nil {
+		return LabOrderRow{}, classify(err)
+	}
+	o, err := scanLabOrder(tx.QueryRow(
+		"UPDATE lab_orders SET accession = $1 WHERE id = $2 RETURNING "+labOrderColumns,
+		fmt.Sprintf("LAB-%06d", id), id,
+	))
+	if err != nil {
+		return LabOrderRow{}, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "lab_orders", id, nil); err != nil {
+		return LabOrderRow{}, classify(err)
+	}
+	return o, classify(tx.Commit())
+}
+
+// labOrderInTenant limits lab orders to visits in the tenant bound to
+// placeholder n
+func labOrderInTenant(n int) string {
+	return fmt.Sprintf("($%d::int IS NULL OR visit_id IN (SELECT id FROM visits WHERE clinic_id = $%d))", n, n)
+}
+
+func ListLabOrdersByVisit(db *sql.DB, t Tenant, visitID int) ([]LabOrderRow, error) {
+	rows, err := db.Query("SELECT "+labOrderColumns+" FROM lab_orders WHERE visit_id = $1 AND "+labOrderInTenant(2)+" ORDER BY id", visitID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []LabOrderRow{}
+	for rows.Next() {
+		o, err := scanLabOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, o)
+	}
+	return res, rows.Err()
+}
+
+// GetLabOrderByID returns an order together with its results
+func GetLabOrderByID(db *sql.DB, t Tenant, id int) (LabOrderRow, error) {
+	o, err := scanLabOrder(db.QueryRow("SELECT "+labOrderColumns+" FROM lab_orders WHERE id = $1 AND "+labOrderInTenant(2), id, t))
+	if err != nil {
+		return o, classify(err)
+	}
+	rows, err := db.Query(`SELECT id, order_id, analyte, value, unit, ref_low, ref_high, flag, created_at
+		FROM lab_results WHERE order_id = $1 ORDER BY analyte`, id)
+	if err != nil {
+		return o, classify(err)
+	}
+	defer rows.Close()
+	o.Results = []LabResultRow{}
+	for rows.Next() {
+		var r LabResultRow
+		var low, high sql.NullFloat64
+		if err := rows.Scan(&r.ID, &r.OrderID, &r.Analyte, &r.Value, &r.Unit, &low, &high, &r.Flag, &r.CreatedAt); err != nil {
+			return o, classify(err)
+		}
+		r.RefLow, r.RefHigh = floatPtr(low), floatPtr(high)
+		o.Results = append(o.Results, r)
+	}
+	return o, classify(rows.Err())
+}
+
+// CancelLabOrder cancels an order that has no results yet
+func CancelLabOrder(db *sql.DB, t Tenant, a Actor, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "lab_orders", id, func() error {
+		return affected(tx.Exec("UPDATE lab_orders SET status = $1 WHERE id = $2 AND status = $3 AND "+labOrderInTenant(4), LabCancelled, id, LabOrdered, t))
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// -------------------- Reference ranges --------------------
+
+func ListReferenceRanges(db *sql.DB) ([]ReferenceRangeRow, error) {
+	rows, err := db.Query("SELECT id, analyte, species, unit, low, high FROM lab_reference_ranges ORDER BY analyte, species")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ReferenceRangeRow{}
+	for rows.Next() {
+		var r ReferenceRangeRow
+		var low, high sql.NullFloat64
+		if err := rows.Scan(&r.ID, &r.Analyte, &r.Species, &r.Unit, &low, &high); err != nil {
+			return nil, err
+		}
+		r.Low, r.High = floatPtr(low), floatPtr(high)
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// UpsertReferenceRange creates or replaces the range for an analyte and
+// species on behalf of a
+func UpsertReferenceRange(db *sql.DB, a Actor, in ReferenceRangeInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	analyte, species := strings.ToUpper(in.Analyte), strings.ToLower(in.Species)
+	var id int
+	err = tx.QueryRow("SELECT id FROM lab_reference_ranges WHERE analyte = $1 AND species = $2", analyte, species).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow(`INSERT INTO lab_reference_ranges(analyte,species,unit,low,high) VALUES($1,$2,$3,$4,$5)
+			RETURNING id`, analyte, species, in.Unit, in.Low, in.High).Scan(&id)
+		if err == nil {
+			err = audit(tx, a, AuditCreate, "lab_reference_ranges", id, nil)
+		}
+	case err == nil:
+		err = audited(tx, a, AuditUpdate, "lab_reference_ranges", id, func() error {
+			_, err := tx.Exec("UPDATE lab_reference_ranges SET unit = $1, low = $2, high = $3 WHERE id = $4",
+				in.Unit, in.Low, in.High, id)
+			return err
+		})
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+// -------------------- Results --------------------
+
+// ImportLabResults stores parsed analyzer results in one transaction. Each
+// result is flagged against the reference range for the patient's species,
+// falling back to the AnySpecies range, unless it was reported in another
+// unit than the range's; then it has no flag. A re-sent analyte replaces the
+// earlier value. If any accession is unknown, or belongs to another clinic,
+// nothing is stored.
+func ImportLabResults(db *sql.DB, t Tenant, a Actor, results []lab.Result, rawFile string) (map[string]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type order struct {
+		id      int
+		species string
+	}
+	orders := map[string]order{}
+	var unknown []string
+	for _, r := range results {
+		if _, seen := orders[r.Accession]; seen {
+			continue
+		}
+		var o order
+		err := tx.QueryRow(`SELECT o.id, LOWER(p.species) FROM lab_orders o
+			JOIN visits v ON v.id = o.visit_id JOIN pets p ON p.id = v.pet_id
+			WHERE o.accession = $1 AND o.status <> $2 AND `+inTenant("v.clinic_id", 3)+` FOR UPDATE OF o`,
+			r.Accession, LabCancelled, t).Scan(&o.id, &o.species)
+		if err == sql.ErrNoRows {
+			unknown = append(unknown, r.Accession)
+			orders[r.Accession] = order{}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		orders[r.Accession] = o
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAccession, strings.Join(unknown, ", "))
+	}
+
+	counts := map[string]int{}
+	for _, r := range results {
+		o := orders[r.Accession]
+		var low, high sql.NullFloat64
+		var unit sql.NullString
+		err := tx.QueryRow(`SELECT low, high, unit FROM lab_reference_ranges
+			WHERE analyte = $1 AND species IN ($2, $3)
+			ORDER BY species = $3 LIMIT 1`, r.Analyte, o.species, AnySpecies).Scan(&low, &high, &unit)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		resultUnit := r.Unit
+		if resultUnit == "" {
+			resultUnit = unit.String
+		}
+		// A value in another unit than the range, e.g. mg/dL against
+		// mmol/L, cannot be flagged against it
+		flag := ""
+		if lab.SameUnit(r.Unit, unit.String) {
+			flag = lab.Flag(r.Value, floatPtr(low), floatPtr(high))
+		}
+
+		// A re-sent analyte is recorded as an update of the earlier result
+		var id int
+		var before map[string]interface{}
+		err = tx.QueryRow("SELECT id FROM lab_results WHERE order_id = $1 AND analyte = $2", o.id, r.Analyte).Scan(&id)
+		switch {
+		case err == nil:
+			if before, err = snapshot(tx, "lab_results", id); err != nil {
+				return nil, err
+			}
+		case err != sql.ErrNoRows:
+			return nil, err
+		}
+		err = tx.QueryRow(`INSERT INTO lab_results(order_id,analyte,value,unit,ref_low,ref_high,flag)
+			VALUES($1,$2,$3,$4,$5,$6,$7)
+			ON CONFLICT (order_id, analyte) DO UPDATE SET value = EXCLUDED.value, unit = EXCLUDED.unit,
+				ref_low = EXCLUDED.ref_low, ref_high = EXCLUDED.ref_high, flag = EXCLUDED.flag,
+				created_at = CURRENT_TIMESTAMP
+			RETURNING id`,
+			o.id, r.Analyte, r.Value, resultUnit, low, high, flag).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		action := AuditUpdate
+		if before == nil {
+			action = AuditCreate
+		}
+		if err := audit(tx, a, action, "lab_results", id, before); err != nil {
+			return nil, err
+		}
+		counts[r.Accession]++
+	}
+
+	for acc, o := range orders {
+		err := audited(tx, a, AuditUpdate, "lab_orders", o.id, func() error {
+			_, err := tx.Exec("UPDATE lab_orders SET status = $1, raw_file = $2 WHERE id = $3", LabCompleted, rawFile, o.id)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("completing %s: %w", acc, err)
+		}
+	}
+	return counts, tx.Commit()
+}
+
+func floatPtr(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	v := f.Float64
+	return &v
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LoginFailureRow tracks failed logins for one key: an account
+// ("account:<email>") or a client address ("ip:<addr>")
+type LoginFailureRow struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// LoginLockedUntil returns when the lock on key ends; the zero time means
+// the key is not locked
+func LoginLockedUntil(db *sql.DB, key string) (time.Time, error) {
+	var until sql.NullTime
+	err := db.QueryRow("SELECT locked_until FROM login_failures WHERE key = $1 AND locked_until > CURRENT_TIMESTAMP", key).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until.Time, err
+}
+
+// RecordLoginFailure counts a failed login for key and returns the number
+// of failures in the current run. A run starts over once the previous
+// failure is older than window.
+func RecordLoginFailure(db *sql.DB, key string, window time.Duration) (int, error) {
+	var n int
+	err := db.QueryRow(`INSERT INTO login_failures(key, failures, last_failure_at) VALUES($1, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+				THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = CURRENT_TIMESTAMP
+		RETURNING failures`, key, window.Seconds()).Scan(&n)
+	return n, err
+}
+
+// LockLogin refuses logins for key until the given time
+func LockLogin(db *sql.DB, key string, until time.Time) error {
+	_, err := db.Exec("UPDATE login_failures SET locked_until = $1 WHERE key = $2", until, key)
+	return err
+}
+
+// ClearLoginFailures forgets the failures and any lock of key
+func ClearLoginFailures(db *sql.DB, key string) (bool, error) {
+	res, err := db.Exec("DELETE FROM login_failures WHERE key = $1", key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ListLoginFailures lists keys that are locked or failed within window
+func ListLoginFailures(db *sql.DB, window time.Duration) ([]LoginFailureRow, error) {
+	rows, err := db.Query(`SELECT key, failures, last_failure_at, locked_until FROM login_failures
+		WHERE locked_until > CURRENT_TIMESTAMP OR last_failure_at > CURRENT_TIMESTAMP - make_interval(secs => $1)
+		ORDER BY locked_until DESC NULLS LAST, last_failure_at DESC`, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []LoginFailureRow{}
+	for rows.Next() {
+		var f LoginFailureRow
+		var until sql.NullTime
+		if err := rows.Scan(&f.Key, &f.Failures, &f.LastFailureAt, &until); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			f.LockedUntil = &until.Time
+		}
+		res = append(res, f)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"database/sql"
+)
+
+// SetPendingTOTPSecret stores a new secret for a user who has not finished
+// enrolling; it takes effect once ConfirmTOTP is called
+func SetPendingTOTPSecret(db *sql.DB, a Actor, userID int, secret string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = audited(tx, a, AuditUpdate, "users", userID, func() error {
+		_, err := tx.Exec("UPDATE users SET totp_secret = $1, totp_last_counter = 0 WHERE id = $2 AND NOT totp_enabled", secret, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTOTPSecret returns the user's secret, pending or enabled
+func GetTOTPSecret(db *sql.DB, userID int) (string, error) {
+	var secret sql.NullString
+	err := db.QueryRow("SELECT totp_secret FROM users WHERE id = $1", userID).Scan(&secret)
+	if err == nil && !secret.Valid {
+		return "", sql.ErrNoRows
+	}
+	return secret.String, err
+}
+
+// ConfirmTOTP turns on two-factor authentication and replaces the user's
+// recovery codes with the given hashes
+func ConfirmTOTP(db *sql.DB, a Actor, userID int, counter int64, recoveryHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "users", userID, func() error {
+		return affected(tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_counter = $1 WHERE id = $2 AND totp_secret IS NOT NULL", counter, userID))
+	})
+	if err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, a, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes swaps all recovery codes of a user
+func ReplaceRecoveryCodes(db *sql.DB, a Actor, userID int, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(tx, a, userID, hashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, a Actor, userID int, hashes []string) error {
+	if err := deleteRecoveryCodes(tx, a, userID); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		var id int
+		if err := tx.QueryRow("INSERT INTO user_recovery_codes(user_id, code_hash) VALUES($1, $2) RETURNING id", userID, h).Scan(&id); err != nil {
+			return err
+		}
+		if err := audit(tx, a, AuditCreate, "user_recovery_codes", id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRecoveryCodes drops all recovery codes of a user on behalf of a
+func deleteRecoveryCodes(tx *sql.Tx, a Actor, userID int) error {
+	return auditedRows(tx, a, AuditDelete, "user_recovery_codes", "user_id = $1", []interface{}{userID}, func() error {
+		_, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID)
+		return err
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and
+// recovery codes
+func DisableTOTP(db *sql.DB, a Actor, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = audited(tx, a, AuditUpdate, "users", userID, func() error {
+		_, err := tx.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_counter = 0 WHERE id = $1", userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteRecoveryCodes(tx, a, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPCounter records that the code of a time step was used. It returns
+// false when that step or a later one was used before, so a code cannot be
+// replayed. As sign-in bookkeeping it is not audited.
+func UseTOTPCounter(db *sql.DB, userID int, counter int64) (bool, error) {
+	res, err := db.Exec("UPDATE users SET totp_last_counter = $1 WHERE id = $2 AND totp_last_counter < $1", counter, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// UseRecoveryCode spends a recovery code; false means it is unknown or used
+func UseRecoveryCode(db *sql.DB, a Actor, userID int, codeHash string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	where := "user_id = $1 AND code_hash = $2 AND used_at IS NULL"
+	err = auditedRows(tx, a, AuditUpdate, "user_recovery_codes", where, []interface{}{userID, codeHash}, func() error {
+		res, err := tx.Exec("UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE "+where, userID, codeHash)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func CountRecoveryCodes(db *sql.DB, userID int) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// -------------------- Policy --------------------
+
+// GetMFAPolicy returns, per role, whether two-factor authentication is
+// required. Roles without a row are not required to use it.
+func GetMFAPolicy(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT role, required FROM mfa_policy")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]bool{}
+	for rows.Next() {
+		var role string
+		var required bool
+		if err := rows.Scan(&role, &required); err != nil {
+			return nil, err
+		}
+		res[role] = required
+	}
+	return res, rows.Err()
+}
+
+func MFARequired(db *sql.DB, role string) (bool, error) {
+	var required bool
+	err := db.QueryRow("SELECT required FROM mfa_policy WHERE role = $1", role).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return required, err
+}
+
+// SetMFAPolicy sets whether role must use two-factor authentication, on
+// behalf of a
+func SetMFAPolicy(db *sql.DB, a Actor, role string, required bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM mfa_policy WHERE role = $1", role).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow("INSERT INTO mfa_policy(role, required) VALUES($1, $2) RETURNING id", role, required).Scan(&id)
+		if err == nil {
+			err = audit(tx, a, AuditCreate, "mfa_policy", id, nil)
+		}
+	case err == nil:
+		err = audited(tx, a, AuditUpdate, "mfa_policy", id, func() error {
+			_, err := tx.Exec("UPDATE mfa_policy SET required = $1 WHERE id = $2", required, id)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
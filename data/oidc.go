@@ -0,0 +1,118 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrOIDCStateInvalid is returned for sign-in states that are unknown,
+// expired or already used
+var ErrOIDCStateInvalid = errors.New("sign-in request is invalid or has expired")
+
+// ErrOIDCAccountConflict is returned when the email of an identity belongs
+// to an account that cannot be linked to it
+var ErrOIDCAccountConflict = errors.New("email address is already used by another account")
+
+// unusablePasswordHash never matches a bcrypt comparison, so accounts
+// created through single sign-on cannot log in with a password
+const unusablePasswordHash = "!"
+
+// CreateOIDCState stores the hash of a sign-in state with the nonce and PKCE
+// verifier needed to finish it, dropping states that have expired
+func CreateOIDCState(db *sql.DB, stateHash, nonce, verifier string, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM oidc_states WHERE expires_at <= CURRENT_TIMESTAMP"); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO oidc_states(state_hash, nonce, code_verifier, expires_at) VALUES($1,$2,$3,$4)",
+		stateHash, nonce, verifier, expiresAt)
+	return err
+}
+
+// ConsumeOIDCState removes a valid state and returns its nonce and verifier
+func ConsumeOIDCState(db *sql.DB, stateHash string) (nonce, verifier string, err error) {
+	err = db.QueryRow(`DELETE FROM oidc_states WHERE state_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING nonce, code_verifier`, stateHash).Scan(&nonce, &verifier)
+	if err == sql.ErrNoRows {
+		return "", "", ErrOIDCStateInvalid
+	}
+	return nonce, verifier, err
+}
+
+// linkCandidate is an existing account whose email matches a new identity
+type linkCandidate struct {
+	Linked   bool
+	Portal   bool
+	Role     string
+	ClinicID sql.NullInt64
+}
+
+// oidcLinkable reports whether an identity with a verified email or not may
+// be linked to c when signing in to clinic. Super-admin accounts are never
+// linked: whoever controls the address at the provider would take over the
+// whole group.
+func oidcLinkable(c linkCandidate, clinic int, emailVerified bool) bool {
+	return emailVerified && !c.Linked && !c.Portal && c.Role != RoleSuperAdmin &&
+		c.ClinicID.Valid && c.ClinicID.Int64 == int64(clinic)
+}
+
+// ProvisionOIDCUser returns the account of an identity, creating it on first
+// sign-in, in clinic. An existing account with the same email is linked only
+// when the provider vouches for the address, and never when it is an owner
+// portal account, a super-admin or belongs to another clinic. The role
+// follows the provider on every sign-in, except that super-admins stay
+// super-admins.
+func ProvisionOIDCUser(db *sql.DB, a Actor, clinic int, issuer, subject, email, role string, emailVerified bool) (UserRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserRow{}, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var link bool
+	err = tx.QueryRow("SELECT id FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2 FOR UPDATE",
+		issuer, subject).Scan(&id)
+	if err == sql.ErrNoRows {
+		var c linkCandidate
+		err = tx.QueryRow(`SELECT id, oidc_subject IS NOT NULL, owner_id IS NOT NULL, role, clinic_id
+			FROM users WHERE email = $1 FOR UPDATE`, email).Scan(&id, &c.Linked, &c.Portal, &c.Role, &c.ClinicID)
+		switch {
+		case err == sql.ErrNoRows:
+			u, err := scanUser(tx.QueryRow(`INSERT INTO users(email, password_hash, role, oidc_issuer, oidc_subject, email_verified_at, clinic_id)
+				VALUES($1,$2,$3,$4,$5, CASE WHEN $6 THEN CURRENT_TIMESTAMP END, $7) RETURNING `+userColumns,
+				email, unusablePasswordHash, role, issuer, subject, emailVerified, clinic))
+			if err != nil {
+				return UserRow{}, err
+			}
+			if err := audit(tx, a, AuditCreate, "users", u.ID, nil); err != nil {
+				return UserRow{}, err
+			}
+			return u, tx.Commit()
+		case err != nil:
+			return UserRow{}, err
+		case !oidcLinkable(c, clinic, emailVerified):
+			return UserRow{}, ErrOIDCAccountConflict
+		}
+		link = true
+	} else if err != nil {
+		return UserRow{}, err
+	}
+
+	var u UserRow
+	err = audited(tx, a, AuditUpdate, "users", id, func() (err error) {
+		if link {
+			if _, err := tx.Exec("UPDATE users SET oidc_issuer = $1, oidc_subject = $2 WHERE id = $3", issuer, subject, id); err != nil {
+				return err
+			}
+		}
+		u, err = scanUser(tx.QueryRow(`UPDATE users SET role = CASE WHEN role = '`+RoleSuperAdmin+`' THEN role ELSE $1 END,
+			email_verified_at = CASE WHEN $2 THEN COALESCE(email_verified_at, CURRENT_TIMESTAMP) ELSE email_verified_at END
+			WHERE id = $3 RETURNING `+userColumns, role, emailVerified, id))
+		return err
+	})
+	if err != nil {
+		return UserRow{}, err
+	}
+	return u, tx.Commit()
+}
@@ -0,0 +1,32 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestOIDCLinkable(t *testing.T) {
+	clinic1 := sql.NullInt64{Int64: 1, Valid: true}
+	staff := linkCandidate{Role: RoleStaff, ClinicID: clinic1}
+	tests := []struct {
+		name     string
+		c        linkCandidate
+		verified bool
+		want     bool
+	}{
+		{"staff of the clinic", staff, true, true},
+		{"unverified email", staff, false, false},
+		{"already linked", linkCandidate{Linked: true, Role: RoleStaff, ClinicID: clinic1}, true, false},
+		{"portal account", linkCandidate{Portal: true, Role: RoleOwner, ClinicID: clinic1}, true, false},
+		{"other clinic", linkCandidate{Role: RoleStaff, ClinicID: sql.NullInt64{Int64: 2, Valid: true}}, true, false},
+		{"super-admin", linkCandidate{Role: RoleSuperAdmin}, true, false},
+		{"super-admin of the clinic", linkCandidate{Role: RoleSuperAdmin, ClinicID: clinic1}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := oidcLinkable(tt.c, 1, tt.verified); got != tt.want {
+				t.Errorf("oidcLinkable(%+v, 1, %v) = %v, want %v", tt.c, tt.verified, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,18 @@
 package data
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type OwnerRow struct {
-	ID      int
-	Name    string
-	Phone   string
-	Address string
+	ID       int
+	Name     string
+	Phone    string
+	Address  string
+	ClinicID  int
+	Version   int
+	DeletedAt *time.Time
 }
 
 type OwnerInput struct {
@@ -15,16 +21,18 @@ type OwnerInput struct {
 	Address string
 }
 
-func ListOwners(db *sql.DB) ([]OwnerRow, error) {
-	rows, err := db.Query("SELECT id, name, phone, address FROM owners")
+// ListOwners lists the owners of t; deleted ones only when withDeleted
+func ListOwners(db *sql.DB, t Tenant, withDeleted bool) ([]OwnerRow, error) {
+	rows, err := db.Query("SELECT id, name, phone, address, clinic_id, version, deleted_at FROM owners WHERE "+
+		inTenant("clinic_id", 1)+" AND "+orDeleted("deleted_at", 2), t, withDeleted)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	defer rows.Close()
 	res := []OwnerRow{}
 	for rows.Next() {
 		var o OwnerRow
-		if err := rows.Scan(&o.ID, &o.Name, &o.Phone, &o.Address); err != nil {
+		if err := rows.Scan(&o.ID, &o.Name, &o.Phone, &o.Address, &o.ClinicID, &o.Version, &o.DeletedAt); err != nil {
 			return nil, err
 		}
 		res = append(res, o)
@@ -32,36 +40,107 @@ func ListOwners(db *sql.DB) ([]OwnerRow, error) {
 	return res, nil
 }
 
-func GetOwnerByID(db *sql.DB, id int) (OwnerRow, error) {
+// GetOwnerByID returns an owner of t, which may be deleted only when
+// withDeleted
+func GetOwnerByID(db *sql.DB, t Tenant, id int, withDeleted bool) (OwnerRow, error) {
 	var o OwnerRow
-	err := db.QueryRow("SELECT id, name, phone, address FROM owners WHERE id=$1", id).
-		Scan(&o.ID, &o.Name, &o.Phone, &o.Address)
-	return o, err
+	err := db.QueryRow("SELECT id, name, phone, address, clinic_id, version, deleted_at FROM owners WHERE id=$1 AND "+
+		inTenant("clinic_id", 2)+" AND "+orDeleted("deleted_at", 3), id, t, withDeleted).
+		Scan(&o.ID, &o.Name, &o.Phone, &o.Address, &o.ClinicID, &o.Version, &o.DeletedAt)
+	return o, classify(err)
 }
 
-func CreateOwner(db *sql.DB, in OwnerInput) (int, error) {
+// CreateOwner adds an owner to clinic t on behalf of a
+func CreateOwner(db *sql.DB, t Tenant, a Actor, in OwnerInput) (int, error) {
+	if t == AllClinics {
+		return 0, ErrClinicRequired
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
 	var id int
-	err := db.QueryRow(
-		"INSERT INTO owners(name,phone,address) VALUES($1,$2,$3) RETURNING id",
-		in.Name, in.Phone, in.Address,
+	err = tx.QueryRow(
+		"INSERT INTO owners(name,phone,address,clinic_id) VALUES($1,$2,$3,$4) RETURNING id",
+		in.Name, in.Phone, in.Address, t,
 	).Scan(&id)
-	return id, err
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "owners", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
 }
 
-// UpdateOwner updates an existing owner in the database
-func UpdateOwner(db *sql.DB, id int, in OwnerInput) error {
+// UpdateOwner updates an existing owner in the database if it is still at
+// version
+func UpdateOwner(db *sql.DB, t Tenant, a Actor, id, version int, in OwnerInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
 	sqlStatement := `
 		UPDATE owners 
-		SET name = $1, phone = $2, address = $3
-		WHERE id = $4`
+		SET name = $1, phone = $2, address = $3, version = version + 1
+		WHERE id = $4 AND ` + inTenant("clinic_id", 5) + ` AND ` + versionIs(6)
 	
-	_, err := db.Exec(sqlStatement, in.Name, in.Phone, in.Address, id)
-	return err
+	err = audited(tx, a, AuditUpdate, "owners", id, func() error {
+		err := affected(tx.Exec(sqlStatement, in.Name, in.Phone, in.Address, id, t, version))
+		return stale(tx, "owners", id, t, err)
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
 
-// DeleteOwner removes an owner from the database
-func DeleteOwner(db *sql.DB, id int) error {
-	sqlStatement := `DELETE FROM owners WHERE id = $1`
-	_, err := db.Exec(sqlStatement, id)
-	return err
+// PatchOwner updates only the columns named in fields (name, phone,
+// address), taking their values from in, if it is still at version. It
+// returns the owner's new version.
+func PatchOwner(db *sql.DB, t Tenant, a Actor, id, version int, in OwnerInput, fields []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "owners", id, func() (err error) {
+		version, err = patchRow(tx, "owners", id, t, version, fields, map[string]interface{}{
+			"name":    in.Name,
+			"phone":   in.Phone,
+			"address": in.Address,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return version, classify(tx.Commit())
+}
+
+// DeleteOwner marks an owner deleted, with its pets and their visits, if it
+// is still at version
+func DeleteOwner(db *sql.DB, t Tenant, a Actor, id, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if err := softDelete(tx, a, "owners", id, t, version); err != nil {
+		return classify(err)
+	}
+	err = setDeleted(tx, a, AuditDelete, "visits", "pet_id IN (SELECT id FROM pets WHERE owner_id = $1) AND deleted_at IS NULL", id)
+	if err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditDelete, "pets", "owner_id = $1 AND deleted_at IS NULL", id); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
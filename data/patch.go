@@ -0,0 +1,43 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// patchRow updates the columns named in fields of row id of table in t, if
+// the row is still at version, and returns the row's new version. Values come
+// from vals, which also limits the columns that can be set; other fields are
+// ignored. Nothing is written when no column is left.
+func patchRow(q querier, table string, id int, t Tenant, version int, fields []string, vals map[string]interface{}) (int, error) {
+	var set []string
+	var args []interface{}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		v, ok := vals[f]
+		if !ok || seen[f] {
+			continue
+		}
+		seen[f] = true
+		args = append(args, v)
+		set = append(set, fmt.Sprintf("%s = $%d", f, len(args)))
+	}
+	if len(set) == 0 {
+		return version, nil
+	}
+	args = append(args, id, t, version)
+	n := len(args)
+	stmt := fmt.Sprintf("UPDATE %s SET %s, version = version + 1 WHERE id = $%d AND %s AND %s RETURNING version",
+		table, strings.Join(set, ", "), n-2, inTenant("clinic_id", n-1), versionIs(n))
+	err := q.QueryRow(stmt, args...).Scan(&version)
+	return version, stale(q, table, id, t, err)
+}
+
+func hasField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
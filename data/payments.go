@@ -0,0 +1,260 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Payment kinds and statuses
+const (
+	PaymentKindPayment = "payment"
+	PaymentKindRefund  = "refund"
+
+	PaymentPending   = "pending"
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+)
+
+var (
+	// ErrAmountExceedsBalance is returned when a payment is larger than what is
+	// still owed, or a refund larger than what was paid
+	ErrAmountExceedsBalance = errors.New("amount exceeds outstanding balance")
+	// ErrIdempotencyKeyReuse is returned when an idempotency key is replayed
+	// with a different invoice, kind or amount
+	ErrIdempotencyKeyReuse = errors.New("idempotency key already used for a different payment")
+)
+
+type PaymentRow struct {
+	ID             int
+	InvoiceID      int
+	Kind           string
+	Provider       string
+	Method         string
+	AmountCents    int64
+	Status         string
+	Reference      string
+	IdempotencyKey string
+	RefundOf       *int
+	CreatedAt      time.Time
+}
+
+type PaymentInput struct {
+	InvoiceID      int
+	Kind           string
+	Provider       string
+	Method         string
+	AmountCents    int64
+	IdempotencyKey string
+	RefundOf       int
+}
+
+const paymentColumns = "id, invoice_id, kind, provider, method, amount_cents, status, reference, idempotency_key, refund_of, created_at"
+
+func scanPayment(s rowScanner) (PaymentRow, error) {
+	var p PaymentRow
+	var refundOf sql.NullInt64
+	err := s.Scan(&p.ID, &p.InvoiceID, &p.Kind, &p.Provider, &p.Method, &p.AmountCents,
+		&p.Status, &p.Reference, &p.IdempotencyKey, &refundOf, &p.CreatedAt)
+	if refundOf.Valid {
+		v := int(refundOf.Int64)
+		p.RefundOf = &v
+	}
+	return p, err
+}
+
+func ListPaymentsByInvoice(db *sql.DB, t Tenant, invoiceID int) ([]PaymentRow, error) {
+	rows, err := db.Query("SELECT "+paymentColumns+" FROM payments WHERE invoice_id = (SELECT id FROM invoices WHERE id = $1 AND "+
+		invoiceInTenant(2)+") ORDER BY id", invoiceID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []PaymentRow{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func GetPaymentByID(db *sql.DB, t Tenant, id int) (PaymentRow, error) {
+	p, err := scanPayment(db.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1 AND invoice_id IN (SELECT id FROM invoices WHERE "+
+		invoiceInTenant(2)+")", id, t))
+	return p, classify(err)
+}
+
+// BeginPayment records a pending payment or refund against an issued or paid
+// invoice. Amounts still pending count against the balance so a payment
+// cannot be captured twice while the provider is working.
+//
+// If a payment with the same idempotency key already exists it is returned
+// with created=false instead of recording a new one.
+func BeginPayment(db *sql.DB, t Tenant, a Actor, in PaymentInput) (p PaymentRow, created bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return p, false, err
+	}
+	defer tx.Rollback()
+
+	if err := lockInvoiceInStatus(tx, t, in.InvoiceID, InvoiceIssued, InvoicePaid); err != nil {
+		return p, false, err
+	}
+
+	existing, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE idempotency_key = $1", in.IdempotencyKey))
+	switch {
+	case err == nil:
+		if existing.InvoiceID != in.InvoiceID || existing.Kind != in.Kind || existing.AmountCents != in.AmountCents {
+			return existing, false, ErrIdempotencyKeyReuse
+		}
+		return existing, false, nil
+	case err != sql.ErrNoRows:
+		return p, false, err
+	}
+
+	var total, paid, pendingPayments, pendingRefunds int64
+	err = tx.QueryRow(`SELECT i.total_cents, i.paid_cents,
+		COALESCE(SUM(p.amount_cents) FILTER (WHERE p.kind = 'payment'), 0),
+		COALESCE(SUM(p.amount_cents) FILTER (WHERE p.kind = 'refund'), 0)
+		FROM invoices i LEFT JOIN payments p ON p.invoice_id = i.id AND p.status = 'pending'
+		WHERE i.id = $1 GROUP BY i.id`, in.InvoiceID).Scan(&total, &paid, &pendingPayments, &pendingRefunds)
+	if err != nil {
+		return p, false, err
+	}
+
+	switch in.Kind {
+	case PaymentKindPayment:
+		if in.AmountCents > total-paid-pendingPayments {
+			return p, false, ErrAmountExceedsBalance
+		}
+	case PaymentKindRefund:
+		var refundable int64
+		err := tx.QueryRow(`SELECT o.amount_cents - COALESCE((SELECT SUM(amount_cents) FROM payments
+			WHERE refund_of = o.id AND status <> 'failed'), 0)
+			FROM payments o WHERE o.id = $1 AND o.invoice_id = $2 AND o.kind = 'payment' AND o.status = 'succeeded'`,
+			in.RefundOf, in.InvoiceID).Scan(&refundable)
+		if err != nil {
+			return p, false, fmt.Errorf("payment to refund: %w", err)
+		}
+		if in.AmountCents > refundable || in.AmountCents > paid-pendingRefunds {
+			return p, false, ErrAmountExceedsBalance
+		}
+	}
+
+	var refundOf sql.NullInt64
+	if in.RefundOf != 0 {
+		refundOf = sql.NullInt64{Int64: int64(in.RefundOf), Valid: true}
+	}
+	p, err = scanPayment(tx.QueryRow(`INSERT INTO payments(invoice_id, kind, provider, method, amount_cents, status, reference, idempotency_key, refund_of)
+		VALUES($1,$2,$3,$4,$5,$6,'',$7,$8) RETURNING `+paymentColumns,
+		in.InvoiceID, in.Kind, in.Provider, in.Method, in.AmountCents, PaymentPending, in.IdempotencyKey, refundOf))
+	if err != nil {
+		return p, false, err
+	}
+	if err := audit(tx, a, AuditCreate, "payments", p.ID, nil); err != nil {
+		return p, false, err
+	}
+	return p, true, tx.Commit()
+}
+
+// CompletePayment stores the provider's outcome for a pending payment and
+// brings the invoice's paid amount and status up to date. Completing an
+// already completed payment is a no-op, so duplicate webhooks are harmless.
+func CompletePayment(db *sql.DB, a Actor, paymentID int, status, reference string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var invoiceID int
+	var current string
+	if err := tx.QueryRow("SELECT invoice_id, status FROM payments WHERE id = $1", paymentID).Scan(&invoiceID, &current); err != nil {
+		return err
+	}
+	// Lock the invoice before the payment so concurrent completions for the
+	// same invoice are serialised
+	if _, err := tx.Exec("SELECT 1 FROM invoices WHERE id = $1 FOR UPDATE", invoiceID); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT status FROM payments WHERE id = $1 FOR UPDATE", paymentID).Scan(&current); err != nil {
+		return err
+	}
+	if current != PaymentPending {
+		return nil
+	}
+
+	err = audited(tx, a, AuditUpdate, "payments", paymentID, func() error {
+		_, err := tx.Exec("UPDATE payments SET status = $1, reference = $2 WHERE id = $3", status, reference, paymentID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if status == PaymentSucceeded {
+		if err := settleInvoice(tx, a, invoiceID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CompletePaymentByReference is CompletePayment for callers that only know
+// the provider's reference, such as webhooks
+func CompletePaymentByReference(db *sql.DB, a Actor, provider, reference, status string) error {
+	var id int
+	err := db.QueryRow("SELECT id FROM payments WHERE provider = $1 AND reference = $2", provider, reference).Scan(&id)
+	if err != nil {
+		return classify(err)
+	}
+	return CompletePayment(db, a, id, status, reference)
+}
+
+// SetPaymentReference records the provider reference of a payment that is
+// still pending, so a later webhook can find it
+func SetPaymentReference(db *sql.DB, a Actor, paymentID int, reference string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = audited(tx, a, AuditUpdate, "payments", paymentID, func() error {
+		_, err := tx.Exec("UPDATE payments SET reference = $1 WHERE id = $2 AND status = $3", reference, paymentID, PaymentPending)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// settleInvoice recomputes the net amount paid on an invoice from its
+// successful payments and refunds, and moves it between issued and paid
+func settleInvoice(tx *sql.Tx, a Actor, invoiceID int) error {
+	var paid, total int64
+	var status string
+	err := tx.QueryRow(`SELECT COALESCE(SUM(CASE WHEN kind = 'refund' THEN -amount_cents ELSE amount_cents END), 0)
+		FROM payments WHERE invoice_id = $1 AND status = 'succeeded'`, invoiceID).Scan(&paid)
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT total_cents, status FROM invoices WHERE id = $1", invoiceID).Scan(&total, &status); err != nil {
+		return err
+	}
+
+	next := status
+	switch {
+	case status == InvoiceIssued && paid >= total:
+		next = InvoicePaid
+	case status == InvoicePaid && paid < total:
+		next = InvoiceIssued
+	}
+	return audited(tx, a, AuditUpdate, "invoices", invoiceID, func() error {
+		_, err := tx.Exec("UPDATE invoices SET paid_cents = $1, status = $2 WHERE id = $3", paid, next, invoiceID)
+		return err
+	})
+}
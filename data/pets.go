@@ -6,32 +6,59 @@ import (
 )
 
 type PetRow struct {
-	ID      int
-	Name    string
-	Species string
-	Breed   string
-	Birth   time.Time
-	OwnerID int
+	ID        int
+	Name      string
+	Species   string
+	Breed     string
+	Birth     time.Time
+	OwnerID   int
+	SpeciesID *int
+	BreedID   *int
+	ClinicID  int
+	Version   int
+	DeletedAt *time.Time
 }
 
+// PetInput carries the canonical species and breed names together with
+// their catalog ids; BreedID is 0 when no breed is recorded
 type PetInput struct {
-	Name    string
-	Species string
-	Breed   string
-	Birth   time.Time
-	OwnerID int
+	Name      string
+	Species   string
+	Breed     string
+	Birth     time.Time
+	OwnerID   int
+	SpeciesID int
+	BreedID   int
 }
 
-func ListPets(db *sql.DB) ([]PetRow, error) {
-	rows, err := db.Query("SELECT id, name, species, breed, birth_date, owner_id FROM pets")
+const petColumns = "id, name, species, COALESCE(breed, ''), birth_date, owner_id, species_id, breed_id, clinic_id, version, deleted_at"
+
+func scanPet(s rowScanner) (PetRow, error) {
+	var p PetRow
+	var speciesID, breedID sql.NullInt64
+	err := s.Scan(&p.ID, &p.Name, &p.Species, &p.Breed, &p.Birth, &p.OwnerID, &speciesID, &breedID, &p.ClinicID, &p.Version, &p.DeletedAt)
+	if speciesID.Valid {
+		v := int(speciesID.Int64)
+		p.SpeciesID = &v
+	}
+	if breedID.Valid {
+		v := int(breedID.Int64)
+		p.BreedID = &v
+	}
+	return p, err
+}
+
+// ListPets lists the pets of t; deleted ones only when withDeleted
+func ListPets(db *sql.DB, t Tenant, withDeleted bool) ([]PetRow, error) {
+	rows, err := db.Query("SELECT "+petColumns+" FROM pets WHERE "+inTenant("clinic_id", 1)+" AND "+orDeleted("deleted_at", 2), t, withDeleted)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	defer rows.Close()
 	s := []PetRow{}
 	for rows.Next() {
-		var p PetRow
-		if err := rows.Scan(&p.ID, &p.Name, &p.Species, &p.Breed, &p.Birth, &p.OwnerID); err != nil {
+		p, err := scanPet(rows)
+		if err != nil {
 			return nil, err
 		}
 		s = append(s, p)
@@ -39,36 +66,148 @@ func ListPets(db *sql.DB) ([]PetRow, error) {
 	return s, nil
 }
 
-func GetPetByID(db *sql.DB, id int) (PetRow, error) {
-	var p PetRow
-	err := db.QueryRow("SELECT id, name, species, breed, birth_date, owner_id FROM pets WHERE id=$1", id).
-		Scan(&p.ID, &p.Name, &p.Species, &p.Breed, &p.Birth, &p.OwnerID)
-	return p, err
+// GetPetByID returns a pet of t, which may be deleted only when withDeleted
+func GetPetByID(db *sql.DB, t Tenant, id int, withDeleted bool) (PetRow, error) {
+	p, err := scanPet(db.QueryRow("SELECT "+petColumns+" FROM pets WHERE id=$1 AND "+
+		inTenant("clinic_id", 2)+" AND "+orDeleted("deleted_at", 3), id, t, withDeleted))
+	return p, classify(err)
 }
 
-// UpdatePet updates an existing pet in the database
-func UpdatePet(db *sql.DB, id int, in PetInput) error {
+// UpdatePet updates an existing pet in the database if it is still at
+// version. The owner must be in the pet's clinic.
+func UpdatePet(db *sql.DB, t Tenant, a Actor, id, version int, in PetInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	clinic, err := clinicOf(tx, "pets", id, t)
+	if err != nil {
+		return classify(err)
+	}
+	if err := referenceInClinic(tx, "owners", in.OwnerID, clinic); err != nil {
+		return classify(err)
+	}
+
 	sqlStatement := `
 		UPDATE pets 
-		SET name = $1, species = $2, breed = $3, birth_date = $4, owner_id = $5 
-		WHERE id = $6`
+		SET name = $1, species = $2, breed = $3, birth_date = $4, owner_id = $5,
+		    species_id = $6, breed_id = $7, version = version + 1
+		WHERE id = $8 AND ` + versionIs(9)
 	
-	_, err := db.Exec(sqlStatement, in.Name, in.Species, in.Breed, in.Birth, in.OwnerID, id)
-	return err
+	err = audited(tx, a, AuditUpdate, "pets", id, func() error {
+		err := affected(tx.Exec(sqlStatement, in.Name, in.Species, in.Breed, in.Birth, in.OwnerID,
+			nullableID(in.SpeciesID), nullableID(in.BreedID), id, version))
+		return stale(tx, "pets", id, t, err)
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// PatchPet updates only the columns named in fields (name, species, breed,
+// birth_date, owner_id), taking their values from in. A new species also
+// rewrites the breed, which was checked against it. The pet must still be at
+// version and the owner in the pet's clinic. It returns the pet's new version.
+func PatchPet(db *sql.DB, t Tenant, a Actor, id, version int, in PetInput, fields []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	clinic, err := clinicOf(tx, "pets", id, t)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if hasField(fields, "owner_id") {
+		if err := referenceInClinic(tx, "owners", in.OwnerID, clinic); err != nil {
+			return 0, classify(err)
+		}
+	}
+	if hasField(fields, "species") {
+		fields = append(fields, "species_id", "breed", "breed_id")
+	} else if hasField(fields, "breed") {
+		fields = append(fields, "breed_id")
+	}
+
+	err = audited(tx, a, AuditUpdate, "pets", id, func() (err error) {
+		version, err = patchRow(tx, "pets", id, Tenant(clinic), version, fields, map[string]interface{}{
+			"name":       in.Name,
+			"species":    in.Species,
+			"species_id": nullableID(in.SpeciesID),
+			"breed":      in.Breed,
+			"breed_id":   nullableID(in.BreedID),
+			"birth_date": in.Birth,
+			"owner_id":   in.OwnerID,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return version, classify(tx.Commit())
 }
 
-// DeletePet removes a pet from the database
-func DeletePet(db *sql.DB, id int) error {
-	sqlStatement := `DELETE FROM pets WHERE id = $1`
-	_, err := db.Exec(sqlStatement, id)
-	return err
+// DeletePet marks a pet deleted, with its visits, if it is still at version
+func DeletePet(db *sql.DB, t Tenant, a Actor, id, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if err := softDelete(tx, a, "pets", id, t, version); err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditDelete, "visits", "pet_id = $1 AND deleted_at IS NULL", id); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
 
-func CreatePet(db *sql.DB, in PetInput) (int, error) {
+// CreatePet adds a pet to its owner's clinic on behalf of a
+func CreatePet(db *sql.DB, t Tenant, a Actor, in PetInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
 	var id int
-	err := db.QueryRow(
-		"INSERT INTO pets(name,species,breed,birth_date,owner_id) VALUES($1,$2,$3,$4,$5) RETURNING id",
-		in.Name, in.Species, in.Breed, in.Birth, in.OwnerID,
+	err = tx.QueryRow(
+		`INSERT INTO pets(name,species,breed,birth_date,owner_id,species_id,breed_id,clinic_id)
+		SELECT $1,$2,$3,$4::date,o.id,$6::int,$7::int,o.clinic_id FROM owners o WHERE o.id = $5 AND o.deleted_at IS NULL AND `+inTenant("o.clinic_id", 8)+`
+		RETURNING id`,
+		in.Name, in.Species, in.Breed, in.Birth, in.OwnerID, nullableID(in.SpeciesID), nullableID(in.BreedID), t,
 	).Scan(&id)
-	return id, err
+	if err == sql.ErrNoRows {
+		return 0, ErrOtherClinic
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "pets", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+func ListPetsByOwner(db *sql.DB, t Tenant, ownerID int) ([]PetRow, error) {
+	rows, err := db.Query("SELECT "+petColumns+" FROM pets WHERE owner_id = $1 AND deleted_at IS NULL AND "+inTenant("clinic_id", 2)+" ORDER BY id", ownerID, t)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+	s := []PetRow{}
+	for rows.Next() {
+		p, err := scanPet(rows)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, p)
+	}
+	return s, rows.Err()
 }
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type PrescriptionRow struct {
+	ID           int
+	VisitID      int
+	ItemID       int
+	LocationID   *int
+	Quantity     int
+	Instructions string
+	CreatedAt    time.Time
+}
+
+type PrescriptionInput struct {
+	VisitID      int
+	ItemID       int
+	LocationID   int
+	Quantity     int
+	Instructions string
+}
+
+func ListPrescriptionsByVisit(db *sql.DB, t Tenant, visitID int) ([]PrescriptionRow, error) {
+	rows, err := db.Query(`SELECT id, visit_id, item_id, location_id, quantity, instructions, created_at
+		FROM prescriptions WHERE visit_id = (SELECT id FROM visits WHERE id = $1 AND `+inTenant("clinic_id", 2)+`)
+		ORDER BY id`, visitID, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []PrescriptionRow{}
+	for rows.Next() {
+		var p PrescriptionRow
+		var loc sql.NullInt64
+		if err := rows.Scan(&p.ID, &p.VisitID, &p.ItemID, &loc, &p.Quantity, &p.Instructions, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		if loc.Valid {
+			v := int(loc.Int64)
+			p.LocationID = &v
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+// CreatePrescription records a prescription and dispenses its stock in the
+// same transaction; it fails with ErrInsufficientStock rather than go negative
+func CreatePrescription(db *sql.DB, t Tenant, a Actor, in PrescriptionInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The visit must exist in the tenant; sql.ErrNoRows otherwise. The item
+	// and location must be stock of the visit's clinic.
+	clinic, err := clinicOf(tx, "visits", in.VisitID, t)
+	if err != nil {
+		return 0, err
+	}
+	if err := stockInClinic(tx, "stock_items", in.ItemID, clinic); err != nil {
+		return 0, err
+	}
+	if in.LocationID != 0 {
+		if err := stockInClinic(tx, "stock_locations", in.LocationID, clinic); err != nil {
+			return 0, err
+		}
+	}
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO prescriptions(visit_id,item_id,location_id,quantity,instructions) VALUES($1,$2,$3,$4,$5) RETURNING id",
+		in.VisitID, in.ItemID, nullableID(in.LocationID), in.Quantity, in.Instructions,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if err := audit(tx, a, AuditCreate, "prescriptions", id, nil); err != nil {
+		return 0, err
+	}
+	if err := consumeStock(tx, a, clinic, in.ItemID, in.LocationID, in.Quantity, MovementPrescription, fmt.Sprintf("prescription:%d", id)); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
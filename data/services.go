@@ -0,0 +1,126 @@
+package data
+
+import "database/sql"
+
+// Service kinds used on the price catalog and on invoice lines
+const (
+	ServiceKindProcedure  = "procedure"
+	ServiceKindMedication = "medication"
+	ServiceKindConsumable = "consumable"
+)
+
+type ServiceRow struct {
+	ID             int
+	Code           string
+	Name           string
+	Kind           string
+	UnitPriceCents int64
+	TaxRateBP      int
+	Active         bool
+}
+
+type ServiceInput struct {
+	Code           string
+	Name           string
+	Kind           string
+	UnitPriceCents int64
+	TaxRateBP      int
+	Active         bool
+}
+
+// ValidServiceKind reports whether kind is one of the known service kinds
+func ValidServiceKind(kind string) bool {
+	switch kind {
+	case ServiceKindProcedure, ServiceKindMedication, ServiceKindConsumable:
+		return true
+	}
+	return false
+}
+
+func ListServices(db *sql.DB) ([]ServiceRow, error) {
+	rows, err := db.Query("SELECT id, code, name, kind, unit_price_cents, tax_rate_bp, active FROM services ORDER BY code")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ServiceRow{}
+	for rows.Next() {
+		var s ServiceRow
+		if err := rows.Scan(&s.ID, &s.Code, &s.Name, &s.Kind, &s.UnitPriceCents, &s.TaxRateBP, &s.Active); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func GetServiceByID(db *sql.DB, id int) (ServiceRow, error) {
+	var s ServiceRow
+	err := db.QueryRow("SELECT id, code, name, kind, unit_price_cents, tax_rate_bp, active FROM services WHERE id=$1", id).
+		Scan(&s.ID, &s.Code, &s.Name, &s.Kind, &s.UnitPriceCents, &s.TaxRateBP, &s.Active)
+	return s, classify(err)
+}
+
+func CreateService(db *sql.DB, a Actor, in ServiceInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO services(code,name,kind,unit_price_cents,tax_rate_bp,active) VALUES($1,$2,$3,$4,$5,$6) RETURNING id",
+		in.Code, in.Name, in.Kind, in.UnitPriceCents, in.TaxRateBP, in.Active,
+	).Scan(&id)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "services", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+// UpdateService updates a catalog entry. Existing invoice lines keep the
+// price they were billed at.
+func UpdateService(db *sql.DB, a Actor, id int, in ServiceInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "services", id, func() error {
+		return affected(tx.Exec(
+			"UPDATE services SET code = $1, name = $2, kind = $3, unit_price_cents = $4, tax_rate_bp = $5, active = $6 WHERE id = $7",
+			in.Code, in.Name, in.Kind, in.UnitPriceCents, in.TaxRateBP, in.Active, id,
+		))
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+func DeleteService(db *sql.DB, a Actor, id int) error {
+	return deleteAudited(db, a, "services", id)
+}
+
+// deleteAudited deletes row id of a catalog table on behalf of a.
+// Deleting a row others still refer to fails with ErrInUse.
+func deleteAudited(db *sql.DB, a Actor, table string, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditDelete, table, id, func() error {
+		return affected(tx.Exec("DELETE FROM "+table+" WHERE id = $1", id))
+	})
+	if err != nil {
+		return classifyDelete(err)
+	}
+	return classify(tx.Commit())
+}
@@ -0,0 +1,226 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Owners, pets, vets and visits are deleted by setting deleted_at, so that
+// medical history survives a mistaken delete. Deleting an owner also deletes
+// its pets and their visits, and deleting a pet its visits, at the same
+// instant; restoring brings back what was deleted with it. Deleted rows are
+// removed for good by PurgeDeleted.
+
+var (
+	// ErrNotDeleted is returned when restoring a record that is not deleted
+	ErrNotDeleted = errors.New("record is not deleted")
+	// ErrParentDeleted is returned when restoring a pet of a deleted owner
+	// or a visit of a deleted pet
+	ErrParentDeleted = errors.New("record belongs to a deleted record")
+)
+
+// orDeleted is the condition that hides rows whose deleted_at column col is
+// set, unless the boolean bound to placeholder n is true
+func orDeleted(col string, n int) string {
+	return fmt.Sprintf("($%d OR %s IS NULL)", n, col)
+}
+
+// softDelete marks row id of table in t deleted on behalf of a if it is
+// still at version
+func softDelete(tx *sql.Tx, a Actor, table string, id int, t Tenant, version int) error {
+	return audited(tx, a, AuditDelete, table, id, func() error {
+		var at time.Time
+		err := tx.QueryRow("UPDATE "+table+" SET deleted_at = now(), version = version + 1 WHERE id = $1 AND "+
+			inTenant("clinic_id", 2)+" AND "+versionIs(3)+" AND deleted_at IS NULL RETURNING deleted_at",
+			id, t, version).Scan(&at)
+		return stale(tx, table, id, t, err)
+	})
+}
+
+// setDeleted deletes (AuditDelete) or restores (AuditRestore) the rows of
+// table matching where, whose arguments start at placeholder 1, recording
+// each on behalf of a
+func setDeleted(tx *sql.Tx, a Actor, action, table, where string, args ...interface{}) error {
+	set := "deleted_at = now()"
+	if action == AuditRestore {
+		set = "deleted_at = NULL"
+	}
+	return auditedRows(tx, a, action, table, where, args, func() error {
+		_, err := tx.Exec("UPDATE "+table+" SET "+set+", version = version + 1 WHERE "+where, args...)
+		return err
+	})
+}
+
+// deletedAt locks row id of table in t and returns when it was deleted
+func deletedAt(tx *sql.Tx, table string, id int, t Tenant) (time.Time, error) {
+	var at sql.NullTime
+	err := tx.QueryRow("SELECT deleted_at FROM "+table+" WHERE id = $1 AND "+inTenant("clinic_id", 2)+" FOR UPDATE", id, t).Scan(&at)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !at.Valid {
+		return time.Time{}, ErrNotDeleted
+	}
+	return at.Time, nil
+}
+
+// RestoreOwner brings back a deleted owner with the pets and visits that
+// were deleted with it
+func RestoreOwner(db *sql.DB, t Tenant, a Actor, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	at, err := deletedAt(tx, "owners", id, t)
+	if err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditRestore, "owners", "id = $1", id); err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditRestore, "pets", "owner_id = $1 AND deleted_at = $2", id, at); err != nil {
+		return classify(err)
+	}
+	err = setDeleted(tx, a, AuditRestore, "visits", "pet_id IN (SELECT id FROM pets WHERE owner_id = $1) AND deleted_at = $2", id, at)
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// RestorePet brings back a deleted pet with the visits that were deleted
+// with it. Its owner must not be deleted.
+func RestorePet(db *sql.DB, t Tenant, a Actor, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	at, err := deletedAt(tx, "pets", id, t)
+	if err != nil {
+		return classify(err)
+	}
+	var ownerLive bool
+	err = tx.QueryRow("SELECT o.deleted_at IS NULL FROM pets p JOIN owners o ON o.id = p.owner_id WHERE p.id = $1", id).Scan(&ownerLive)
+	if err != nil && err != sql.ErrNoRows {
+		return classify(err)
+	}
+	if !ownerLive {
+		return ErrParentDeleted
+	}
+	if err := setDeleted(tx, a, AuditRestore, "pets", "id = $1", id); err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditRestore, "visits", "pet_id = $1 AND deleted_at = $2", id, at); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// RestoreVet brings back a deleted vet
+func RestoreVet(db *sql.DB, t Tenant, a Actor, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := deletedAt(tx, "vets", id, t); err != nil {
+		return classify(err)
+	}
+	if err := setDeleted(tx, a, AuditRestore, "vets", "id = $1", id); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// RestoreVisit brings back a deleted visit. Its pet must not be deleted.
+func RestoreVisit(db *sql.DB, t Tenant, a Actor, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := deletedAt(tx, "visits", id, t); err != nil {
+		return classify(err)
+	}
+	var petLive bool
+	err = tx.QueryRow("SELECT p.deleted_at IS NULL FROM visits v JOIN pets p ON p.id = v.pet_id WHERE v.id = $1", id).Scan(&petLive)
+	if err != nil && err != sql.ErrNoRows {
+		return classify(err)
+	}
+	if !petLive {
+		return ErrParentDeleted
+	}
+	if err := setDeleted(tx, a, AuditRestore, "visits", "id = $1", id); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// PurgeCounts is the number of rows of each table PurgeDeleted removed
+type PurgeCounts struct {
+	Owners int64
+	Pets   int64
+	Vets   int64
+	Visits int64
+}
+
+// PurgeDeleted removes rows deleted before cutoff, recording each with its
+// last contents. Visits are medical records and also stay until their visit
+// date is before recordsCutoff. A row is kept while anything still refers to
+// it, so no foreign key cascades or nulls out unaudited rows: visits stay
+// while they have prescriptions, lab orders or invoices, pets while they have
+// visits, owners while they have pets, invoices, portal accounts or
+// invitations, and vets while visits name them.
+func PurgeDeleted(db *sql.DB, cutoff, recordsCutoff time.Time) (PurgeCounts, error) {
+	var n PurgeCounts
+	tx, err := db.Begin()
+	if err != nil {
+		return n, classify(err)
+	}
+	defer tx.Rollback()
+
+	steps := []struct {
+		count *int64
+		stmt  string
+		args  []interface{}
+	}{
+		{&n.Visits, purgeAudited("visits", `visit_date < $2
+			AND NOT EXISTS (SELECT 1 FROM prescriptions p WHERE p.visit_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM lab_orders l WHERE l.visit_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.visit_id = t.id)`), []interface{}{cutoff, recordsCutoff}},
+		{&n.Pets, purgeAudited("pets", `NOT EXISTS (SELECT 1 FROM visits v WHERE v.pet_id = t.id)`), []interface{}{cutoff}},
+		{&n.Owners, purgeAudited("owners", `NOT EXISTS (SELECT 1 FROM pets p WHERE p.owner_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.owner_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM users u WHERE u.owner_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM owner_invitations oi WHERE oi.owner_id = t.id)`), []interface{}{cutoff}},
+		{&n.Vets, purgeAudited("vets", `NOT EXISTS (SELECT 1 FROM visits v WHERE v.vet_id = t.id)`), []interface{}{cutoff}},
+	}
+	for _, s := range steps {
+		res, err := tx.Exec(s.stmt, s.args...)
+		if err != nil {
+			return PurgeCounts{}, classify(err)
+		}
+		if *s.count, err = res.RowsAffected(); err != nil {
+			return PurgeCounts{}, err
+		}
+	}
+	return n, classify(tx.Commit())
+}
+
+// purgeAudited is the statement deleting the rows t of table deleted before
+// $1 that also match cond, and recording each in audit_events. It affects one
+// row per purged row.
+func purgeAudited(table, cond string) string {
+	return `WITH gone AS (DELETE FROM ` + table + ` t WHERE t.deleted_at < $1 AND ` + cond + `
+		RETURNING t.id, t.clinic_id, to_jsonb(t) - 'version' AS row)
+		INSERT INTO audit_events(action, entity_type, entity_id, clinic_id, before)
+		SELECT '` + AuditPurge + `', '` + auditEntities[table] + `', id, clinic_id, row FROM gone`
+}
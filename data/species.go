@@ -0,0 +1,376 @@
+package data
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+type SpeciesRow struct {
+	ID      int
+	Name    string
+	Aliases []string
+}
+
+type SpeciesInput struct {
+	Name    string
+	Aliases []string
+}
+
+type BreedRow struct {
+	ID          int
+	SpeciesID   int
+	Name        string
+	Aliases     []string
+	MinWeightKg *float64
+	MaxWeightKg *float64
+}
+
+type BreedInput struct {
+	SpeciesID   int
+	Name        string
+	Aliases     []string
+	MinWeightKg *float64
+	MaxWeightKg *float64
+}
+
+// SpeciesMigrationReport describes how free-text pet species and breeds were
+// mapped onto the reference catalog
+type SpeciesMigrationReport struct {
+	MappedSpecies   int
+	MappedBreeds    int
+	UnmappedSpecies map[string]int
+	UnmappedBreeds  map[string]int
+	AlreadyLinked   int
+}
+
+func normaliseAlias(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// -------------------- Species --------------------
+
+func ListSpecies(db *sql.DB) ([]SpeciesRow, error) {
+	rows, err := db.Query(`SELECT s.id, s.name, COALESCE(array_to_string(array_agg(a.alias ORDER BY a.alias) FILTER (WHERE a.alias IS NOT NULL), ','), '')
+		FROM species s LEFT JOIN species_aliases a ON a.species_id = s.id
+		GROUP BY s.id ORDER BY s.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []SpeciesRow{}
+	for rows.Next() {
+		var s SpeciesRow
+		var aliases string
+		if err := rows.Scan(&s.ID, &s.Name, &aliases); err != nil {
+			return nil, err
+		}
+		s.Aliases = splitAliases(aliases)
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func GetSpeciesByID(db *sql.DB, id int) (SpeciesRow, error) {
+	var s SpeciesRow
+	var aliases string
+	err := db.QueryRow(`SELECT s.id, s.name, COALESCE(array_to_string(array_agg(a.alias ORDER BY a.alias) FILTER (WHERE a.alias IS NOT NULL), ','), '')
+		FROM species s LEFT JOIN species_aliases a ON a.species_id = s.id
+		WHERE s.id = $1 GROUP BY s.id`, id).Scan(&s.ID, &s.Name, &aliases)
+	s.Aliases = splitAliases(aliases)
+	return s, classify(err)
+}
+
+// ResolveSpecies finds the species whose name or alias matches text,
+// ignoring case and surrounding space
+func ResolveSpecies(db *sql.DB, text string) (SpeciesRow, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM species WHERE LOWER(name) = $1
+		UNION SELECT species_id FROM species_aliases WHERE alias = $1 LIMIT 1`, normaliseAlias(text)).Scan(&id)
+	if err != nil {
+		return SpeciesRow{}, classify(err)
+	}
+	return GetSpeciesByID(db, id)
+}
+
+func CreateSpecies(db *sql.DB, a Actor, in SpeciesInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	if err := tx.QueryRow("INSERT INTO species(name) VALUES($1) RETURNING id", strings.TrimSpace(in.Name)).Scan(&id); err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "species", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	if err := replaceAliases(tx, "species_aliases", "species_id", id, in.Aliases); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+// UpdateSpecies renames a species and replaces its aliases. Pets linked to
+// the species pick up the new name. The changes are recorded as made by a.
+func UpdateSpecies(db *sql.DB, a Actor, id int, in SpeciesInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	name := strings.TrimSpace(in.Name)
+	err = audited(tx, a, AuditUpdate, "species", id, func() error {
+		return affected(tx.Exec("UPDATE species SET name = $1 WHERE id = $2", name, id))
+	})
+	if err != nil {
+		return classify(err)
+	}
+	err = auditedRows(tx, a, AuditUpdate, "pets", "species_id = $1", []interface{}{id}, func() error {
+		_, err := tx.Exec("UPDATE pets SET species = $1, version = version + 1 WHERE species_id = $2", name, id)
+		return err
+	})
+	if err != nil {
+		return classify(err)
+	}
+	if err := replaceAliases(tx, "species_aliases", "species_id", id, in.Aliases); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+func DeleteSpecies(db *sql.DB, a Actor, id int) error {
+	return deleteAudited(db, a, "species", id)
+}
+
+// -------------------- Breeds --------------------
+
+const breedSelect = `SELECT b.id, b.species_id, b.name, b.min_weight_kg, b.max_weight_kg,
+	COALESCE(array_to_string(array_agg(a.alias ORDER BY a.alias) FILTER (WHERE a.alias IS NOT NULL), ','), '')
+	FROM breeds b LEFT JOIN breed_aliases a ON a.breed_id = b.id `
+
+func scanBreed(s rowScanner) (BreedRow, error) {
+	var b BreedRow
+	var min, max sql.NullFloat64
+	var aliases string
+	err := s.Scan(&b.ID, &b.SpeciesID, &b.Name, &min, &max, &aliases)
+	b.MinWeightKg, b.MaxWeightKg = floatPtr(min), floatPtr(max)
+	b.Aliases = splitAliases(aliases)
+	return b, classify(err)
+}
+
+// ListBreeds lists breeds, optionally only those of one species
+func ListBreeds(db *sql.DB, speciesID int) ([]BreedRow, error) {
+	rows, err := db.Query(breedSelect+`WHERE ($1 = 0 OR b.species_id = $1) GROUP BY b.id ORDER BY b.name`, speciesID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []BreedRow{}
+	for rows.Next() {
+		b, err := scanBreed(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
+
+func GetBreedByID(db *sql.DB, id int) (BreedRow, error) {
+	return scanBreed(db.QueryRow(breedSelect+`WHERE b.id = $1 GROUP BY b.id`, id))
+}
+
+// ResolveBreed finds a breed of the given species by name or alias
+func ResolveBreed(db *sql.DB, speciesID int, text string) (BreedRow, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM breeds WHERE species_id = $1 AND LOWER(name) = $2
+		UNION SELECT a.breed_id FROM breed_aliases a JOIN breeds b ON b.id = a.breed_id
+		WHERE b.species_id = $1 AND a.alias = $2 LIMIT 1`, speciesID, normaliseAlias(text)).Scan(&id)
+	if err != nil {
+		return BreedRow{}, classify(err)
+	}
+	return GetBreedByID(db, id)
+}
+
+func CreateBreed(db *sql.DB, a Actor, in BreedInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO breeds(species_id,name,min_weight_kg,max_weight_kg) VALUES($1,$2,$3,$4) RETURNING id",
+		in.SpeciesID, strings.TrimSpace(in.Name), in.MinWeightKg, in.MaxWeightKg,
+	).Scan(&id)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "breeds", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	if err := replaceAliases(tx, "breed_aliases", "breed_id", id, in.Aliases); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+// UpdateBreed changes a breed and replaces its aliases. Pets linked to the
+// breed pick up the new name, and its species when the breed moves to
+// another. The changes are recorded as made by a.
+func UpdateBreed(db *sql.DB, a Actor, id int, in BreedInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	name := strings.TrimSpace(in.Name)
+	err = audited(tx, a, AuditUpdate, "breeds", id, func() error {
+		return affected(tx.Exec(
+			"UPDATE breeds SET species_id = $1, name = $2, min_weight_kg = $3, max_weight_kg = $4 WHERE id = $5",
+			in.SpeciesID, name, in.MinWeightKg, in.MaxWeightKg, id,
+		))
+	})
+	if err != nil {
+		return classify(err)
+	}
+	err = auditedRows(tx, a, AuditUpdate, "pets", "breed_id = $1", []interface{}{id}, func() error {
+		_, err := tx.Exec(`UPDATE pets SET breed = $1, species_id = $2,
+			species = (SELECT name FROM species WHERE id = $2), version = version + 1
+			WHERE breed_id = $3`, name, in.SpeciesID, id)
+		return err
+	})
+	if err != nil {
+		return classify(err)
+	}
+	if err := replaceAliases(tx, "breed_aliases", "breed_id", id, in.Aliases); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+func DeleteBreed(db *sql.DB, a Actor, id int) error {
+	return deleteAudited(db, a, "breeds", id)
+}
+
+// -------------------- Migration --------------------
+
+// MigratePetSpecies links pets that still only have free-text species and
+// breed values to the catalog, rewriting the text to the canonical names.
+// Values that match no species, breed or alias are left untouched and
+// reported with the number of pets using them. Only pets of the tenant are
+// touched, and the changes are recorded as made by a. With dryRun nothing is
+// saved.
+func MigratePetSpecies(db *sql.DB, t Tenant, a Actor, dryRun bool) (SpeciesMigrationReport, error) {
+	report := SpeciesMigrationReport{UnmappedSpecies: map[string]int{}, UnmappedBreeds: map[string]int{}}
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pets WHERE species_id IS NOT NULL AND (breed_id IS NOT NULL OR COALESCE(breed, '') = '') AND "+
+		inTenant("clinic_id", 1), t).Scan(&report.AlreadyLinked); err != nil {
+		return report, err
+	}
+
+	err = auditedRows(tx, a, AuditUpdate, "pets", "species_id IS NULL AND "+inTenant("clinic_id", 1), []interface{}{t}, func() error {
+		res, err := tx.Exec(`UPDATE pets p SET species_id = m.species_id, species = s.name, version = p.version + 1
+			FROM (SELECT LOWER(name) AS alias, id AS species_id FROM species
+			      UNION SELECT alias, species_id FROM species_aliases) m
+			JOIN species s ON s.id = m.species_id
+			WHERE p.species_id IS NULL AND LOWER(TRIM(p.species)) = m.alias AND `+inTenant("p.clinic_id", 1), t)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		report.MappedSpecies = int(n)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = auditedRows(tx, a, AuditUpdate, "pets", "breed_id IS NULL AND "+inTenant("clinic_id", 1), []interface{}{t}, func() error {
+		res, err := tx.Exec(`UPDATE pets p SET breed_id = m.breed_id, breed = b.name, version = p.version + 1
+			FROM (SELECT LOWER(name) AS alias, id AS breed_id, species_id FROM breeds
+			      UNION SELECT a.alias, a.breed_id, b.species_id FROM breed_aliases a JOIN breeds b ON b.id = a.breed_id) m
+			JOIN breeds b ON b.id = m.breed_id
+			WHERE p.breed_id IS NULL AND p.species_id = m.species_id AND LOWER(TRIM(p.breed)) = m.alias AND `+inTenant("p.clinic_id", 1), t)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		report.MappedBreeds = int(n)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if err := countValues(tx, report.UnmappedSpecies,
+		"SELECT species, COUNT(*) FROM pets WHERE species_id IS NULL AND "+inTenant("clinic_id", 1)+" GROUP BY species", t); err != nil {
+		return report, err
+	}
+	if err := countValues(tx, report.UnmappedBreeds,
+		`SELECT COALESCE(species, '') || ' / ' || breed, COUNT(*) FROM pets
+		WHERE breed_id IS NULL AND COALESCE(breed, '') <> '' AND `+inTenant("clinic_id", 1)+` GROUP BY species, breed`, t); err != nil {
+		return report, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+func countValues(tx *sql.Tx, into map[string]int, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v string
+		var n int
+		if err := rows.Scan(&v, &n); err != nil {
+			return err
+		}
+		into[v] = n
+	}
+	return rows.Err()
+}
+
+// replaceAliases swaps the aliases of a species or breed for the given set
+func replaceAliases(tx *sql.Tx, table, fk string, id int, aliases []string) error {
+	if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+fk+" = $1", id); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, a := range aliases {
+		a = normaliseAlias(a)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		if _, err := tx.Exec("INSERT INTO "+table+"("+fk+", alias) VALUES($1, $2)", id, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitAliases(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	parts := strings.Split(s, ",")
+	sort.Strings(parts)
+	return parts
+}
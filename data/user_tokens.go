@@ -0,0 +1,112 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Purposes of single-use user tokens
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+// ErrTokenInvalid is returned for tokens that are unknown, expired or
+// already used
+var ErrTokenInvalid = errors.New("token is invalid or has expired")
+
+// CreateUserToken stores the hash of a single-use token for a user. Earlier
+// unused tokens with the same purpose stop working.
+func CreateUserToken(db *sql.DB, userID int, purpose, tokenHash string, expiresAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID, purpose); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO user_tokens(user_id,purpose,token_hash,expires_at) VALUES($1,$2,$3,$4)",
+		userID, purpose, tokenHash, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// consumeUserToken marks a valid token as used and returns its user
+func consumeUserToken(tx *sql.Tx, purpose, tokenHash string) (int, error) {
+	var userID int
+	err := tx.QueryRow(`UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id`, tokenHash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrTokenInvalid
+	}
+	return userID, err
+}
+
+// UserForToken returns the user a valid token belongs to without using it
+func UserForToken(db *sql.DB, purpose, tokenHash string) (UserRow, error) {
+	u, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = (
+		SELECT user_id FROM user_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP)`,
+		tokenHash, purpose))
+	if err == sql.ErrNoRows {
+		return UserRow{}, ErrTokenInvalid
+	}
+	return u, err
+}
+
+// VerifyEmail redeems an email verification token
+func VerifyEmail(db *sql.DB, a Actor, tokenHash string) (UserRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserRow{}, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, TokenVerifyEmail, tokenHash)
+	if err != nil {
+		return UserRow{}, err
+	}
+	var u UserRow
+	err = audited(tx, a, AuditUpdate, "users", userID, func() (err error) {
+		u, err = scanUser(tx.QueryRow(
+			"UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = $1 RETURNING "+userColumns, userID))
+		return err
+	})
+	if err != nil {
+		return UserRow{}, err
+	}
+	return u, tx.Commit()
+}
+
+// ResetPassword redeems a password reset token and sets a new password
+// hash. Completing a reset also proves ownership of the address, so the
+// email counts as verified.
+func ResetPassword(db *sql.DB, a Actor, tokenHash, passwordHash string) (UserRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserRow{}, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, TokenResetPassword, tokenHash)
+	if err != nil {
+		return UserRow{}, err
+	}
+	var u UserRow
+	err = audited(tx, a, AuditUpdate, "users", userID, func() (err error) {
+		u, err = scanUser(tx.QueryRow(`UPDATE users SET password_hash = $1,
+			email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+			WHERE id = $2 RETURNING `+userColumns, passwordHash, userID))
+		return err
+	})
+	if err != nil {
+		return UserRow{}, err
+	}
+	return u, tx.Commit()
+}
@@ -2,12 +2,58 @@ package data
 
 import (
 	"database/sql"
+	"time"
+)
+
+// User roles. Staff work with every record of their clinic and admins
+// additionally manage its accounts; owners only see their own pets, visits
+// and invoices through the portal. Super-admins belong to no clinic and
+// manage all of them. Pending accounts registered themselves and see
+// nothing but their own profile until an admin gives them a role.
+const (
+	RoleSuperAdmin = "superadmin"
+	RoleAdmin      = "admin"
+	RoleStaff      = "staff"
+	RoleOwner      = "owner"
+	RolePending    = "pending"
 )
 
 type UserRow struct {
-	ID           int
-	Email        string
-	PasswordHash string
+	ID            int
+	Email         string
+	PasswordHash  string
+	Role          string
+	OwnerID       *int
+	EmailVerified bool
+	TOTPEnabled   bool
+	Active        bool
+	CreatedAt     time.Time
+	ClinicID      *int
+}
+
+// UserInput is what admins set on an account; OwnerID is only kept for
+// owner accounts
+type UserInput struct {
+	Email   string
+	Role    string
+	OwnerID *int
+}
+
+const userColumns = "id, email, password_hash, role, owner_id, email_verified_at IS NOT NULL, totp_enabled, deactivated_at IS NULL, created_at, clinic_id"
+
+func scanUser(s rowScanner) (UserRow, error) {
+	var u UserRow
+	var ownerID, clinicID sql.NullInt64
+	err := s.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Role, &ownerID, &u.EmailVerified, &u.TOTPEnabled, &u.Active, &u.CreatedAt, &clinicID)
+	if ownerID.Valid {
+		v := int(ownerID.Int64)
+		u.OwnerID = &v
+	}
+	if clinicID.Valid {
+		v := int(clinicID.Int64)
+		u.ClinicID = &v
+	}
+	return u, err
 }
 
 func EmailExists(db *sql.DB, email string) (bool, error) {
@@ -18,16 +64,159 @@ func EmailExists(db *sql.DB, email string) (bool, error) {
 	return c > 0, nil
 }
 
-func CreateUser(db *sql.DB, email, passwordHash string) (UserRow, error) {
-	var u UserRow
-	err := db.QueryRow("INSERT INTO users(email, password_hash) VALUES($1,$2) RETURNING id, email, password_hash", email, passwordHash).
-		Scan(&u.ID, &u.Email, &u.PasswordHash)
-	return u, err
+// CreateUser creates a self-registered account in a clinic. It is pending
+// until an admin of the clinic gives it a role.
+func CreateUser(db *sql.DB, a Actor, clinic int, email, passwordHash string) (UserRow, error) {
+	u, err := writeUser(db, a, AuditCreate, 0, "INSERT INTO users(email, password_hash, role, clinic_id) VALUES($1,$2,$3,$4) RETURNING "+userColumns,
+		email, passwordHash, RolePending, clinic)
+	return u, classify(err)
 }
 
 func FindUserByEmail(db *sql.DB, email string) (UserRow, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE email=$1", email))
+}
+
+func GetUserByID(db *sql.DB, id int) (UserRow, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id=$1", id))
+}
+
+// writeUser runs query, an insert (action AuditCreate) or an update of
+// account id returning userColumns, and records it on behalf of a
+func writeUser(db *sql.DB, a Actor, action string, id int, query string, args ...interface{}) (UserRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserRow{}, err
+	}
+	defer tx.Rollback()
+
 	var u UserRow
-	err := db.QueryRow("SELECT id, email, password_hash FROM users WHERE email=$1", email).
-		Scan(&u.ID, &u.Email, &u.PasswordHash)
-	return u, err
+	if action == AuditCreate {
+		if u, err = scanUser(tx.QueryRow(query, args...)); err == nil {
+			err = audit(tx, a, action, "users", u.ID, nil)
+		}
+	} else {
+		err = audited(tx, a, action, "users", id, func() (err error) {
+			u, err = scanUser(tx.QueryRow(query, args...))
+			return err
+		})
+	}
+	if err != nil {
+		return u, err
+	}
+	return u, tx.Commit()
+}
+
+// notSuperAdmin keeps account management away from super-admins, which are
+// only set up in the database
+const notSuperAdmin = "role <> '" + RoleSuperAdmin + "'"
+
+// GetClinicUser is GetUserByID limited to the accounts of a tenant
+func GetClinicUser(db *sql.DB, t Tenant, id int) (UserRow, error) {
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id=$1 AND "+inTenant("clinic_id", 2), id, t))
+	return u, classify(err)
+}
+
+func ListUsers(db *sql.DB, t Tenant) ([]UserRow, error) {
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE "+inTenant("clinic_id", 1)+" ORDER BY id", t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []UserRow
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func ownerIDFor(in UserInput) sql.NullInt64 {
+	if in.Role != RoleOwner || in.OwnerID == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*in.OwnerID), Valid: true}
+}
+
+// CreateUserAccount creates an account with any clinic role in the tenant,
+// as admins do
+func CreateUserAccount(db *sql.DB, t Tenant, a Actor, in UserInput, passwordHash string) (UserRow, error) {
+	if t == AllClinics {
+		return UserRow{}, ErrClinicRequired
+	}
+	u, err := writeUser(db, a, AuditCreate, 0, "INSERT INTO users(email, password_hash, role, owner_id, clinic_id) VALUES($1,$2,$3,$4,$5) RETURNING "+userColumns,
+		in.Email, passwordHash, in.Role, ownerIDFor(in), t)
+	return u, classify(err)
+}
+
+// UpdateUser changes an account's email, role and owner. A new email
+// address has to be verified again.
+func UpdateUser(db *sql.DB, t Tenant, a Actor, id int, in UserInput) (UserRow, error) {
+	u, err := writeUser(db, a, AuditUpdate, id, `UPDATE users SET
+		email_verified_at = CASE WHEN email = $1 THEN email_verified_at END,
+		email = $1, role = $2, owner_id = $3
+		WHERE id = $4 AND `+notSuperAdmin+` AND `+inTenant("clinic_id", 5)+` RETURNING `+userColumns, in.Email, in.Role, ownerIDFor(in), id, t)
+	return u, classify(err)
+}
+
+// UpdateUserEmail changes the email of an account, which then has to be
+// verified again
+func UpdateUserEmail(db *sql.DB, a Actor, id int, email string) (UserRow, error) {
+	u, err := writeUser(db, a, AuditUpdate, id, `UPDATE users SET
+		email_verified_at = CASE WHEN email = $1 THEN email_verified_at END,
+		email = $1
+		WHERE id = $2 RETURNING `+userColumns, email, id)
+	return u, classify(err)
+}
+
+func SetUserPassword(db *sql.DB, a Actor, id int, passwordHash string) error {
+	_, err := writeUser(db, a, AuditUpdate, id, "UPDATE users SET password_hash = $1 WHERE id = $2 RETURNING "+userColumns, passwordHash, id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// SetUserActive deactivates or reactivates an account. Deactivated accounts
+// cannot log in and their tokens stop working.
+func SetUserActive(db *sql.DB, t Tenant, a Actor, id int, active bool) (UserRow, error) {
+	u, err := writeUser(db, a, AuditUpdate, id, `UPDATE users SET
+		deactivated_at = CASE WHEN $1 THEN NULL ELSE COALESCE(deactivated_at, CURRENT_TIMESTAMP) END
+		WHERE id = $2 AND `+notSuperAdmin+` AND `+inTenant("clinic_id", 3)+` RETURNING `+userColumns, active, id, t)
+	return u, classify(err)
+}
+
+// DeleteUser removes an account with its recovery codes. It reports false
+// when there was none.
+func DeleteUser(db *sql.DB, t Tenant, a Actor, id int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	account := "id = $1 AND " + notSuperAdmin + " AND " + inTenant("clinic_id", 2)
+	err = auditedRows(tx, a, AuditDelete, "user_recovery_codes", "user_id IN (SELECT id FROM users WHERE "+account+")", []interface{}{id, t}, func() error {
+		_, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id IN (SELECT id FROM users WHERE "+account+")", id, t)
+		return err
+	})
+	if err != nil {
+		return false, classify(err)
+	}
+	var n int64
+	err = audited(tx, a, AuditDelete, "users", id, func() error {
+		res, err := tx.Exec("DELETE FROM users WHERE "+account, id, t)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return false, classifyDelete(err)
+	}
+	return n > 0, tx.Commit()
 }
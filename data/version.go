@@ -0,0 +1,31 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Owners, pets, vets and visits carry a version that every change
+// increments. Updates and deletes name the version they were based on and
+// fail with ErrVersionMismatch when the row has moved on since.
+
+// ErrVersionMismatch means the row was changed since the caller read it
+var ErrVersionMismatch = errors.New("record was changed by someone else")
+
+// versionIs is the condition that a row still has the version in parameter n
+func versionIs(n int) string {
+	return fmt.Sprintf("version = $%d", n)
+}
+
+// stale turns sql.ErrNoRows from a versioned update or delete into
+// ErrVersionMismatch when the row still exists in t
+func stale(q querier, table string, id int, t Tenant, err error) error {
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if _, cerr := clinicOf(q, table, id, t); cerr == nil {
+		return ErrVersionMismatch
+	}
+	return err
+}
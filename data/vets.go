@@ -1,11 +1,17 @@
 package data
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type VetRow struct {
 	ID            int
 	Name          string
 	Specialization string
+	ClinicID      int
+	Version       int
+	DeletedAt     *time.Time
 }
 
 type VetInput struct {
@@ -13,17 +19,19 @@ type VetInput struct {
 	Specialization string
 }
 
-func ListVets(db *sql.DB) ([]VetRow, error) {
-	rows, err := db.Query("SELECT id, name, specialization FROM vets ORDER BY name")
+// ListVets lists the vets of t by name; deleted ones only when withDeleted
+func ListVets(db *sql.DB, t Tenant, withDeleted bool) ([]VetRow, error) {
+	rows, err := db.Query("SELECT id, name, specialization, clinic_id, version, deleted_at FROM vets WHERE "+
+		inTenant("clinic_id", 1)+" AND "+orDeleted("deleted_at", 2)+" ORDER BY name", t, withDeleted)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	defer rows.Close()
 
 	var vets []VetRow
 	for rows.Next() {
 		var v VetRow
-		if err := rows.Scan(&v.ID, &v.Name, &v.Specialization); err != nil {
+		if err := rows.Scan(&v.ID, &v.Name, &v.Specialization, &v.ClinicID, &v.Version, &v.DeletedAt); err != nil {
 			return nil, err
 		}
 		vets = append(vets, v)
@@ -31,32 +39,95 @@ func ListVets(db *sql.DB) ([]VetRow, error) {
 	return vets, nil
 }
 
-func GetVetByID(db *sql.DB, id int) (VetRow, error) {
+// GetVetByID returns a vet of t, which may be deleted only when withDeleted
+func GetVetByID(db *sql.DB, t Tenant, id int, withDeleted bool) (VetRow, error) {
 	var v VetRow
-	err := db.QueryRow("SELECT id, name, specialization FROM vets WHERE id = $1", id).
-		Scan(&v.ID, &v.Name, &v.Specialization)
-	return v, err
+	err := db.QueryRow("SELECT id, name, specialization, clinic_id, version, deleted_at FROM vets WHERE id = $1 AND "+
+		inTenant("clinic_id", 2)+" AND "+orDeleted("deleted_at", 3), id, t, withDeleted).
+		Scan(&v.ID, &v.Name, &v.Specialization, &v.ClinicID, &v.Version, &v.DeletedAt)
+	return v, classify(err)
 }
 
-func CreateVet(db *sql.DB, in VetInput) (int, error) {
+// CreateVet adds a vet to clinic t on behalf of a
+func CreateVet(db *sql.DB, t Tenant, a Actor, in VetInput) (int, error) {
+	if t == AllClinics {
+		return 0, ErrClinicRequired
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
 	var id int
-	err := db.QueryRow(
-		"INSERT INTO vets(name, specialization) VALUES($1, $2) RETURNING id",
-		in.Name, in.Specialization,
+	err = tx.QueryRow(
+		"INSERT INTO vets(name, specialization, clinic_id) VALUES($1, $2, $3) RETURNING id",
+		in.Name, in.Specialization, t,
 	).Scan(&id)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "vets", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
+}
+
+// UpdateVet updates a vet if it is still at version
+func UpdateVet(db *sql.DB, t Tenant, a Actor, id, version int, in VetInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
 
-	return id, err
+	err = audited(tx, a, AuditUpdate, "vets", id, func() error {
+		err := affected(tx.Exec(
+			"UPDATE vets SET name = $1, specialization = $2, version = version + 1 WHERE id = $3 AND "+inTenant("clinic_id", 4)+" AND "+versionIs(5),
+			in.Name, in.Specialization, id, t, version,
+		))
+		return stale(tx, "vets", id, t, err)
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
 
-func UpdateVet(db *sql.DB, id int, in VetInput) error {
-	_, err := db.Exec(
-		"UPDATE vets SET name = $1, specialization = $2 WHERE id = $3",
-		in.Name, in.Specialization, id,
-	)
-	return err
+// PatchVet updates only the columns named in fields (name,
+// specialization), taking their values from in, if it is still at version.
+// It returns the vet's new version.
+func PatchVet(db *sql.DB, t Tenant, a Actor, id, version int, in VetInput, fields []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, a, AuditUpdate, "vets", id, func() (err error) {
+		version, err = patchRow(tx, "vets", id, t, version, fields, map[string]interface{}{
+			"name":           in.Name,
+			"specialization": in.Specialization,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return version, classify(tx.Commit())
 }
 
-func DeleteVet(db *sql.DB, id int) error {
-	_, err := db.Exec("DELETE FROM vets WHERE id = $1", id)
-	return err
+// DeleteVet marks a vet deleted if it is still at version. Visits keep
+// naming the vet.
+func DeleteVet(db *sql.DB, t Tenant, a Actor, id, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if err := softDelete(tx, a, "vets", id, t, version); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
@@ -6,11 +6,14 @@ import (
 )
 
 type VisitRow struct {
-	ID    int
-	PetID int
-	VetID int
-	Visit time.Time
-	Desc  string
+	ID       int
+	PetID    int
+	VetID    int
+	Visit    time.Time
+	Desc     string
+	ClinicID  int
+	Version   int
+	DeletedAt *time.Time
 }
 
 type VisitInput struct {
@@ -20,16 +23,18 @@ type VisitInput struct {
 	Desc  string
 }
 
-func ListVisits(db *sql.DB) ([]VisitRow, error) {
-	rows, err := db.Query("SELECT id, pet_id, vet_id, visit_date, description FROM visits")
+// ListVisits lists the visits of t; deleted ones only when withDeleted
+func ListVisits(db *sql.DB, t Tenant, withDeleted bool) ([]VisitRow, error) {
+	rows, err := db.Query("SELECT id, pet_id, vet_id, visit_date, description, clinic_id, version, deleted_at FROM visits WHERE "+
+		inTenant("clinic_id", 1)+" AND "+orDeleted("deleted_at", 2), t, withDeleted)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	defer rows.Close()
 	res := []VisitRow{}
 	for rows.Next() {
 		var v VisitRow
-		if err := rows.Scan(&v.ID, &v.PetID, &v.VetID, &v.Visit, &v.Desc); err != nil {
+		if err := rows.Scan(&v.ID, &v.PetID, &v.VetID, &v.Visit, &v.Desc, &v.ClinicID, &v.Version, &v.DeletedAt); err != nil {
 			return nil, err
 		}
 		res = append(res, v)
@@ -37,36 +42,165 @@ func ListVisits(db *sql.DB) ([]VisitRow, error) {
 	return res, nil
 }
 
-func GetVisitByID(db *sql.DB, id int) (VisitRow, error) {
+// GetVisitByID returns a visit of t, which may be deleted only when
+// withDeleted
+func GetVisitByID(db *sql.DB, t Tenant, id int, withDeleted bool) (VisitRow, error) {
 	var v VisitRow
-	err := db.QueryRow("SELECT id, pet_id, vet_id, visit_date, description FROM visits WHERE id=$1", id).
-		Scan(&v.ID, &v.PetID, &v.VetID, &v.Visit, &v.Desc)
-	return v, err
+	err := db.QueryRow("SELECT id, pet_id, vet_id, visit_date, description, clinic_id, version, deleted_at FROM visits WHERE id=$1 AND "+
+		inTenant("clinic_id", 2)+" AND "+orDeleted("deleted_at", 3), id, t, withDeleted).
+		Scan(&v.ID, &v.PetID, &v.VetID, &v.Visit, &v.Desc, &v.ClinicID, &v.Version, &v.DeletedAt)
+	return v, classify(err)
 }
 
-func CreateVisit(db *sql.DB, in VisitInput) (int, error) {
+// CreateVisit records a visit in the pet's clinic on behalf of a; the vet
+// must work there
+func CreateVisit(db *sql.DB, t Tenant, a Actor, in VisitInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	clinic, err := clinicOf(tx, "pets", in.PetID, t)
+	if err == sql.ErrNoRows {
+		return 0, ErrOtherClinic
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := referenceInClinic(tx, "vets", in.VetID, clinic); err != nil {
+		return 0, classify(err)
+	}
+
 	var id int
-	err := db.QueryRow(
-		"INSERT INTO visits(pet_id,vet_id,visit_date,description) VALUES($1,$2,$3,$4) RETURNING id",
-		in.PetID, in.VetID, in.Visit, in.Desc,
+	err = tx.QueryRow(
+		"INSERT INTO visits(pet_id,vet_id,visit_date,description,clinic_id) VALUES($1,$2,$3,$4,$5) RETURNING id",
+		in.PetID, in.VetID, in.Visit, in.Desc, clinic,
 	).Scan(&id)
-	return id, err
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err := audit(tx, a, AuditCreate, "visits", id, nil); err != nil {
+		return 0, classify(err)
+	}
+	return id, classify(tx.Commit())
 }
 
-// UpdateVisit updates an existing visit in the database
-func UpdateVisit(db *sql.DB, id int, in VisitInput) error {
+// UpdateVisit updates an existing visit in the database if it is still at
+// version. The pet and vet must be in the visit's clinic.
+func UpdateVisit(db *sql.DB, t Tenant, a Actor, id, version int, in VisitInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	clinic, err := clinicOf(tx, "visits", id, t)
+	if err != nil {
+		return classify(err)
+	}
+	if err := referenceInClinic(tx, "pets", in.PetID, clinic); err != nil {
+		return classify(err)
+	}
+	if err := referenceInClinic(tx, "vets", in.VetID, clinic); err != nil {
+		return classify(err)
+	}
+
 	sqlStatement := `
 		UPDATE visits 
-		SET pet_id = $1, vet_id = $2, visit_date = $3, description = $4
-		WHERE id = $5`
+		SET pet_id = $1, vet_id = $2, visit_date = $3, description = $4, version = version + 1
+		WHERE id = $5 AND ` + versionIs(6)
 	
-	_, err := db.Exec(sqlStatement, in.PetID, in.VetID, in.Visit, in.Desc, id)
-	return err
+	err = audited(tx, a, AuditUpdate, "visits", id, func() error {
+		err := affected(tx.Exec(sqlStatement, in.PetID, in.VetID, in.Visit, in.Desc, id, version))
+		return stale(tx, "visits", id, t, err)
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
 }
 
-// DeleteVisit removes a visit from the database
-func DeleteVisit(db *sql.DB, id int) error {
-	sqlStatement := `DELETE FROM visits WHERE id = $1`
-	_, err := db.Exec(sqlStatement, id)
-	return err
+// PatchVisit updates only the columns named in fields (pet_id, vet_id,
+// visit_date, description), taking their values from in. The pet and vet
+// must be in the visit's clinic, which must still be at version. It returns
+// the visit's new version.
+func PatchVisit(db *sql.DB, t Tenant, a Actor, id, version int, in VisitInput, fields []string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, classify(err)
+	}
+	defer tx.Rollback()
+
+	clinic, err := clinicOf(tx, "visits", id, t)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if hasField(fields, "pet_id") {
+		if err := referenceInClinic(tx, "pets", in.PetID, clinic); err != nil {
+			return 0, classify(err)
+		}
+	}
+	if hasField(fields, "vet_id") {
+		if err := referenceInClinic(tx, "vets", in.VetID, clinic); err != nil {
+			return 0, classify(err)
+		}
+	}
+
+	err = audited(tx, a, AuditUpdate, "visits", id, func() (err error) {
+		version, err = patchRow(tx, "visits", id, Tenant(clinic), version, fields, map[string]interface{}{
+			"pet_id":      in.PetID,
+			"vet_id":      in.VetID,
+			"visit_date":  in.Visit,
+			"description": in.Desc,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return version, classify(tx.Commit())
+}
+
+// DeleteVisit marks a visit deleted if it is still at version
+func DeleteVisit(db *sql.DB, t Tenant, a Actor, id, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	defer tx.Rollback()
+
+	if err := softDelete(tx, a, "visits", id, t, version); err != nil {
+		return classify(err)
+	}
+	return classify(tx.Commit())
+}
+
+// ListVisitsByOwner lists the visits of all pets of an owner, newest first
+func ListVisitsByOwner(db *sql.DB, t Tenant, ownerID int) ([]VisitRow, error) {
+	return listVisitsWhere(db, "p.owner_id = $1 AND v.deleted_at IS NULL AND "+inTenant("v.clinic_id", 2), ownerID, t)
+}
+
+// ListVisitsByPet lists the visits of one pet, newest first
+func ListVisitsByPet(db *sql.DB, t Tenant, petID int) ([]VisitRow, error) {
+	return listVisitsWhere(db, "v.pet_id = $1 AND v.deleted_at IS NULL AND "+inTenant("v.clinic_id", 2), petID, t)
+}
+
+func listVisitsWhere(db *sql.DB, where string, args ...interface{}) ([]VisitRow, error) {
+	rows, err := db.Query(`SELECT v.id, v.pet_id, COALESCE(v.vet_id, 0), v.visit_date, COALESCE(v.description, ''), v.clinic_id, v.version, v.deleted_at
+		FROM visits v JOIN pets p ON p.id = v.pet_id
+		WHERE `+where+` ORDER BY v.visit_date DESC, v.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []VisitRow{}
+	for rows.Next() {
+		var v VisitRow
+		if err := rows.Scan(&v.ID, &v.PetID, &v.VetID, &v.Visit, &v.Desc, &v.ClinicID, &v.Version, &v.DeletedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
 }
@@ -84,3 +84,474 @@ CREATE TABLE IF NOT EXISTS logs (
 CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level);
 CREATE INDEX IF NOT EXISTS idx_logs_created_at ON logs(created_at);
 -- +goose StatementEnd
+
+-- BILLING: PRICE CATALOG AND INVOICES
+-- Money is stored in integer minor units (cents); tax rates in basis points.
+CREATE TABLE IF NOT EXISTS services (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(200) NOT NULL,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('procedure', 'medication', 'consumable')),
+    unit_price_cents BIGINT NOT NULL CHECK (unit_price_cents >= 0),
+    tax_rate_bp INT NOT NULL DEFAULT 0 CHECK (tax_rate_bp BETWEEN 0 AND 10000),
+    active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id SERIAL PRIMARY KEY,
+    owner_id INT NOT NULL REFERENCES owners(id),
+    visit_id INT REFERENCES visits(id) ON DELETE SET NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'issued', 'paid', 'void')),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    subtotal_cents BIGINT NOT NULL DEFAULT 0,
+    tax_cents BIGINT NOT NULL DEFAULT 0,
+    discount_cents BIGINT NOT NULL DEFAULT 0 CHECK (discount_cents >= 0),
+    total_cents BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    issued_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    service_id INT REFERENCES services(id) ON DELETE SET NULL,
+    kind VARCHAR(20) NOT NULL,
+    description VARCHAR(200) NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    unit_price_cents BIGINT NOT NULL,
+    tax_rate_bp INT NOT NULL DEFAULT 0,
+    discount_cents BIGINT NOT NULL DEFAULT 0,
+    net_cents BIGINT NOT NULL,
+    tax_cents BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoices_owner_id ON invoices(owner_id);
+CREATE INDEX IF NOT EXISTS idx_invoices_visit_id ON invoices(visit_id);
+CREATE INDEX IF NOT EXISTS idx_invoice_lines_invoice_id ON invoice_lines(invoice_id);
+
+INSERT INTO services (code, name, kind, unit_price_cents, tax_rate_bp)
+VALUES
+('CONSULT', 'General consultation', 'procedure', 4500, 0),
+('VACC-RAB', 'Rabies vaccine', 'medication', 2500, 800),
+('SYRINGE', 'Disposable syringe', 'consumable', 150, 800)
+ON CONFLICT (code) DO NOTHING;
+
+-- PAYMENTS
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS paid_cents BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS payments (
+    id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL REFERENCES invoices(id),
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('payment', 'refund')),
+    provider VARCHAR(30) NOT NULL,
+    method VARCHAR(30) NOT NULL,
+    amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+    status VARCHAR(10) NOT NULL CHECK (status IN ('pending', 'succeeded', 'failed')),
+    reference VARCHAR(255) NOT NULL DEFAULT '',
+    idempotency_key VARCHAR(255) NOT NULL UNIQUE,
+    refund_of INT REFERENCES payments(id),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_invoice_id ON payments(invoice_id);
+CREATE INDEX IF NOT EXISTS idx_payments_reference ON payments(provider, reference);
+
+-- INVENTORY
+-- Batches carry the stock; the CHECK is the last line of defence against
+-- concurrent consumers driving a batch negative.
+CREATE TABLE IF NOT EXISTS stock_locations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS stock_items (
+    id SERIAL PRIMARY KEY,
+    sku VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(200) NOT NULL,
+    unit VARCHAR(20) NOT NULL DEFAULT 'unit',
+    reorder_threshold INT NOT NULL DEFAULT 0 CHECK (reorder_threshold >= 0),
+    service_id INT UNIQUE REFERENCES services(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS stock_batches (
+    id SERIAL PRIMARY KEY,
+    item_id INT NOT NULL REFERENCES stock_items(id),
+    location_id INT NOT NULL REFERENCES stock_locations(id),
+    batch_no VARCHAR(50) NOT NULL DEFAULT '',
+    expires_on DATE,
+    quantity INT NOT NULL CHECK (quantity >= 0),
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id SERIAL PRIMARY KEY,
+    item_id INT NOT NULL REFERENCES stock_items(id),
+    batch_id INT NOT NULL REFERENCES stock_batches(id),
+    location_id INT NOT NULL REFERENCES stock_locations(id),
+    delta INT NOT NULL,
+    reason VARCHAR(20) NOT NULL,
+    reference VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS prescriptions (
+    id SERIAL PRIMARY KEY,
+    visit_id INT NOT NULL REFERENCES visits(id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES stock_items(id),
+    location_id INT REFERENCES stock_locations(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    instructions TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_batches_item_id ON stock_batches(item_id, location_id);
+CREATE INDEX IF NOT EXISTS idx_stock_batches_expires_on ON stock_batches(expires_on);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_item_id ON stock_movements(item_id);
+CREATE INDEX IF NOT EXISTS idx_prescriptions_visit_id ON prescriptions(visit_id);
+
+
+-- LAB ORDERS AND RESULTS
+CREATE TABLE IF NOT EXISTS lab_orders (
+    id SERIAL PRIMARY KEY,
+    visit_id INT NOT NULL REFERENCES visits(id) ON DELETE CASCADE,
+    panel VARCHAR(20) NOT NULL CHECK (panel IN ('bloodwork', 'urinalysis')),
+    notes TEXT NOT NULL DEFAULT '',
+    accession VARCHAR(20) UNIQUE,
+    status VARCHAR(20) NOT NULL DEFAULT 'ordered' CHECK (status IN ('ordered', 'completed', 'cancelled')),
+    ordered_by INT REFERENCES users(id) ON DELETE SET NULL,
+    raw_file VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- species is lower case; '*' applies to any species without its own range
+CREATE TABLE IF NOT EXISTS lab_reference_ranges (
+    id SERIAL PRIMARY KEY,
+    analyte VARCHAR(20) NOT NULL,
+    species VARCHAR(50) NOT NULL,
+    unit VARCHAR(20) NOT NULL DEFAULT '',
+    low DOUBLE PRECISION,
+    high DOUBLE PRECISION,
+    UNIQUE (analyte, species)
+);
+
+CREATE TABLE IF NOT EXISTS lab_results (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES lab_orders(id) ON DELETE CASCADE,
+    analyte VARCHAR(20) NOT NULL,
+    value VARCHAR(50) NOT NULL,
+    unit VARCHAR(20) NOT NULL DEFAULT '',
+    ref_low DOUBLE PRECISION,
+    ref_high DOUBLE PRECISION,
+    flag VARCHAR(1) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (order_id, analyte)
+);
+
+CREATE INDEX IF NOT EXISTS idx_lab_orders_visit_id ON lab_orders(visit_id);
+
+INSERT INTO lab_reference_ranges (analyte, species, unit, low, high)
+VALUES
+('GLU', 'dog', 'mmol/L', 3.9, 7.9),
+('GLU', 'cat', 'mmol/L', 3.9, 8.8),
+('CREA', 'dog', 'umol/L', 44, 159),
+('CREA', 'cat', 'umol/L', 71, 212),
+('USG', '*', '', 1.015, 1.045)
+ON CONFLICT (analyte, species) DO NOTHING;
+
+-- SPECIES AND BREED CATALOG
+-- Aliases are stored lower case and map free-text input onto catalog entries
+CREATE TABLE IF NOT EXISTS species (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS species_aliases (
+    species_id INT NOT NULL REFERENCES species(id) ON DELETE CASCADE,
+    alias VARCHAR(50) NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS breeds (
+    id SERIAL PRIMARY KEY,
+    species_id INT NOT NULL REFERENCES species(id),
+    name VARCHAR(50) NOT NULL,
+    min_weight_kg NUMERIC(6,2),
+    max_weight_kg NUMERIC(6,2),
+    UNIQUE (species_id, name),
+    CHECK (min_weight_kg IS NULL OR max_weight_kg IS NULL OR min_weight_kg <= max_weight_kg)
+);
+
+CREATE TABLE IF NOT EXISTS breed_aliases (
+    breed_id INT NOT NULL REFERENCES breeds(id) ON DELETE CASCADE,
+    alias VARCHAR(50) NOT NULL,
+    PRIMARY KEY (breed_id, alias)
+);
+
+ALTER TABLE pets ADD COLUMN IF NOT EXISTS species_id INT REFERENCES species(id);
+ALTER TABLE pets ADD COLUMN IF NOT EXISTS breed_id INT REFERENCES breeds(id);
+
+INSERT INTO species (name)
+VALUES ('Dog'), ('Cat'), ('Rabbit'), ('Bird')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO species_aliases (species_id, alias)
+SELECT s.id, a.alias FROM species s JOIN (VALUES
+    ('Dog', 'canine'), ('Dog', 'puppy'),
+    ('Cat', 'feline'), ('Cat', 'kitten'),
+    ('Rabbit', 'bunny'),
+    ('Bird', 'avian'), ('Bird', 'parrot')
+) AS a(species, alias) ON a.species = s.name
+ON CONFLICT (alias) DO NOTHING;
+
+INSERT INTO breeds (species_id, name, min_weight_kg, max_weight_kg)
+SELECT s.id, b.name, b.min_kg, b.max_kg FROM species s JOIN (VALUES
+    ('Dog', 'Labrador Retriever', 25, 36),
+    ('Dog', 'Beagle', 9, 11),
+    ('Dog', 'German Shepherd', 22, 40),
+    ('Dog', 'Mixed', NULL, NULL),
+    ('Cat', 'Siamese', 3, 5),
+    ('Cat', 'Maine Coon', 5, 8),
+    ('Cat', 'Domestic Shorthair', 3, 6)
+) AS b(species, name, min_kg, max_kg) ON b.species = s.name
+ON CONFLICT (species_id, name) DO NOTHING;
+
+INSERT INTO breed_aliases (breed_id, alias)
+SELECT b.id, a.alias FROM breeds b JOIN (VALUES
+    ('Labrador Retriever', 'labrador'), ('Labrador Retriever', 'lab'),
+    ('German Shepherd', 'alsatian'), ('German Shepherd', 'gsd'),
+    ('Mixed', 'mixed breed'), ('Mixed', 'mutt'),
+    ('Domestic Shorthair', 'dsh')
+) AS a(breed, alias) ON a.breed = b.name
+ON CONFLICT DO NOTHING;
+
+-- OWNER PORTAL
+-- Staff accounts have no owner_id; owner accounts are linked to one owner record
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'staff' CHECK (role IN ('staff', 'owner'));
+ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES owners(id) ON DELETE CASCADE;
+
+-- token_hash is the SHA-256 of the link token; the token itself is never stored
+CREATE TABLE IF NOT EXISTS owner_invitations (
+    id SERIAL PRIMARY KEY,
+    owner_id INT NOT NULL REFERENCES owners(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_owner_invitations_owner_id ON owner_invitations(owner_id);
+
+-- EMAIL VERIFICATION AND PASSWORD RESET
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
+
+-- Single-use tokens mailed to users; only the SHA-256 of each token is stored
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL CHECK (purpose IN ('verify_email', 'reset_password')),
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens(user_id, purpose);
+
+-- LOGIN LOCKOUT
+-- Admins manage accounts; promote the first one with
+--   UPDATE users SET role = 'admin' WHERE email = '...';
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'staff', 'owner'));
+
+-- key is 'account:<email>' or 'ip:<address>'
+CREATE TABLE IF NOT EXISTS login_failures (
+    key VARCHAR(300) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+-- TWO-FACTOR AUTHENTICATION
+-- totp_secret is set when enrollment starts; totp_enabled once a code is confirmed.
+-- totp_last_counter is the last time step used, so a code cannot be replayed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NOT NULL DEFAULT 0;
+
+-- code_hash is the SHA-256 of the recovery code without dashes
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS mfa_policy (
+    role VARCHAR(20) PRIMARY KEY CHECK (role IN ('admin', 'staff', 'owner')),
+    required BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- SINGLE SIGN-ON
+-- Accounts signed in through OpenID Connect are keyed by the provider's
+-- issuer and subject; accounts created that way have no usable password.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer VARCHAR(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject);
+
+-- Pending sign-ins; state_hash is the SHA-256 of the state sent to the provider
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- API KEYS
+-- Keys look like pck_<prefix>_<secret>; secret_hash is the SHA-256 of the
+-- secret part. Scopes are "<area>:read" or "<area>:write".
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL UNIQUE,
+    secret_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- USER MANAGEMENT
+-- Deactivated accounts keep their data but cannot sign in
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP WITH TIME ZONE;
+
+-- CLINICS
+-- Each clinic of the group is a tenant: owners, pets, vets and visits belong
+-- to one, and staff, admins and API keys only see their own clinic's records.
+-- Services, species, breeds and lab reference ranges stay shared and only
+-- super-admins change them; stock moves into clinics further down.
+-- Existing records are moved into clinic 1.
+CREATE TABLE IF NOT EXISTS clinics (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO clinics(id, name) VALUES (1, 'Main clinic') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('clinics', 'id'), (SELECT MAX(id) FROM clinics));
+
+ALTER TABLE owners ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE owners ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE pets ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE pets ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE vets ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE vets ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE visits ALTER COLUMN clinic_id DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS idx_owners_clinic ON owners(clinic_id);
+CREATE INDEX IF NOT EXISTS idx_pets_clinic ON pets(clinic_id);
+CREATE INDEX IF NOT EXISTS idx_vets_clinic ON vets(clinic_id);
+CREATE INDEX IF NOT EXISTS idx_visits_clinic ON visits(clinic_id);
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE api_keys ALTER COLUMN clinic_id DROP DEFAULT;
+
+-- Super-admins manage every clinic and are the only accounts without one.
+-- Promote one by hand:
+--   UPDATE users SET role = 'superadmin', clinic_id = NULL WHERE email = '...';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS clinic_id INT REFERENCES clinics(id);
+UPDATE users SET clinic_id = 1 WHERE clinic_id IS NULL AND role <> 'superadmin';
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('superadmin', 'admin', 'staff', 'owner'));
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_clinic_check;
+ALTER TABLE users ADD CONSTRAINT users_clinic_check CHECK ((role = 'superadmin') = (clinic_id IS NULL));
+
+-- Optimistic concurrency: every change to these rows increments version,
+-- which clients echo back in If-Match.
+ALTER TABLE owners ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE pets ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE vets ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+
+-- Responses to create requests sent with an Idempotency-Key, replayed when
+-- the request is retried with the headers that describe them (see
+-- replayedHeaders in idempotency.go). status is NULL while the first request
+-- runs.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(100) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status INT,
+    headers JSONB,
+    body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (scope, idempotency_key)
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at);
+
+-- Soft delete: rows with deleted_at set are hidden and purged once past the
+-- retention period; see PurgeDeleted in data/softdelete.go.
+ALTER TABLE owners ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE pets ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE vets ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE visits ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS idx_owners_deleted ON owners(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_pets_deleted ON pets(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_vets_deleted ON vets(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_visits_deleted ON visits(deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Audit trail: one row per create, update, delete, restore and purge of a
+-- record, account or catalog entry (see auditEntities in data/audit.go),
+-- written in the transaction of the change. before and after hold only the
+-- columns that changed. actor_id and api_key_id are
+-- not foreign keys so that history outlives the accounts.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id SERIAL PRIMARY KEY,
+    actor_id INT,
+    api_key_id INT,
+    action VARCHAR(20) NOT NULL,
+    entity_type VARCHAR(20) NOT NULL,
+    entity_id INT NOT NULL,
+    clinic_id INT NOT NULL REFERENCES clinics(id),
+    before JSONB,
+    after JSONB,
+    request_id VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_entity ON audit_events(entity_type, entity_id);
+
+-- Self-registered accounts are 'pending' and reach nothing but their own
+-- profile until an admin gives them a role.
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'pending';
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('superadmin', 'admin', 'staff', 'owner', 'pending'));
+
+-- Stock belongs to a clinic: each keeps its own locations, items (SKUs are
+-- unique per clinic) and batches.
+ALTER TABLE stock_locations ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE stock_locations ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE stock_items ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE stock_items ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE stock_batches ADD COLUMN IF NOT EXISTS clinic_id INT NOT NULL DEFAULT 1 REFERENCES clinics(id);
+ALTER TABLE stock_batches ALTER COLUMN clinic_id DROP DEFAULT;
+ALTER TABLE stock_locations DROP CONSTRAINT IF EXISTS stock_locations_name_key;
+ALTER TABLE stock_items DROP CONSTRAINT IF EXISTS stock_items_sku_key;
+ALTER TABLE stock_items DROP CONSTRAINT IF EXISTS stock_items_service_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_locations_clinic_name ON stock_locations(clinic_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_items_clinic_sku ON stock_items(clinic_id, sku);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_items_clinic_service ON stock_items(clinic_id, service_id);
+CREATE INDEX IF NOT EXISTS idx_stock_batches_clinic ON stock_batches(clinic_id);
+
+INSERT INTO stock_locations (name, clinic_id) VALUES ('Main pharmacy', 1) ON CONFLICT (clinic_id, name) DO NOTHING;
+
+-- Changes to super-admin accounts, which belong to no clinic, are audited
+-- with no clinic either
+ALTER TABLE audit_events ALTER COLUMN clinic_id DROP NOT NULL;
+
+-- The MFA policy is keyed by role; the id gives its rows an entity id in the
+-- audit trail. Changes to what the clinics share (catalogs, clinics, the MFA
+-- policy) are audited with no clinic.
+ALTER TABLE mfa_policy ADD COLUMN IF NOT EXISTS id SERIAL UNIQUE;
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -16,39 +17,50 @@ import (
 
 func GetOwners(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Fetching all owners")
-	rows, err := data.ListOwners(DB)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rows, err := data.ListOwners(DB, tenantOf(r), withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to fetch owners: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		dataError(w, r, err, "owner")
 		return
 	}
 	owners := []Owner{}
 	for _, ro := range rows {
-		owners = append(owners, Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address})
+		owners = append(owners, Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address, ClinicID: ro.ClinicID, Version: ro.Version, DeletedAt: ro.DeletedAt})
 	}
 	logger.DebugCtx(r.Context(), "Retrieved %d owners", len(owners))
 	json.NewEncoder(w).Encode(owners)
 }
 
 func GetOwnerByID(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Fetching owner with ID: %d", id)
-	ro, err := data.GetOwnerByID(DB, id)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	ro, err := data.GetOwnerByID(DB, tenantOf(r), id, withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to fetch owner with ID %d: %v", id, err)
-		http.Error(w, "owner not found", http.StatusNotFound)
+		dataError(w, r, err, "owner")
 		return
 	}
 
-	o := Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address}
+	o := Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address, ClinicID: ro.ClinicID, Version: ro.Version, DeletedAt: ro.DeletedAt}
 	logger.DebugCtx(r.Context(), "Successfully retrieved owner: %+v", o)
+	if notModified(w, r, o.Version) {
+		return
+	}
 	json.NewEncoder(w).Encode(o)
 }
 
@@ -57,20 +69,27 @@ func CreateOwner(w http.ResponseWriter, r *http.Request) {
 	var o Owner
 	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if !checkBody(w, r, &o) {
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Processing owner data: %+v", o)
-	id, err := data.CreateOwner(DB, data.OwnerInput{
+	id, err := data.CreateOwner(DB, tenantOf(r), actorOf(r), data.OwnerInput{
 		Name:    o.Name,
 		Phone:   o.Phone,
 		Address: o.Address,
 	})
 
 	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
 		logger.ErrorCtx(r.Context(), "Failed to create owner: %v", err)
-		http.Error(w, "failed to create owner", http.StatusInternalServerError)
+		dataError(w, r, err, "owner")
 		return
 	}
 
@@ -88,19 +107,22 @@ func UpdateOwner(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Updating owner")
 	
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid owner ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Get existing owner
-	_, err = data.GetOwnerByID(DB, id)
+	cur, err := data.GetOwnerByID(DB, tenantOf(r), id, false)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Owner not found with ID %d: %v", id, err)
-		http.Error(w, "owner not found", http.StatusNotFound)
+		dataError(w, r, err, "owner")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
@@ -108,12 +130,16 @@ func UpdateOwner(w http.ResponseWriter, r *http.Request) {
 	var o Owner
 	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if !checkBody(w, r, &o) {
 		return
 	}
 
 	// Update owner in database
-	err = data.UpdateOwner(DB, id, data.OwnerInput{
+	err = data.UpdateOwner(DB, tenantOf(r), actorOf(r), id, cur.Version, data.OwnerInput{
 		Name:    o.Name,
 		Phone:   o.Phone,
 		Address: o.Address,
@@ -121,11 +147,12 @@ func UpdateOwner(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to update owner with ID %d: %v", id, err)
-		http.Error(w, "failed to update owner", http.StatusInternalServerError)
+		dataError(w, r, err, "owner")
 		return
 	}
 
 	logger.InfoCtx(r.Context(), "Successfully updated owner with ID: %d", id)
+	setETag(w, cur.Version+1)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"id":      id,
@@ -133,32 +160,84 @@ func UpdateOwner(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// PatchOwner changes only the fields present in a JSON Merge Patch or JSON
+// Patch body; the merged owner is validated like a full update
+func PatchOwner(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid owner ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	ro, err := data.GetOwnerByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Owner not found with ID %d: %v", id, err)
+		dataError(w, r, err, "owner")
+		return
+	}
+
+	if !checkIfMatch(w, r, ro.Version) {
+		return
+	}
+
+	cur := Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address, ClinicID: ro.ClinicID, Version: ro.Version, DeletedAt: ro.DeletedAt}
+	var o Owner
+	fields, ok := patchBody(w, r, cur, &o)
+	if !ok {
+		return
+	}
+	o.ID, o.ClinicID, o.Version = cur.ID, cur.ClinicID, cur.Version
+	if !checkBody(w, r, &o) {
+		return
+	}
+
+	o.Version, err = data.PatchOwner(DB, tenantOf(r), actorOf(r), id, cur.Version, data.OwnerInput{
+		Name:    o.Name,
+		Phone:   o.Phone,
+		Address: o.Address,
+	}, fields)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to patch owner with ID %d: %v", id, err)
+		dataError(w, r, err, "owner")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Patched owner %d: %v", id, fields)
+	setETag(w, o.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
 // DeleteOwner deletes an owner by ID
 func DeleteOwner(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Deleting owner")
 	
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid owner ID format for deletion: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Check if owner exists
-	_, err = data.GetOwnerByID(DB, id)
+	cur, err := data.GetOwnerByID(DB, tenantOf(r), id, false)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Owner not found for deletion with ID %d: %v", id, err)
-		http.Error(w, "owner not found", http.StatusNotFound)
+		dataError(w, r, err, "owner")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
 	// Delete owner
-	err = data.DeleteOwner(DB, id)
+	err = data.DeleteOwner(DB, tenantOf(r), actorOf(r), id, cur.Version)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to delete owner with ID %d: %v", id, err)
-		http.Error(w, "failed to delete owner", http.StatusInternalServerError)
+		dataError(w, r, err, "owner")
 		return
 	}
 
@@ -167,47 +246,60 @@ func DeleteOwner(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// GetOwnerPets lists the pets of one owner
+func GetOwnerPets(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid owner ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetOwnerByID(DB, tenantOf(r), id, false); err != nil {
+		dataError(w, r, err, "owner")
+		return
+	}
+	rows, err := data.ListPetsByOwner(DB, tenantOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch pets for owner %d: %v", id, err)
+		dataError(w, r, err, "pet")
+		return
+	}
+	pets := make([]Pet, len(rows))
+	for i, rp := range rows {
+		pets[i] = petFromRow(rp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pets)
+}
+
 func UploadFile(w http.ResponseWriter, r *http.Request) {
     logger.InfoCtx(r.Context(), "Uploading file")
     if err := r.ParseMultipartForm(32 << 20); err != nil {
         logger.WarnCtx(r.Context(), "Failed to parse multipart form: %v", err)
-        http.Error(w, "invalid multipart form", http.StatusBadRequest)
+        writeError(w, r, "invalid multipart form", http.StatusBadRequest)
         return
     }
 
     file, header, err := r.FormFile("file")
     if err != nil {
         logger.WarnCtx(r.Context(), "Missing file in form: %v", err)
-        http.Error(w, "missing file", http.StatusBadRequest)
+        writeError(w, r, "missing file", http.StatusBadRequest)
         return
     }
     defer file.Close()
 
     filename := filepath.Base(header.Filename)
     if filename == "" {
-        http.Error(w, "invalid filename", http.StatusBadRequest)
-        return
-    }
-
-    if err := os.MkdirAll("uploads", 0755); err != nil {
-        logger.ErrorCtx(r.Context(), "Failed to ensure uploads directory: %v", err)
-        http.Error(w, "internal error", http.StatusInternalServerError)
+        writeError(w, r, "invalid filename", http.StatusBadRequest)
         return
     }
 
-    dstPath := filepath.Join("uploads", filename)
-    dst, err := os.Create(dstPath)
+    n, err := saveUpload(tenantOf(r), filename, file)
     if err != nil {
-        logger.ErrorCtx(r.Context(), "Failed to create destination file: %v", err)
-        http.Error(w, "failed to save file", http.StatusInternalServerError)
-        return
-    }
-    defer dst.Close()
-
-    n, err := io.Copy(dst, file)
-    if err != nil {
-        logger.ErrorCtx(r.Context(), "Failed to write file: %v", err)
-        http.Error(w, "failed to save file", http.StatusInternalServerError)
+        logger.ErrorCtx(r.Context(), "Failed to save file: %v", err)
+        writeError(w, r, "failed to save file", http.StatusInternalServerError)
         return
     }
 
@@ -221,24 +313,52 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
     })
 }
 
+// uploadDir is where the files of a clinic are kept; super-admins without a
+// clinic use the top-level uploads directory
+func uploadDir(t data.Tenant) string {
+    if t == data.AllClinics {
+        return "uploads"
+    }
+    return filepath.Join("uploads", fmt.Sprintf("clinic-%d", t))
+}
+
+// saveUpload writes src into the clinic's uploads directory under filename,
+// which must already be a bare file name
+func saveUpload(t data.Tenant, filename string, src io.Reader) (int64, error) {
+    dir := uploadDir(t)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return 0, err
+    }
+
+    dst, err := os.Create(filepath.Join(dir, filename))
+    if err != nil {
+        return 0, err
+    }
+    n, err := io.Copy(dst, src)
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    return n, err
+}
+
 func DownloadFile(w http.ResponseWriter, r *http.Request) {
     name := r.URL.Query().Get("name")
     if name == "" {
-        http.Error(w, "missing name parameter", http.StatusBadRequest)
+        writeError(w, r, "missing name parameter", http.StatusBadRequest)
         return
     }
 
     filename := filepath.Base(name)
-    path := filepath.Join("uploads", filename)
+    path := filepath.Join(uploadDir(tenantOf(r)), filename)
 
     if _, err := os.Stat(path); err != nil {
         if os.IsNotExist(err) {
             logger.WarnCtx(r.Context(), "File not found: %s", filename)
-            http.Error(w, "file not found", http.StatusNotFound)
+            writeError(w, r, "file not found", http.StatusNotFound)
             return
         }
         logger.ErrorCtx(r.Context(), "Failed to access file: %v", err)
-        http.Error(w, "internal error", http.StatusInternalServerError)
+        writeError(w, r, "internal error", http.StatusInternalServerError)
         return
     }
 
@@ -253,19 +373,22 @@ func UpdatePet(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Updating pet")
 	
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid pet ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Get existing pet
-	_, err = data.GetPetByID(DB, id)
+	cur, err := data.GetPetByID(DB, tenantOf(r), id, false)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Pet not found with ID %d: %v", id, err)
-		http.Error(w, "pet not found", http.StatusNotFound)
+		dataError(w, r, err, "pet")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
@@ -273,26 +396,29 @@ func UpdatePet(w http.ResponseWriter, r *http.Request) {
 	var p Pet
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	in, ok := checkPet(w, r, &p)
+	if !ok {
 		return
 	}
 
 	// Update pet in database
-	err = data.UpdatePet(DB, id, data.PetInput{
-		Name:    p.Name,
-		Species: p.Species,
-		Breed:   p.Breed,
-		Birth:   p.Birth,
-		OwnerID: p.OwnerID,
-	})
+	err = data.UpdatePet(DB, tenantOf(r), actorOf(r), id, cur.Version, in)
 
 	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
 		logger.ErrorCtx(r.Context(), "Failed to update pet with ID %d: %v", id, err)
-		http.Error(w, "failed to update pet", http.StatusInternalServerError)
+		dataError(w, r, err, "pet")
 		return
 	}
 
 	logger.InfoCtx(r.Context(), "Successfully updated pet with ID: %d", id)
+	setETag(w, cur.Version+1)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"id":      id,
@@ -300,32 +426,80 @@ func UpdatePet(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// PatchPet changes only the fields present in a JSON Merge Patch or JSON
+// Patch body; the merged pet is validated like a full update
+func PatchPet(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid pet ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rp, err := data.GetPetByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Pet not found with ID %d: %v", id, err)
+		dataError(w, r, err, "pet")
+		return
+	}
+
+	if !checkIfMatch(w, r, rp.Version) {
+		return
+	}
+
+	cur := petFromRow(rp)
+	var p Pet
+	fields, ok := patchBody(w, r, cur, &p)
+	if !ok {
+		return
+	}
+	p.ID, p.ClinicID, p.Version = cur.ID, cur.ClinicID, cur.Version
+	in, ok := checkPet(w, r, &p)
+	if !ok {
+		return
+	}
+
+	if p.Version, err = data.PatchPet(DB, tenantOf(r), actorOf(r), id, cur.Version, in, fields); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to patch pet with ID %d: %v", id, err)
+		dataError(w, r, err, "pet")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Patched pet %d: %v", id, fields)
+	setETag(w, p.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
 // DeletePet deletes a pet by ID
 func DeletePet(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Deleting pet")
 	
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid pet ID format for deletion: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Check if pet exists
-	_, err = data.GetPetByID(DB, id)
+	cur, err := data.GetPetByID(DB, tenantOf(r), id, false)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Pet not found for deletion with ID %d: %v", id, err)
-		http.Error(w, "pet not found", http.StatusNotFound)
+		dataError(w, r, err, "pet")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
 	// Delete pet
-	err = data.DeletePet(DB, id)
+	err = data.DeletePet(DB, tenantOf(r), actorOf(r), id, cur.Version)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to delete pet with ID %d: %v", id, err)
-		http.Error(w, "failed to delete pet", http.StatusInternalServerError)
+		dataError(w, r, err, "pet")
 		return
 	}
 
@@ -338,39 +512,50 @@ func DeletePet(w http.ResponseWriter, r *http.Request) {
 
 func GetPets(w http.ResponseWriter, r *http.Request) {
 	logger.DebugCtx(r.Context(), "Fetching all pets")
-	rows, err := data.ListPets(DB)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rows, err := data.ListPets(DB, tenantOf(r), withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to fetch pets: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		dataError(w, r, err, "pet")
 		return
 	}
 	pets := []Pet{}
 	for _, rp := range rows {
-		pets = append(pets, Pet{ID: rp.ID, Name: rp.Name, Species: rp.Species, Breed: rp.Breed, Birth: rp.Birth, OwnerID: rp.OwnerID})
+		pets = append(pets, petFromRow(rp))
 	}
 	logger.DebugCtx(r.Context(), "Retrieved %d pets", len(pets))
 	json.NewEncoder(w).Encode(pets)
 }
 
 func GetPetByID(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid pet ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Fetching pet with ID: %d", id)
-	rp, err := data.GetPetByID(DB, id)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rp, err := data.GetPetByID(DB, tenantOf(r), id, withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Pet not found with ID %d: %v", id, err)
-		http.Error(w, "pet not found", http.StatusNotFound)
+		dataError(w, r, err, "pet")
 		return
 	}
 
-	p := Pet{ID: rp.ID, Name: rp.Name, Species: rp.Species, Breed: rp.Breed, Birth: rp.Birth, OwnerID: rp.OwnerID}
+	p := petFromRow(rp)
 	logger.DebugCtx(r.Context(), "Successfully retrieved pet: %+v", p)
+	if notModified(w, r, p.Version) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(p)
 }
@@ -380,22 +565,24 @@ func CreatePet(w http.ResponseWriter, r *http.Request) {
 	var p Pet
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Processing pet data: %+v", p)
-	id, err := data.CreatePet(DB, data.PetInput{
-		Name:    p.Name,
-		Species: p.Species,
-		Breed:   p.Breed,
-		Birth:   p.Birth,
-		OwnerID: p.OwnerID,
-	})
+	in, ok := checkPet(w, r, &p)
+	if !ok {
+		return
+	}
+
+	id, err := data.CreatePet(DB, tenantOf(r), actorOf(r), in)
 
 	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
 		logger.ErrorCtx(r.Context(), "Failed to create pet: %v", err)
-		http.Error(w, "failed to create pet", http.StatusInternalServerError)
+		dataError(w, r, err, "pet")
 		return
 	}
 
@@ -406,14 +593,51 @@ func CreatePet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(p)
 }
 
+// GetPetVisits lists the visits of one pet, newest first
+func GetPetVisits(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid pet ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetPetByID(DB, tenantOf(r), id, false); err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, "pet not found", http.StatusNotFound)
+		} else {
+			logger.ErrorCtx(r.Context(), "Error fetching pet with ID %d: %v", id, err)
+			dataError(w, r, err, "pet")
+		}
+		return
+	}
+	rows, err := data.ListVisitsByPet(DB, tenantOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch visits for pet %d: %v", id, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	visits := make([]Visit, len(rows))
+	for i, rv := range rows {
+		visits[i] = Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID, Version: rv.Version, DeletedAt: rv.DeletedAt}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visits)
+}
+
 // -------------------- Vets --------------------
 
 func GetVets(w http.ResponseWriter, r *http.Request) {
 	logger.InfoCtx(r.Context(), "Fetching all vets")
-	rows, err := data.ListVets(DB)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rows, err := data.ListVets(DB, tenantOf(r), withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to fetch vets: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		dataError(w, r, err, "vet")
 		return
 	}
 
@@ -423,6 +647,9 @@ func GetVets(w http.ResponseWriter, r *http.Request) {
 			ID:            rv.ID,
 			Name:          rv.Name,
 			Specialization: rv.Specialization,
+			ClinicID:      rv.ClinicID,
+			Version:       rv.Version,
+			DeletedAt:     rv.DeletedAt,
 		}
 	}
 
@@ -432,23 +659,27 @@ func GetVets(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetVetByID(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid vet ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Fetching vet with ID: %d", id)
-	v, err := data.GetVetByID(DB, id)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	v, err := data.GetVetByID(DB, tenantOf(r), id, withDeleted)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, data.ErrNotFound) {
 			logger.WarnCtx(r.Context(), "Vet not found with ID %d", id)
-			http.Error(w, "vet not found", http.StatusNotFound)
+			writeError(w, r, "vet not found", http.StatusNotFound)
 		} else {
 			logger.ErrorCtx(r.Context(), "Error fetching vet with ID %d: %v", id, err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			dataError(w, r, err, "vet")
 		}
 		return
 	}
@@ -457,9 +688,15 @@ func GetVetByID(w http.ResponseWriter, r *http.Request) {
 		ID:            v.ID,
 		Name:          v.Name,
 		Specialization: v.Specialization,
+		ClinicID:      v.ClinicID,
+		Version:       v.Version,
+		DeletedAt:     v.DeletedAt,
 	}
 
 	logger.DebugCtx(r.Context(), "Successfully retrieved vet: %+v", vet)
+	if notModified(w, r, vet.Version) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(vet)
 }
@@ -469,25 +706,26 @@ func CreateVet(w http.ResponseWriter, r *http.Request) {
 	var v Vet
 	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
 		return
 	}
 
-	if v.Name == "" {
-		logger.WarnCtx(r.Context(), "Vet name is required")
-		http.Error(w, "name is required", http.StatusBadRequest)
+	if !checkBody(w, r, &v) {
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Processing vet data: %+v", v)
-	id, err := data.CreateVet(DB, data.VetInput{
+	id, err := data.CreateVet(DB, tenantOf(r), actorOf(r), data.VetInput{
 		Name:          v.Name,
 		Specialization: v.Specialization,
 	})
 
 	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
 		logger.ErrorCtx(r.Context(), "Failed to create vet: %v", err)
-		http.Error(w, "failed to create vet", http.StatusInternalServerError)
+		dataError(w, r, err, "vet")
 		return
 	}
 
@@ -499,92 +737,148 @@ func CreateVet(w http.ResponseWriter, r *http.Request) {
 }
 
 func UpdateVet(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid vet ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Check if vet exists
-	_, err = data.GetVetByID(DB, id)
+	cur, err := data.GetVetByID(DB, tenantOf(r), id, false)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, data.ErrNotFound) {
 			logger.WarnCtx(r.Context(), "Vet not found with ID %d", id)
-			http.Error(w, "vet not found", http.StatusNotFound)
+			writeError(w, r, "vet not found", http.StatusNotFound)
 		} else {
 			logger.ErrorCtx(r.Context(), "Error fetching vet with ID %d: %v", id, err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			dataError(w, r, err, "vet")
 		}
 		return
 	}
+	if !checkIfMatch(w, r, cur.Version) {
+		return
+	}
 
 	var v Vet
 	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
 		return
 	}
 
-	if v.Name == "" {
-		logger.WarnCtx(r.Context(), "Vet name is required")
-		http.Error(w, "name is required", http.StatusBadRequest)
+	if !checkBody(w, r, &v) {
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Updating vet ID %d with data: %+v", id, v)
-	err = data.UpdateVet(DB, id, data.VetInput{
+	err = data.UpdateVet(DB, tenantOf(r), actorOf(r), id, cur.Version, data.VetInput{
 		Name:          v.Name,
 		Specialization: v.Specialization,
 	})
 
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to update vet ID %d: %v", id, err)
-		http.Error(w, "failed to update vet", http.StatusInternalServerError)
+		dataError(w, r, err, "vet")
 		return
 	}
 
 	// Fetch updated vet to return
-	updatedVet, _ := data.GetVetByID(DB, id)
+	updatedVet, _ := data.GetVetByID(DB, tenantOf(r), id, false)
 	vet := Vet{
 		ID:            updatedVet.ID,
 		Name:          updatedVet.Name,
 		Specialization: updatedVet.Specialization,
+		ClinicID:      updatedVet.ClinicID,
+		Version:       updatedVet.Version,
+		DeletedAt:     updatedVet.DeletedAt,
 	}
+	setETag(w, vet.Version)
 
 	logger.InfoCtx(r.Context(), "Successfully updated vet ID: %d", id)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(vet)
 }
 
+// PatchVet changes only the fields present in a JSON Merge Patch or JSON
+// Patch body; the merged vet is validated like a full update
+func PatchVet(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid vet ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rv, err := data.GetVetByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Vet not found with ID %d: %v", id, err)
+		dataError(w, r, err, "vet")
+		return
+	}
+
+	if !checkIfMatch(w, r, rv.Version) {
+		return
+	}
+
+	cur := Vet{ID: rv.ID, Name: rv.Name, Specialization: rv.Specialization, ClinicID: rv.ClinicID, Version: rv.Version, DeletedAt: rv.DeletedAt}
+	var v Vet
+	fields, ok := patchBody(w, r, cur, &v)
+	if !ok {
+		return
+	}
+	v.ID, v.ClinicID, v.Version = cur.ID, cur.ClinicID, cur.Version
+	if !checkBody(w, r, &v) {
+		return
+	}
+
+	v.Version, err = data.PatchVet(DB, tenantOf(r), actorOf(r), id, cur.Version, data.VetInput{
+		Name:           v.Name,
+		Specialization: v.Specialization,
+	}, fields)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to patch vet ID %d: %v", id, err)
+		dataError(w, r, err, "vet")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Patched vet %d: %v", id, fields)
+	setETag(w, v.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func DeleteVet(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid vet ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Check if vet exists
-	_, err = data.GetVetByID(DB, id)
+	cur, err := data.GetVetByID(DB, tenantOf(r), id, false)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, data.ErrNotFound) {
 			logger.WarnCtx(r.Context(), "Vet not found with ID %d", id)
-			http.Error(w, "vet not found", http.StatusNotFound)
+			writeError(w, r, "vet not found", http.StatusNotFound)
 		} else {
 			logger.ErrorCtx(r.Context(), "Error fetching vet with ID %d: %v", id, err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			dataError(w, r, err, "vet")
 		}
 		return
 	}
+	if !checkIfMatch(w, r, cur.Version) {
+		return
+	}
 
 	logger.InfoCtx(r.Context(), "Deleting vet with ID: %d", id)
-	err = data.DeleteVet(DB, id)
+	err = data.DeleteVet(DB, tenantOf(r), actorOf(r), id, cur.Version)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to delete vet ID %d: %v", id, err)
-		http.Error(w, "failed to delete vet", http.StatusInternalServerError)
+		dataError(w, r, err, "vet")
 		return
 	}
 
@@ -596,15 +890,19 @@ func DeleteVet(w http.ResponseWriter, r *http.Request) {
 
 func GetVisits(w http.ResponseWriter, r *http.Request) {
 	logger.DebugCtx(r.Context(), "Fetching all visits")
-	rows, err := data.ListVisits(DB)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rows, err := data.ListVisits(DB, tenantOf(r), withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Failed to fetch visits: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		dataError(w, r, err, "visit")
 		return
 	}
 	visits := []Visit{}
 	for _, rv := range rows {
-		visits = append(visits, Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc})
+		visits = append(visits, Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID, Version: rv.Version, DeletedAt: rv.DeletedAt})
 	}
 	logger.DebugCtx(r.Context(), "Retrieved %d visits", len(visits))
 	w.Header().Set("Content-Type", "application/json")
@@ -612,24 +910,31 @@ func GetVisits(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetVisitByID(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		logger.WarnCtx(r.Context(), "Invalid visit ID format: %s", idStr)
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Fetching visit with ID: %d", id)
-	rv, err := data.GetVisitByID(DB, id)
+	withDeleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	rv, err := data.GetVisitByID(DB, tenantOf(r), id, withDeleted)
 	if err != nil {
 		logger.ErrorCtx(r.Context(), "Visit not found with ID %d: %v", id, err)
-		http.Error(w, "visit not found", http.StatusNotFound)
+		dataError(w, r, err, "visit")
 		return
 	}
 
-	v := Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc}
+	v := Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID, Version: rv.Version, DeletedAt: rv.DeletedAt}
 	logger.DebugCtx(r.Context(), "Successfully retrieved visit: %+v", v)
+	if notModified(w, r, v.Version) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(v)
 }
@@ -639,12 +944,16 @@ func CreateVisit(w http.ResponseWriter, r *http.Request) {
 	var v Visit
 	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
 		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if !checkBody(w, r, &v) {
 		return
 	}
 
 	logger.DebugCtx(r.Context(), "Processing visit data: %+v", v)
-	id, err := data.CreateVisit(DB, data.VisitInput{
+	id, err := data.CreateVisit(DB, tenantOf(r), actorOf(r), data.VisitInput{
 		PetID: v.PetID,
 		VetID: v.VetID,
 		Visit: v.Visit,
@@ -652,8 +961,11 @@ func CreateVisit(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
 		logger.ErrorCtx(r.Context(), "Failed to create visit: %v", err)
-		http.Error(w, "failed to create visit", http.StatusInternalServerError)
+		dataError(w, r, err, "visit")
 		return
 	}
 
@@ -667,29 +979,36 @@ func CreateVisit(w http.ResponseWriter, r *http.Request) {
 // UpdateVisit updates an existing visit
 func UpdateVisit(w http.ResponseWriter, r *http.Request) {
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Get existing visit
-	_, err = data.GetVisitByID(DB, id)
+	cur, err := data.GetVisitByID(DB, tenantOf(r), id, false)
 	if err != nil {
-		http.Error(w, "visit not found", http.StatusNotFound)
+		dataError(w, r, err, "visit")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
 	// Decode request body
 	var v Visit
 	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if !checkBody(w, r, &v) {
 		return
 	}
 
 	// Update visit in database
-	err = data.UpdateVisit(DB, id, data.VisitInput{
+	err = data.UpdateVisit(DB, tenantOf(r), actorOf(r), id, cur.Version, data.VisitInput{
 		PetID: v.PetID,
 		VetID: v.VetID,
 		Visit: v.Visit,
@@ -697,19 +1016,73 @@ func UpdateVisit(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		http.Error(w, "failed to update visit", http.StatusInternalServerError)
+		if tenantError(w, r, err) {
+			return
+		}
+		dataError(w, r, err, "visit")
 		return
 	}
 
 	// Return updated visit
-	updatedVisit, _ := data.GetVisitByID(DB, id)
+	updatedVisit, _ := data.GetVisitByID(DB, tenantOf(r), id, false)
 	v = Visit{
 		ID:    updatedVisit.ID,
 		PetID: updatedVisit.PetID,
 		VetID: updatedVisit.VetID,
 		Visit: updatedVisit.Visit,
 		Desc:  updatedVisit.Desc,
+		ClinicID: updatedVisit.ClinicID,
+		Version:  updatedVisit.Version,
+		DeletedAt: updatedVisit.DeletedAt,
+	}
+	setETag(w, v.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// PatchVisit changes only the fields present in a JSON Merge Patch or JSON
+// Patch body; the merged visit is validated like a full update
+func PatchVisit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rv, err := data.GetVisitByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		dataError(w, r, err, "visit")
+		return
+	}
+
+	if !checkIfMatch(w, r, rv.Version) {
+		return
+	}
+
+	cur := Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID, Version: rv.Version, DeletedAt: rv.DeletedAt}
+	var v Visit
+	fields, ok := patchBody(w, r, cur, &v)
+	if !ok {
+		return
+	}
+	v.ID, v.ClinicID, v.Version = cur.ID, cur.ClinicID, cur.Version
+	if !checkBody(w, r, &v) {
+		return
+	}
+
+	v.Version, err = data.PatchVisit(DB, tenantOf(r), actorOf(r), id, cur.Version, data.VisitInput{
+		PetID: v.PetID,
+		VetID: v.VetID,
+		Visit: v.Visit,
+		Desc:  v.Desc,
+	}, fields)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to patch visit with ID %d: %v", id, err)
+		dataError(w, r, err, "visit")
+		return
 	}
+
+	logger.InfoCtx(r.Context(), "Patched visit %d: %v", id, fields)
+	setETag(w, v.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(v)
 }
@@ -717,24 +1090,27 @@ func UpdateVisit(w http.ResponseWriter, r *http.Request) {
 // DeleteVisit deletes a visit by ID
 func DeleteVisit(w http.ResponseWriter, r *http.Request) {
 	// Get ID from URL
-	idStr := r.URL.Query().Get("id")
+	idStr := idParam(r)
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
 		return
 	}
 
 	// Check if visit exists
-	_, err = data.GetVisitByID(DB, id)
+	cur, err := data.GetVisitByID(DB, tenantOf(r), id, false)
 	if err != nil {
-		http.Error(w, "visit not found", http.StatusNotFound)
+		dataError(w, r, err, "visit")
+		return
+	}
+	if !checkIfMatch(w, r, cur.Version) {
 		return
 	}
 
 	// Delete visit
-	err = data.DeleteVisit(DB, id)
+	err = data.DeleteVisit(DB, tenantOf(r), actorOf(r), id, cur.Version)
 	if err != nil {
-		http.Error(w, "failed to delete visit", http.StatusInternalServerError)
+		dataError(w, r, err, "visit")
 		return
 	}
 
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// Create endpoints accept an Idempotency-Key header so that clients can retry
+// a POST that timed out without creating the record twice. The first request
+// with a key is served and its response stored for IDEMPOTENCY_WINDOW_HOURS
+// (24 by default); a retry with the same body gets the stored response back
+// with Idempotent-Replayed: true, and a key reused for a different body is
+// answered with 409.
+
+var idempotencyWindow = 24 * time.Hour
+
+// maxIdempotentBody bounds the request bodies read for fingerprinting
+const maxIdempotentBody = 1 << 20
+
+// replayedHeaders are the response headers stored with a response and sent
+// again when it is replayed; the others are set per request anyway
+var replayedHeaders = []string{"Content-Type", "Location", "ETag", "Last-Modified"}
+
+func initIdempotency() error {
+	v := getenvDefault("IDEMPOTENCY_WINDOW_HOURS", "24")
+	h, err := strconv.Atoi(v)
+	if err != nil || h <= 0 {
+		return fmt.Errorf("IDEMPOTENCY_WINDOW_HOURS %q is not a number of hours", v)
+	}
+	idempotencyWindow = time.Duration(h) * time.Hour
+	go purgeIdempotencyKeys()
+	return nil
+}
+
+func purgeIdempotencyKeys() {
+	for range time.Tick(time.Hour) {
+		n, err := data.PurgeIdempotencyKeys(DB)
+		if err != nil {
+			logger.Error("Failed to purge idempotency keys: %v", err)
+			continue
+		}
+		if n > 0 {
+			logger.Info("Purged %d expired idempotency keys", n)
+		}
+	}
+}
+
+// idempotencyScope keeps the keys of different callers apart, so one
+// client cannot replay another's response
+func idempotencyScope(r *http.Request) string {
+	if id, ok := r.Context().Value(ctxAPIKeyIDKey).(int); ok {
+		return fmt.Sprintf("key:%d", id)
+	}
+	userID, _ := r.Context().Value(logger.CtxUserIDKey).(int)
+	return fmt.Sprintf("user:%d/clinic:%d", userID, tenantOf(r))
+}
+
+// Idempotent serves next at most once per Idempotency-Key. Requests without
+// the header are served as before.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, r, "Idempotency-Key may be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			writeError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s %s\n", r.Method, r.URL.Path)
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		scope := idempotencyScope(r)
+		stored, err := data.ClaimIdempotencyKey(DB, scope, key, fingerprint, idempotencyWindow)
+		switch {
+		case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+			logger.WarnCtx(r.Context(), "Idempotency key %q reused for a different request", key)
+			writeError(w, r, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, data.ErrIdempotencyKeyInProgress):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logger.ErrorCtx(r.Context(), "Failed to claim idempotency key: %v", err)
+			dataError(w, r, err, "idempotency key")
+			return
+		case stored != nil:
+			logger.InfoCtx(r.Context(), "Replaying stored response for idempotency key %q", key)
+			for name, v := range stored.Headers {
+				w.Header().Set(name, v)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w}
+		saved := false
+		defer func() {
+			if !saved {
+				if err := data.ReleaseIdempotencyKey(DB, scope, key); err != nil {
+					logger.ErrorCtx(r.Context(), "Failed to release idempotency key: %v", err)
+				}
+			}
+		}()
+		next(rec, r)
+
+		// Server errors may be transient, so the key is released and a
+		// retry runs the request again
+		if rec.status() >= 500 {
+			return
+		}
+		headers := map[string]string{}
+		for _, name := range replayedHeaders {
+			if v := w.Header().Get(name); v != "" {
+				headers[name] = v
+			}
+		}
+		err = data.SaveIdempotentResponse(DB, scope, key, data.StoredResponse{
+			Status:  rec.status(),
+			Headers: headers,
+			Body:    rec.body.Bytes(),
+		})
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to store response for idempotency key: %v", err)
+			return
+		}
+		saved = true
+	}
+}
+
+// recordingWriter passes a response through while keeping its status and
+// body
+type recordingWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.code == 0 {
+		rw.code = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) status() int {
+	if rw.code == 0 {
+		return http.StatusOK
+	}
+	return rw.code
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+type stockItemRequest struct {
+	SKU              string `json:"sku"`
+	Name             string `json:"name"`
+	Unit             string `json:"unit"`
+	ReorderThreshold int    `json:"reorder_threshold"`
+	ServiceID        int    `json:"service_id"`
+}
+
+type receiveStockRequest struct {
+	ItemID     int    `json:"item_id"`
+	LocationID int    `json:"location_id"`
+	BatchNo    string `json:"batch_no"`
+	ExpiresOn  string `json:"expires_on"`
+	Quantity   int    `json:"quantity"`
+}
+
+type adjustStockRequest struct {
+	BatchID int    `json:"batch_id"`
+	Delta   int    `json:"delta"`
+	Note    string `json:"note"`
+}
+
+func stockItemFromRow(it data.StockItemRow) StockItem {
+	return StockItem{
+		ID:               it.ID,
+		SKU:              it.SKU,
+		Name:             it.Name,
+		Unit:             it.Unit,
+		ReorderThreshold: it.ReorderThreshold,
+		ServiceID:        it.ServiceID,
+		ClinicID:         it.ClinicID,
+	}
+}
+
+func stockLevelsFromRows(rows []data.StockLevelRow) []StockLevel {
+	levels := make([]StockLevel, len(rows))
+	for i, l := range rows {
+		levels[i] = StockLevel{LocationID: l.LocationID, Quantity: l.Quantity}
+	}
+	return levels
+}
+
+func stockBatchFromRow(b data.StockBatchRow) StockBatch {
+	return StockBatch{
+		ID:         b.ID,
+		ItemID:     b.ItemID,
+		LocationID: b.LocationID,
+		BatchNo:    b.BatchNo,
+		ExpiresOn:  b.ExpiresOn,
+		Quantity:   b.Quantity,
+		ReceivedAt: b.ReceivedAt,
+		ClinicID:   b.ClinicID,
+	}
+}
+
+// parseWithinDays parses a horizon such as "30d", "2w" or "14" into days
+func parseWithinDays(s string) (int, error) {
+	if s == "" {
+		return 30, nil
+	}
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "d"):
+		s = strings.TrimSuffix(s, "d")
+	case strings.HasSuffix(s, "w"):
+		s, mult = strings.TrimSuffix(s, "w"), 7
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return n * mult, nil
+}
+
+func writeStockError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case tenantError(w, r, err):
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, r, "not found", http.StatusNotFound)
+	case errors.Is(err, data.ErrInsufficientStock):
+		writeError(w, r, err.Error(), http.StatusConflict)
+	default:
+		logger.ErrorCtx(r.Context(), "Failed to %s: %v", action, err)
+		writeError(w, r, "failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+// -------------------- Locations --------------------
+
+func GetStockLocations(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListStockLocations(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch stock locations: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	locations := make([]StockLocation, len(rows))
+	for i, l := range rows {
+		locations[i] = StockLocation{ID: l.ID, Name: l.Name, ClinicID: l.ClinicID}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+func CreateStockLocation(w http.ResponseWriter, r *http.Request) {
+	var l StockLocation
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if l.Name == "" {
+		writeError(w, r, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := data.CreateStockLocation(DB, tenantOf(r), actorOf(r), l.Name)
+	if err != nil {
+		writeStockError(w, r, err, "create location")
+		return
+	}
+	l.ID = id
+	l.ClinicID = int(tenantOf(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// -------------------- Items --------------------
+
+func GetStockItems(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Fetching stock items")
+	rows, err := data.ListStockItems(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch stock items: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	items := make([]StockItem, len(rows))
+	for i, it := range rows {
+		items[i] = stockItemFromRow(it)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// GetStockItemByID returns an item with its usable quantity per location
+func GetStockItemByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid stock item ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	it, err := data.GetStockItemByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeStockError(w, r, err, "fetch stock item")
+		return
+	}
+	levels, err := data.StockLevels(DB, tenantOf(r), id)
+	if err != nil {
+		writeStockError(w, r, err, "fetch stock levels")
+		return
+	}
+
+	item := stockItemFromRow(it)
+	item.Levels = stockLevelsFromRows(levels)
+	total := 0
+	for _, l := range levels {
+		total += l.Quantity
+	}
+	item.Quantity = &total
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+func CreateStockItem(w http.ResponseWriter, r *http.Request) {
+	var req stockItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.SKU == "" || req.Name == "" || req.ReorderThreshold < 0 {
+		writeError(w, r, "sku and name are required and reorder_threshold must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Unit == "" {
+		req.Unit = "unit"
+	}
+
+	id, err := data.CreateStockItem(DB, tenantOf(r), actorOf(r), data.StockItemInput{
+		SKU:              req.SKU,
+		Name:             req.Name,
+		Unit:             req.Unit,
+		ReorderThreshold: req.ReorderThreshold,
+		ServiceID:        req.ServiceID,
+	})
+	if err != nil {
+		writeStockError(w, r, err, "create stock item")
+		return
+	}
+
+	it, err := data.GetStockItemByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeStockError(w, r, err, "fetch stock item")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Successfully created stock item with ID: %d", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(stockItemFromRow(it))
+}
+
+func UpdateStockItem(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid stock item ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if _, err := data.GetStockItemByID(DB, tenantOf(r), id); err != nil {
+		writeStockError(w, r, err, "fetch stock item")
+		return
+	}
+
+	var req stockItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.SKU == "" || req.Name == "" || req.ReorderThreshold < 0 {
+		writeError(w, r, "sku and name are required and reorder_threshold must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Unit == "" {
+		req.Unit = "unit"
+	}
+
+	err = data.UpdateStockItem(DB, tenantOf(r), actorOf(r), id, data.StockItemInput{
+		SKU:              req.SKU,
+		Name:             req.Name,
+		Unit:             req.Unit,
+		ReorderThreshold: req.ReorderThreshold,
+		ServiceID:        req.ServiceID,
+	})
+	if err != nil {
+		writeStockError(w, r, err, "update stock item")
+		return
+	}
+
+	it, err := data.GetStockItemByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeStockError(w, r, err, "fetch stock item")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stockItemFromRow(it))
+}
+
+// -------------------- Movements --------------------
+
+// ReceiveStock books a delivered batch into a location
+func ReceiveStock(w http.ResponseWriter, r *http.Request) {
+	var req receiveStockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.ItemID == 0 || req.LocationID == 0 || req.Quantity <= 0 {
+		writeError(w, r, "item_id, location_id and a positive quantity are required", http.StatusBadRequest)
+		return
+	}
+
+	in := data.StockBatchInput{
+		ItemID:     req.ItemID,
+		LocationID: req.LocationID,
+		BatchNo:    req.BatchNo,
+		Quantity:   req.Quantity,
+	}
+	if req.ExpiresOn != "" {
+		t, err := time.Parse("2006-01-02", req.ExpiresOn)
+		if err != nil {
+			writeError(w, r, "expires_on must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		in.ExpiresOn = &t
+	}
+
+	id, err := data.ReceiveStock(DB, tenantOf(r), actorOf(r), in)
+	if err != nil {
+		writeStockError(w, r, err, "receive stock")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Received %d of item %d into location %d (batch %d)", req.Quantity, req.ItemID, req.LocationID, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      id,
+		"message": "Stock received successfully",
+	})
+}
+
+// AdjustStock applies a manual correction to a batch
+func AdjustStock(w http.ResponseWriter, r *http.Request) {
+	var req adjustStockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.BatchID == 0 || req.Delta == 0 {
+		writeError(w, r, "batch_id and a non-zero delta are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.AdjustStock(DB, tenantOf(r), actorOf(r), req.BatchID, req.Delta, req.Note); err != nil {
+		writeStockError(w, r, err, "adjust stock")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Adjusted batch %d by %d: %s", req.BatchID, req.Delta, req.Note)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// -------------------- Reports --------------------
+
+// GetLowStock reports items at or below their reorder threshold
+func GetLowStock(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.LowStock(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to compute low stock report: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	items := make([]StockItem, len(rows))
+	for i, row := range rows {
+		items[i] = stockItemFromRow(row.Item)
+		q := row.Quantity
+		items[i].Quantity = &q
+		items[i].Levels = stockLevelsFromRows(row.Levels)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// GetExpiringStock reports batches expiring within ?within= (default 30d)
+func GetExpiringStock(w http.ResponseWriter, r *http.Request) {
+	days, err := parseWithinDays(r.URL.Query().Get("within"))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := data.ExpiringBatches(DB, tenantOf(r), days)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to compute expiring stock report: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	batches := make([]StockBatch, len(rows))
+	for i, b := range rows {
+		batches[i] = stockBatchFromRow(b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batches)
+}
+
+// -------------------- Prescriptions --------------------
+
+func GetPrescriptions(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("visit_id")
+	visitID, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid visit ID format: %s", idStr)
+		writeError(w, r, "invalid visit_id", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := data.ListPrescriptionsByVisit(DB, tenantOf(r), visitID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch prescriptions for visit %d: %v", visitID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	prescriptions := make([]Prescription, len(rows))
+	for i, p := range rows {
+		prescriptions[i] = Prescription{
+			ID:           p.ID,
+			VisitID:      p.VisitID,
+			ItemID:       p.ItemID,
+			LocationID:   p.LocationID,
+			Quantity:     p.Quantity,
+			Instructions: p.Instructions,
+			CreatedAt:    p.CreatedAt,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prescriptions)
+}
+
+// CreatePrescription prescribes a stock item on a visit and dispenses it
+func CreatePrescription(w http.ResponseWriter, r *http.Request) {
+	var p Prescription
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if p.VisitID == 0 || p.ItemID == 0 || p.Quantity <= 0 {
+		writeError(w, r, "visit_id, item_id and a positive quantity are required", http.StatusBadRequest)
+		return
+	}
+
+	in := data.PrescriptionInput{
+		VisitID:      p.VisitID,
+		ItemID:       p.ItemID,
+		Quantity:     p.Quantity,
+		Instructions: p.Instructions,
+	}
+	if p.LocationID != nil {
+		in.LocationID = *p.LocationID
+	}
+	id, err := data.CreatePrescription(DB, tenantOf(r), actorOf(r), in)
+	if err != nil {
+		writeStockError(w, r, err, "create prescription")
+		return
+	}
+
+	p.ID = id
+	logger.InfoCtx(r.Context(), "Successfully created prescription with ID: %d", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
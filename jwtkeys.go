@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"petclinic/logger"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is one key of the keyring. Private is only set for the signing key.
+type jwtKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Public  crypto.PublicKey
+	Private crypto.Signer
+}
+
+// jwtKeys holds the key tokens are signed with and every key tokens are
+// still accepted from, by kid
+var jwtKeys struct {
+	signing *jwtKey
+	verify  map[string]*jwtKey
+}
+
+// initJWTKeys loads the signing key from the PEM file in JWT_SIGNING_KEY and
+// extra verification keys from the comma-separated PEM files in
+// JWT_VERIFY_KEYS. Outside production (APP_ENV != "production") a missing
+// signing key is replaced by a throwaway key, so tokens do not survive a
+// restart.
+func initJWTKeys() error {
+	jwtKeys.verify = map[string]*jwtKey{}
+
+	path := os.Getenv("JWT_SIGNING_KEY")
+	if path == "" {
+		if os.Getenv("APP_ENV") == "production" {
+			return errors.New("JWT_SIGNING_KEY must point to a private key in production")
+		}
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		k, err := newJWTKey(priv)
+		if err != nil {
+			return err
+		}
+		jwtKeys.signing = k
+		logger.Warn("JWT_SIGNING_KEY is not set; signing tokens with a temporary key %s", k.ID)
+	} else {
+		k, err := loadJWTKey(path)
+		if err != nil {
+			return fmt.Errorf("loading JWT signing key: %w", err)
+		}
+		if k.Private == nil {
+			return fmt.Errorf("JWT signing key %s is not a private key", path)
+		}
+		jwtKeys.signing = k
+		logger.Info("Signing tokens with %s key %s", k.Method.Alg(), k.ID)
+	}
+	jwtKeys.verify[jwtKeys.signing.ID] = jwtKeys.signing
+
+	for _, p := range strings.Split(os.Getenv("JWT_VERIFY_KEYS"), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		k, err := loadJWTKey(p)
+		if err != nil {
+			return fmt.Errorf("loading JWT verification key: %w", err)
+		}
+		k.Private = nil
+		if _, dup := jwtKeys.verify[k.ID]; !dup {
+			jwtKeys.verify[k.ID] = k
+		}
+		logger.Info("Accepting tokens signed with %s key %s", k.Method.Alg(), k.ID)
+	}
+	return nil
+}
+
+// loadJWTKey reads an RSA or Ed25519 key from a PEM file. Private keys may
+// be PKCS#1 (RSA) or PKCS#8, public keys PKIX.
+func loadJWTKey(path string) (*jwtKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newJWTKey(key)
+}
+
+// newJWTKey wraps a parsed key. The kid is derived from the public key, so
+// every service loading the same key agrees on it.
+func newJWTKey(key interface{}) (*jwtKey, error) {
+	k := &jwtKey{}
+	switch v := key.(type) {
+	case *rsa.PrivateKey:
+		k.Method, k.Public, k.Private = jwt.SigningMethodRS256, &v.PublicKey, v
+	case *rsa.PublicKey:
+		k.Method, k.Public = jwt.SigningMethodRS256, v
+	case ed25519.PrivateKey:
+		k.Method, k.Public, k.Private = jwt.SigningMethodEdDSA, v.Public(), v
+	case ed25519.PublicKey:
+		k.Method, k.Public = jwt.SigningMethodEdDSA, v
+	default:
+		return nil, fmt.Errorf("unsupported key type %T; use RSA or Ed25519", key)
+	}
+	if rk, ok := k.Public.(*rsa.PublicKey); ok && rk.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA key of %d bits is too short; use at least 2048", rk.N.BitLen())
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(k.Public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.ID = hex.EncodeToString(sum[:8])
+	return k, nil
+}
+
+// jwtKeyFunc picks the verification key named by the token's kid and
+// refuses tokens whose algorithm does not match that key
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := jwtKeys.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return k.Public, nil
+}
+
+// jwk is a public key in RFC 7517 form
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// GetJWKS publishes the verification keys so other services can validate
+// tokens without sharing a secret
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding
+	keys := []jwk{}
+	for _, k := range jwtKeys.verify {
+		j := jwk{Kid: k.ID, Alg: k.Method.Alg(), Use: "sig"}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			j.Kty = "RSA"
+			j.N = b64.EncodeToString(pub.N.Bytes())
+			j.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			j.Kty, j.Crv = "OKP", "Ed25519"
+			j.X = b64.EncodeToString(pub)
+		}
+		keys = append(keys, j)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
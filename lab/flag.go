@@ -0,0 +1,45 @@
+package lab
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Abnormal flags stored with each result
+const (
+	FlagLow    = "L"
+	FlagHigh   = "H"
+	FlagNormal = "N"
+)
+
+// NumericValue parses a reported value, tolerating comparison prefixes such
+// as "<0.1" or ">500" that analyzers emit at the edge of their range
+func NumericValue(v string) (float64, bool) {
+	v = strings.TrimLeft(strings.TrimSpace(v), "<>= ")
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil
+}
+
+// Flag compares a value with a reference range. It returns "" when the value
+// is not numeric or there is no range to compare against.
+func Flag(value string, low, high *float64) string {
+	f, ok := NumericValue(value)
+	if !ok || (low == nil && high == nil) {
+		return ""
+	}
+	switch {
+	case low != nil && f < *low:
+		return FlagLow
+	case high != nil && f > *high:
+		return FlagHigh
+	}
+	return FlagNormal
+}
+
+// SameUnit reports whether a result reported in unit can be compared with a
+// reference range in refUnit. A result without a unit is taken to be in the
+// range's unit; otherwise the units must match, ignoring case.
+func SameUnit(unit, refUnit string) bool {
+	unit = strings.TrimSpace(unit)
+	return unit == "" || strings.EqualFold(unit, strings.TrimSpace(refUnit))
+}
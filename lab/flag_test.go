@@ -0,0 +1,48 @@
+package lab
+
+import "testing"
+
+func TestFlag(t *testing.T) {
+	low, high := 3.9, 6.1
+	cases := []struct {
+		value     string
+		low, high *float64
+		want      string
+	}{
+		{"5.4", &low, &high, FlagNormal},
+		{"3.9", &low, &high, FlagNormal},
+		{"6.1", &low, &high, FlagNormal},
+		{"3.8", &low, &high, FlagLow},
+		{"6.2", &low, &high, FlagHigh},
+		{"<0.1", &low, &high, FlagLow},
+		{">500", &low, &high, FlagHigh},
+		{"7", nil, &high, FlagHigh},
+		{"1", &low, nil, FlagLow},
+		{"positive", &low, &high, ""},
+		{"5.4", nil, nil, ""},
+	}
+	for _, c := range cases {
+		if got := Flag(c.value, c.low, c.high); got != c.want {
+			t.Errorf("Flag(%q) = %q, want %q", c.value, got, c.want)
+		}
+	}
+}
+
+func TestSameUnit(t *testing.T) {
+	cases := []struct {
+		unit, refUnit string
+		want          bool
+	}{
+		{"mmol/L", "mmol/L", true},
+		{"MMOL/l", "mmol/L", true},
+		{"", "mmol/L", true},
+		{"", "", true},
+		{"mg/dL", "mmol/L", false},
+		{"mmol/L", "", false},
+	}
+	for _, c := range cases {
+		if got := SameUnit(c.unit, c.refUnit); got != c.want {
+			t.Errorf("SameUnit(%q, %q) = %v, want %v", c.unit, c.refUnit, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package lab parses result files produced by the in-house analyzer.
+//
+// Two formats are accepted. CSV with a header row naming at least the
+// accession, analyte and value columns (unit is optional):
+//
+//	accession,analyte,value,unit
+//	LAB-000012,GLU,5.4,mmol/L
+//
+// and a pipe-delimited HL7 v2 subset where OBR-2 carries the accession and
+// each following OBX segment one analyte (OBX-3 code, OBX-5 value, OBX-6 unit):
+//
+//	MSH|^~\&|ANALYZER|CLINIC|||20250112103000||ORU^R01|1|P|2.3
+//	OBR|1|LAB-000012||CBC
+//	OBX|1|NM|GLU^Glucose||5.4|mmol/L|3.9-6.1|N
+package lab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Result is one analyte value reported for an order
+type Result struct {
+	Accession string
+	Analyte   string
+	Value     string
+	Unit      string
+}
+
+// Format names returned by Parse
+const (
+	FormatCSV = "csv"
+	FormatHL7 = "hl7"
+)
+
+// ErrEmpty is returned when a file contains no results
+var ErrEmpty = errors.New("lab: file contains no results")
+
+// Parse detects the format of data and returns the results it contains
+func Parse(data []byte) (string, []Result, error) {
+	trimmed := bytes.TrimLeft(data, "\ufeff \t\r\n")
+	if bytes.HasPrefix(trimmed, []byte("MSH|")) {
+		res, err := ParseHL7(bytes.NewReader(trimmed))
+		return FormatHL7, res, err
+	}
+	res, err := ParseCSV(bytes.NewReader(trimmed))
+	return FormatCSV, res, err
+}
+
+// ParseCSV reads results from CSV with a header row
+func ParseCSV(r io.Reader) ([]Result, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lab: reading csv header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"accession", "analyte", "value"} {
+		if _, ok := col[required]; !ok {
+			return nil, fmt.Errorf("lab: csv header is missing %q", required)
+		}
+	}
+
+	field := func(rec []string, name string) string {
+		i, ok := col[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+
+	var res []Result
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lab: csv line %d: %w", line, err)
+		}
+		r := Result{
+			Accession: field(rec, "accession"),
+			Analyte:   strings.ToUpper(field(rec, "analyte")),
+			Value:     field(rec, "value"),
+			Unit:      field(rec, "unit"),
+		}
+		if r.Accession == "" && r.Analyte == "" && r.Value == "" {
+			continue
+		}
+		if r.Accession == "" || r.Analyte == "" {
+			return nil, fmt.Errorf("lab: csv line %d: accession and analyte are required", line)
+		}
+		res = append(res, r)
+	}
+	if len(res) == 0 {
+		return nil, ErrEmpty
+	}
+	return res, nil
+}
+
+// ParseHL7 reads results from MSH/OBR/OBX segments. Segments may be separated
+// by CR, LF or CRLF; other segment types are ignored.
+func ParseHL7(r io.Reader) ([]Result, error) {
+	sc := bufio.NewScanner(r)
+	sc.Split(splitSegments)
+
+	var res []Result
+	accession := ""
+	for n := 1; sc.Scan(); n++ {
+		seg := strings.TrimSpace(sc.Text())
+		if seg == "" {
+			continue
+		}
+		fields := strings.Split(seg, "|")
+		switch fields[0] {
+		case "OBR":
+			accession = hl7Component(fields, 2)
+			if accession == "" {
+				accession = hl7Component(fields, 3)
+			}
+		case "OBX":
+			if accession == "" {
+				return nil, fmt.Errorf("lab: segment %d: OBX before any OBR", n)
+			}
+			analyte := strings.ToUpper(hl7Component(fields, 3))
+			if analyte == "" {
+				return nil, fmt.Errorf("lab: segment %d: OBX without analyte code", n)
+			}
+			res = append(res, Result{
+				Accession: accession,
+				Analyte:   analyte,
+				Value:     hl7Field(fields, 5),
+				Unit:      hl7Component(fields, 6),
+			})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrEmpty
+	}
+	return res, nil
+}
+
+func hl7Field(fields []string, i int) string {
+	if i >= len(fields) {
+		return ""
+	}
+	return strings.TrimSpace(fields[i])
+}
+
+// hl7Component returns the first component (before ^) of a field
+func hl7Component(fields []string, i int) string {
+	f := hl7Field(fields, i)
+	if c, _, ok := strings.Cut(f, "^"); ok {
+		return strings.TrimSpace(c)
+	}
+	return f
+}
+
+func splitSegments(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
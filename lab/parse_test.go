@@ -0,0 +1,78 @@
+package lab
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	data := []byte("\ufeffAccession, Analyte ,Value,Unit\n" +
+		"LAB-000012,glu,5.4,mmol/L\n" +
+		",,,\n" +
+		"LAB-000012,CREA,<44\n")
+	format, res, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []Result{
+		{Accession: "LAB-000012", Analyte: "GLU", Value: "5.4", Unit: "mmol/L"},
+		{Accession: "LAB-000012", Analyte: "CREA", Value: "<44"},
+	}
+	if format != FormatCSV || !reflect.DeepEqual(res, want) {
+		t.Fatalf("Parse = %s %+v, want csv %+v", format, res, want)
+	}
+}
+
+func TestParseCSVRejectsBadFiles(t *testing.T) {
+	cases := map[string]string{
+		"missing column": "accession,analyte\nLAB-1,GLU\n",
+		"no analyte":     "accession,analyte,value\nLAB-1,,5\n",
+	}
+	for name, data := range cases {
+		if _, _, err := Parse([]byte(data)); err == nil || errors.Is(err, ErrEmpty) {
+			t.Errorf("%s: err = %v, want a parse error", name, err)
+		}
+	}
+	if _, _, err := Parse([]byte("accession,analyte,value\n")); !errors.Is(err, ErrEmpty) {
+		t.Errorf("header only: err = %v, want ErrEmpty", err)
+	}
+	if _, _, err := Parse(nil); !errors.Is(err, ErrEmpty) {
+		t.Errorf("empty file: err = %v, want ErrEmpty", err)
+	}
+}
+
+func TestParseHL7(t *testing.T) {
+	data := []byte("MSH|^~\\&|ANALYZER|CLINIC|||20250112103000||ORU^R01|1|P|2.3\r" +
+		"OBR|1|LAB-000012||CBC\r\n" +
+		"OBX|1|NM|GLU^Glucose||5.4|mmol/L^^UCUM|3.9-6.1|N\n" +
+		"NTE|1||fasting\n" +
+		"OBR|2||LAB-000013|UA\n" +
+		"OBX|1|NM|usg^Specific gravity||1.020\n")
+	format, res, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []Result{
+		{Accession: "LAB-000012", Analyte: "GLU", Value: "5.4", Unit: "mmol/L"},
+		{Accession: "LAB-000013", Analyte: "USG", Value: "1.020"},
+	}
+	if format != FormatHL7 || !reflect.DeepEqual(res, want) {
+		t.Fatalf("Parse = %s %+v, want hl7 %+v", format, res, want)
+	}
+}
+
+func TestParseHL7RejectsBadFiles(t *testing.T) {
+	cases := map[string]string{
+		"OBX before OBR": "MSH|^~\\&\rOBX|1|NM|GLU||5.4\r",
+		"no analyte":     "MSH|^~\\&\rOBR|1|LAB-1\rOBX|1|NM|||5.4\r",
+	}
+	for name, data := range cases {
+		if _, _, err := Parse([]byte(data)); err == nil || errors.Is(err, ErrEmpty) {
+			t.Errorf("%s: err = %v, want a parse error", name, err)
+		}
+	}
+	if _, _, err := Parse([]byte("MSH|^~\\&\rOBR|1|LAB-1\r")); !errors.Is(err, ErrEmpty) {
+		t.Errorf("no OBX: err = %v, want ErrEmpty", err)
+	}
+}
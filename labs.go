@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"petclinic/data"
+	"petclinic/lab"
+	"petclinic/logger"
+)
+
+func labOrderFromRow(o data.LabOrderRow) LabOrder {
+	order := LabOrder{
+		ID:        o.ID,
+		VisitID:   o.VisitID,
+		Panel:     o.Panel,
+		Notes:     o.Notes,
+		Accession: o.Accession,
+		Status:    o.Status,
+		OrderedBy: o.OrderedBy,
+		RawFile:   o.RawFile,
+		CreatedAt: o.CreatedAt,
+	}
+	for _, r := range o.Results {
+		order.Results = append(order.Results, LabResult{
+			Analyte: r.Analyte,
+			Value:   r.Value,
+			Unit:    r.Unit,
+			RefLow:  r.RefLow,
+			RefHigh: r.RefHigh,
+			Flag:    r.Flag,
+		})
+	}
+	return order
+}
+
+// GetLabOrders lists the lab orders of a visit
+func GetLabOrders(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("visit_id")
+	visitID, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid visit ID format: %s", idStr)
+		writeError(w, r, "invalid visit_id", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := data.ListLabOrdersByVisit(DB, tenantOf(r), visitID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch lab orders for visit %d: %v", visitID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	orders := make([]LabOrder, len(rows))
+	for i, o := range rows {
+		orders[i] = labOrderFromRow(o)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// GetLabOrderByID returns an order with its flagged results
+func GetLabOrderByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid lab order ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	o, err := data.GetLabOrderByID(DB, tenantOf(r), id)
+	if err != nil {
+		dataError(w, r, err, "lab order")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labOrderFromRow(o))
+}
+
+// CreateLabOrder orders a panel for a visit. The returned accession number
+// is what the analyzer reports results against.
+func CreateLabOrder(w http.ResponseWriter, r *http.Request) {
+	var req LabOrder
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.VisitID == 0 || !data.ValidLabPanel(req.Panel) {
+		writeError(w, r, "visit_id is required and panel must be bloodwork or urinalysis", http.StatusBadRequest)
+		return
+	}
+
+	orderedBy, _ := r.Context().Value(logger.CtxUserIDKey).(int)
+	o, err := data.CreateLabOrder(DB, tenantOf(r), actorOf(r), data.LabOrderInput{
+		VisitID:   req.VisitID,
+		Panel:     req.Panel,
+		Notes:     req.Notes,
+		OrderedBy: orderedBy,
+	})
+	if errors.Is(err, data.ErrNotFound) {
+		writeError(w, r, "visit not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dataError(w, r, err, "lab order")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Created lab order %s for visit %d", o.Accession, o.VisitID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(labOrderFromRow(o))
+}
+
+// CancelLabOrder cancels an order that has not produced results
+func CancelLabOrder(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid lab order ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.CancelLabOrder(DB, tenantOf(r), actorOf(r), id); err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, "no open lab order with this id", http.StatusConflict)
+		} else {
+			dataError(w, r, err, "lab order")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportLabResults ingests an analyzer result file (CSV or HL7-style text)
+// uploaded as the multipart field "file". The raw file is kept in the
+// uploads directory before parsing, so a rejected file can still be inspected.
+func ImportLabResults(w http.ResponseWriter, r *http.Request) {
+	logger.InfoCtx(r.Context(), "Importing lab results")
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		logger.WarnCtx(r.Context(), "Failed to parse multipart form: %v", err)
+		writeError(w, r, "invalid multipart form", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Missing file in form: %v", err)
+		writeError(w, r, "missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Failed to read lab file: %v", err)
+		writeError(w, r, "failed to read file", http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("lab-%s-%s", time.Now().UTC().Format("20060102T150405"), filepath.Base(header.Filename))
+	if _, err := saveUpload(tenantOf(r), filename, bytes.NewReader(raw)); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to store lab file: %v", err)
+		writeError(w, r, "failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	format, results, err := lab.Parse(raw)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Rejected lab file %s: %v", filename, err)
+		writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	counts, err := data.ImportLabResults(DB, tenantOf(r), actorOf(r), results, filename)
+	if err != nil {
+		if errors.Is(err, data.ErrUnknownAccession) {
+			logger.WarnCtx(r.Context(), "Rejected lab file %s: %v", filename, err)
+			writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		logger.ErrorCtx(r.Context(), "Failed to import lab file %s: %v", filename, err)
+		writeError(w, r, "failed to import results", http.StatusInternalServerError)
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Imported %d lab results from %s (%s)", len(results), filename, format)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file":    filename,
+		"format":  format,
+		"results": len(results),
+		"orders":  counts,
+	})
+}
+
+func GetReferenceRanges(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListReferenceRanges(DB)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch reference ranges: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	ranges := make([]ReferenceRange, len(rows))
+	for i, rr := range rows {
+		ranges[i] = ReferenceRange{ID: rr.ID, Analyte: rr.Analyte, Species: rr.Species, Unit: rr.Unit, Low: rr.Low, High: rr.High}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ranges)
+}
+
+// PutReferenceRange creates or replaces the range for an analyte and species.
+// Species "*" applies to any species without a range of its own.
+func PutReferenceRange(w http.ResponseWriter, r *http.Request) {
+	var rr ReferenceRange
+	if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rr.Analyte == "" || rr.Species == "" || (rr.Low == nil && rr.High == nil) {
+		writeError(w, r, "analyte, species and at least one of low/high are required", http.StatusBadRequest)
+		return
+	}
+	if rr.Low != nil && rr.High != nil && *rr.Low > *rr.High {
+		writeError(w, r, "low must not exceed high", http.StatusBadRequest)
+		return
+	}
+
+	id, err := data.UpsertReferenceRange(DB, actorOf(r), data.ReferenceRangeInput{
+		Analyte: rr.Analyte,
+		Species: rr.Species,
+		Unit:    rr.Unit,
+		Low:     rr.Low,
+		High:    rr.High,
+	})
+	if err != nil {
+		dataError(w, r, err, "reference range")
+		return
+	}
+	rr.ID = id
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rr)
+}
@@ -27,6 +27,8 @@ type ContextKey string
 var CtxUserIDKey ContextKey = "user_id"
 // CtxUserEmailKey is the exported key to put/get user email from context
 var CtxUserEmailKey ContextKey = "user_email"
+// CtxRequestIDKey is the exported key to put/get the request id from context
+var CtxRequestIDKey ContextKey = "request_id"
 
 type LogLevel int
 
@@ -122,8 +124,9 @@ func logInternal(level, format string, v ...interface{}) {
 	}
 }
 
-// logInternalWithUser logs and persists with optional user id and email
-func logInternalWithUser(userID *int, userEmail *string, level, format string, v ...interface{}) {
+// logInternalWithUser logs and persists with optional user id, email and
+// request id
+func logInternalWithUser(userID *int, userEmail *string, requestID, level, format string, v ...interface{}) {
 	fileInfo, funcName := getCallerInfo()
 	message := fmt.Sprintf(format, v...)
 	// Add [user:<id>] or [user:<email>] suffix only for console clarity when present
@@ -133,6 +136,9 @@ func logInternalWithUser(userID *int, userEmail *string, level, format string, v
 	} else if userID != nil {
 		userSuffix = fmt.Sprintf(" [user:%d]", *userID)
 	}
+	if requestID != "" {
+		userSuffix += fmt.Sprintf(" [req:%s]", requestID)
+	}
 	prefix := fmt.Sprintf("[%s] [%s] [%s] %s%s", level, fileInfo, funcName, message, userSuffix)
 	log.Print(prefix)
 	if db != nil {
@@ -196,7 +202,9 @@ func DebugCtx(ctx context.Context, format string, v ...interface{}) {
 	if logLevel <= DEBUG {
 		var uid *int
 		var uemail *string
+		var reqID string
 		if ctx != nil {
+			reqID, _ = ctx.Value(CtxRequestIDKey).(string)
 			if v, ok := ctx.Value(CtxUserIDKey).(int); ok {
 				uid = &v
 			}
@@ -204,7 +212,7 @@ func DebugCtx(ctx context.Context, format string, v ...interface{}) {
 				uemail = &e
 			}
 		}
-		logInternalWithUser(uid, uemail, "DEBUG", format, v...)
+		logInternalWithUser(uid, uemail, reqID, "DEBUG", format, v...)
 	}
 }
 
@@ -212,7 +220,9 @@ func InfoCtx(ctx context.Context, format string, v ...interface{}) {
 	if logLevel <= INFO {
 		var uid *int
 		var uemail *string
+		var reqID string
 		if ctx != nil {
+			reqID, _ = ctx.Value(CtxRequestIDKey).(string)
 			if v, ok := ctx.Value(CtxUserIDKey).(int); ok {
 				uid = &v
 			}
@@ -220,7 +230,7 @@ func InfoCtx(ctx context.Context, format string, v ...interface{}) {
 				uemail = &e
 			}
 		}
-		logInternalWithUser(uid, uemail, "INFO", format, v...)
+		logInternalWithUser(uid, uemail, reqID, "INFO", format, v...)
 	}
 }
 
@@ -228,7 +238,9 @@ func WarnCtx(ctx context.Context, format string, v ...interface{}) {
 	if logLevel <= WARN {
 		var uid *int
 		var uemail *string
+		var reqID string
 		if ctx != nil {
+			reqID, _ = ctx.Value(CtxRequestIDKey).(string)
 			if v, ok := ctx.Value(CtxUserIDKey).(int); ok {
 				uid = &v
 			}
@@ -236,7 +248,7 @@ func WarnCtx(ctx context.Context, format string, v ...interface{}) {
 				uemail = &e
 			}
 		}
-		logInternalWithUser(uid, uemail, "WARN", format, v...)
+		logInternalWithUser(uid, uemail, reqID, "WARN", format, v...)
 	}
 }
 
@@ -244,7 +256,9 @@ func ErrorCtx(ctx context.Context, format string, v ...interface{}) {
 	if logLevel <= ERROR {
 		var uid *int
 		var uemail *string
+		var reqID string
 		if ctx != nil {
+			reqID, _ = ctx.Value(CtxRequestIDKey).(string)
 			if v, ok := ctx.Value(CtxUserIDKey).(int); ok {
 				uid = &v
 			}
@@ -252,14 +266,16 @@ func ErrorCtx(ctx context.Context, format string, v ...interface{}) {
 				uemail = &e
 			}
 		}
-		logInternalWithUser(uid, uemail, "ERROR", format, v...)
+		logInternalWithUser(uid, uemail, reqID, "ERROR", format, v...)
 	}
 }
 
 func FatalCtx(ctx context.Context, format string, v ...interface{}) {
 	var uid *int
 	var uemail *string
+	var reqID string
 	if ctx != nil {
+		reqID, _ = ctx.Value(CtxRequestIDKey).(string)
 		if v, ok := ctx.Value(CtxUserIDKey).(int); ok {
 			uid = &v
 		}
@@ -267,6 +283,6 @@ func FatalCtx(ctx context.Context, format string, v ...interface{}) {
 			uemail = &e
 		}
 	}
-	logInternalWithUser(uid, uemail, "FATAL", format, v...)
+	logInternalWithUser(uid, uemail, reqID, "FATAL", format, v...)
 	os.Exit(1)
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// lockoutPolicy decides when repeated login failures lock a key. Once
+// Threshold failures happen in a run, each further failure locks the key for
+// BaseLock doubled per extra failure, up to MaxLock. A run ends after Window
+// without failures or on a successful login.
+type lockoutPolicy struct {
+	Threshold int
+	BaseLock  time.Duration
+	MaxLock   time.Duration
+	Window    time.Duration
+}
+
+// Accounts lock quickly; an address gets more room because several users
+// can share it behind NAT
+var (
+	accountLockout = lockoutPolicy{Threshold: 5, BaseLock: 30 * time.Second, MaxLock: time.Hour, Window: 24 * time.Hour}
+	ipLockout      = lockoutPolicy{Threshold: 20, BaseLock: time.Minute, MaxLock: time.Hour, Window: 24 * time.Hour}
+)
+
+// lockFor returns how long to lock a key after its n-th failure in a run
+func (p lockoutPolicy) lockFor(n int) time.Duration {
+	if n < p.Threshold {
+		return 0
+	}
+	d := time.Duration(float64(p.BaseLock) * math.Pow(2, float64(n-p.Threshold)))
+	if d > p.MaxLock || d <= 0 {
+		return p.MaxLock
+	}
+	return d
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only
+// honoured with TRUST_PROXY=true, since clients can set it freely.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordCheck spends the same time as checking a real password, so
+// unknown emails cannot be told apart from wrong passwords by timing
+func dummyPasswordCheck(plain string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(plain))
+}
+
+// loginLocked reports whether any of keys is locked, and until when
+func loginLocked(keys ...string) (time.Time, error) {
+	var until time.Time
+	for _, k := range keys {
+		t, err := data.LoginLockedUntil(DB, k)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t.After(until) {
+			until = t
+		}
+	}
+	return until, nil
+}
+
+// recordLoginFailure counts a failure against the account and the address
+// and locks whichever crossed its threshold
+func recordLoginFailure(email, ip string) {
+	for _, k := range []struct {
+		key    string
+		policy lockoutPolicy
+	}{{accountKey(email), accountLockout}, {ipKey(ip), ipLockout}} {
+		n, err := data.RecordLoginFailure(DB, k.key, k.policy.Window)
+		if err != nil {
+			logger.Error("Failed to record login failure for %s: %v", k.key, err)
+			continue
+		}
+		if d := k.policy.lockFor(n); d > 0 {
+			if err := data.LockLogin(DB, k.key, time.Now().Add(d)); err != nil {
+				logger.Error("Failed to lock %s: %v", k.key, err)
+				continue
+			}
+			logger.Warn("Locked logins for %s for %s after %d failures", k.key, d, n)
+		}
+	}
+}
+
+// writeLockedOut answers a login attempt against a locked key
+func writeLockedOut(w http.ResponseWriter, r *http.Request, until time.Time) {
+	secs := int(math.Ceil(time.Until(until).Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeError(w, r, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// -------------------- Admin --------------------
+
+type loginLockout struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// GetLoginLockouts lists locked keys and keys with failures in the last day
+func GetLoginLockouts(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListLoginFailures(DB, 24*time.Hour)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch login lockouts: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	res := make([]loginLockout, len(rows))
+	for i, f := range rows {
+		res[i] = loginLockout{Key: f.Key, Failures: f.Failures, LastFailureAt: f.LastFailureAt, LockedUntil: f.LockedUntil}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// ClearLoginLockout removes the failures and lock of ?key= (as listed) or
+// of ?email=
+func ClearLoginLockout(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if email := r.URL.Query().Get("email"); key == "" && email != "" {
+		key = accountKey(email)
+	}
+	if key == "" {
+		writeError(w, r, "key or email is required", http.StatusBadRequest)
+		return
+	}
+
+	found, err := data.ClearLoginFailures(DB, key)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to clear lockout %s: %v", key, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, r, "no lockout for this key", http.StatusNotFound)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Cleared login lockout %s", key)
+	w.WriteHeader(http.StatusNoContent)
+}
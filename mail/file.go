@@ -0,0 +1,58 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File writes each message to its own .eml file in Dir, or to Out when Dir
+// is empty. It is meant for development, where the links in a message can be
+// copied from the file or the console instead of a real inbox.
+type File struct {
+	Dir  string
+	Out  io.Writer
+	From string
+
+	mu sync.Mutex
+	n  int
+}
+
+// NewFile returns a mailer writing into dir
+func NewFile(dir, from string) *File {
+	return &File{Dir: dir, From: from}
+}
+
+// NewConsole returns a mailer printing messages to stdout
+func NewConsole(from string) *File {
+	return &File{Out: os.Stdout, From: from}
+}
+
+func (f *File) Send(ctx context.Context, m Message) error {
+	if err := validHeader(m.To); err != nil {
+		return err
+	}
+	if err := validHeader(m.Subject); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg := format(f.From, m)
+
+	if f.Dir == "" {
+		_, err := fmt.Fprintf(f.Out, "----- mail -----\n%s\n----------------\n", strings.ReplaceAll(string(msg), "\r\n", "\n"))
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+	f.n++
+	name := fmt.Sprintf("%s-%03d.eml", time.Now().UTC().Format("20060102T150405"), f.n)
+	return os.WriteFile(filepath.Join(f.Dir, name), msg, 0644)
+}
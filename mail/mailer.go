@@ -0,0 +1,43 @@
+// Package mail sends the transactional emails of the application, such as
+// address verification and password reset links.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// format renders m as an RFC 5322 message
+func format(from string, m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects header values that would let a caller inject headers
+func validHeader(v string) error {
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Errorf("mail: header value %q contains a line break", v)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+)
+
+// SMTP delivers mail through an SMTP server, authenticating with PLAIN auth
+// when a username is set. net/smtp upgrades to TLS when the server offers
+// STARTTLS.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTP returns a mailer for the server at addr (host:port)
+func NewSMTP(addr, username, password, from string) *SMTP {
+	return &SMTP{Addr: addr, Username: username, Password: password, From: from}
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if err := validHeader(m.To); err != nil {
+		return err
+	}
+	if err := validHeader(m.Subject); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, format(s.From, m))
+}
@@ -12,8 +12,8 @@ func recoveryMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         defer func() {
             if err := recover(); err != nil {
-                logger.Error("Recovered from panic: %v", err)
-                http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+                logger.ErrorCtx(r.Context(), "Recovered from panic: %v", err)
+                writeError(w, r, "internal server error", http.StatusInternalServerError)
             }
         }()
         next.ServeHTTP(w, r)
@@ -55,137 +55,34 @@ func main() {
 
 	logger.Info("Database connection established")
 
-	// Register routes
-	http.HandleFunc("/auth/register", func(w http.ResponseWriter, r *http.Request) {
-		logger.Info("Register endpoint called")
-		if r.Method == http.MethodPost {
-			Register(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
-
-	http.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			Login(w, r)
-		} else {
-			http.Error(w, "Method not allowed", 405)
-		}
-	})
-
-	// Owners
-	http.HandleFunc("/owners", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			GetOwners(w, r)
-		} else if r.Method == http.MethodPost {
-			CreateOwner(w, r)
-		} else {
-			http.Error(w, "Method not allowed", 405)
-		}
-	}))
-
-	// Files (local storage)
-	http.HandleFunc("/files", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "%s %s", r.Method, r.URL.Path)
-		switch r.Method {
-		case http.MethodPost:
-			UploadFile(w, r)
-		case http.MethodGet:
-			DownloadFile(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
-
-	http.HandleFunc("/owners/id", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			GetOwnerByID(w, r)
-		case http.MethodPut:
-			UpdateOwner(w, r)
-		case http.MethodDelete:
-			DeleteOwner(w, r)
-		default:
-			http.Error(w, "Method not allowed", 405)
-		}
-	}))
-
-	// Pets
-	http.HandleFunc("/pets", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "%s %s", r.Method, r.URL.Path)
-		if r.Method == http.MethodGet {
-			GetPets(w, r)
-		} else if r.Method == http.MethodPost {
-			CreatePet(w, r)
-		} else {
-			http.Error(w, "Method not allowed", 405)
-		}
-	}))
-
-	http.HandleFunc("/pets/id", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "%s %s", r.Method, r.URL.Path)
-		switch r.Method {
-		case http.MethodGet:
-			GetPetByID(w, r)
-		case http.MethodPut:
-			UpdatePet(w, r)
-		case http.MethodDelete:
-			DeletePet(w, r)
-		default:
-			http.Error(w, "Method not allowed", 405)
-		}
-	}))
-
-	// Vets
-	http.HandleFunc("/vets", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "%s %s", r.Method, r.URL.Path)
-		switch r.Method {
-		case http.MethodGet:
-			GetVets(w, r)
-		case http.MethodPost:
-			CreateVet(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
-
-	http.HandleFunc("/vets/id", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			GetVetByID(w, r)
-		case http.MethodPut:
-			UpdateVet(w, r)
-		case http.MethodDelete:
-			DeleteVet(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
-
-	// Visits
-	http.HandleFunc("/visits", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugCtx(r.Context(), "%s %s", r.Method, r.URL.Path)
-		if r.Method == http.MethodGet {
-			GetVisits(w, r)
-		} else if r.Method == http.MethodPost {
-			CreateVisit(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
+	if err := initJWTKeys(); err != nil {
+		logger.Fatal("Failed to load JWT keys: %v", err)
+	}
+	if err := initPasswordPolicy(); err != nil {
+		logger.Fatal("Invalid password policy: %v", err)
+	}
+	if err := initValidation(); err != nil {
+		logger.Fatal("Invalid validation settings: %v", err)
+	}
+	if err := initClinics(); err != nil {
+		logger.Fatal("Invalid clinic settings: %v", err)
+	}
+	if err := initPreconditions(); err != nil {
+		logger.Fatal("Invalid precondition settings: %v", err)
+	}
+	if err := initIdempotency(); err != nil {
+		logger.Fatal("Invalid idempotency settings: %v", err)
+	}
+	if err := initRetention(); err != nil {
+		logger.Fatal("Invalid retention settings: %v", err)
+	}
+	initPaymentProviders()
+	initMailer()
+	initOIDC()
 
-	http.HandleFunc("/visits/id", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			GetVisitByID(w, r)
-		case http.MethodPut:
-			UpdateVisit(w, r)
-		case http.MethodDelete:
-			DeleteVisit(w, r)
-		default:
-			http.Error(w, "Method not allowed", 405)
-		}
-	}))
+	if err := initAPIVersions(http.DefaultServeMux); err != nil {
+		logger.Fatal("Invalid API version settings: %v", err)
+	}
 
 	logger.Info("	// Start server")
 	port := os.Getenv("PORT")
@@ -195,7 +92,7 @@ func main() {
 
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: recoveryMiddleware(http.DefaultServeMux),
+		Handler: requestIDMiddleware(recoveryMiddleware(http.DefaultServeMux)),
 	}
 
 	logger.Info("Server starting on :%s", port)
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+	"petclinic/totp"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaEnrollTTL      = 15 * time.Minute
+	recoveryCodeCount = 10
+)
+
+type loginResponse struct {
+	Token                 string `json:"token,omitempty"`
+	MFARequired           bool   `json:"mfa_required,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+	MFAToken              string `json:"mfa_token,omitempty"`
+}
+
+type secondFactorRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaPolicyRequest struct {
+	Role     string `json:"role"`
+	Required bool   `json:"required"`
+}
+
+// loginResult decides what a user whose password was correct receives.
+// Users with two-factor authentication get a short-lived challenge token to
+// exchange at /auth/login/mfa; users whose role requires it but who have not
+// enrolled get a token that only works for enrollment.
+func loginResult(u data.UserRow) (loginResponse, error) {
+	var res loginResponse
+	var err error
+	if u.TOTPEnabled {
+		res.MFARequired = true
+		res.MFAToken, err = signToken(u, tokenMFAChallenge, mfaChallengeTTL)
+		return res, err
+	}
+	required, err := data.MFARequired(DB, u.Role)
+	if err != nil {
+		return res, err
+	}
+	if required {
+		res.MFAEnrollmentRequired = true
+		res.MFAToken, err = signToken(u, tokenMFAEnroll, mfaEnrollTTL)
+		return res, err
+	}
+	res.Token, err = generateToken(u)
+	return res, err
+}
+
+// respondLogin finishes a login whose password was correct
+func respondLogin(w http.ResponseWriter, r *http.Request, u data.UserRow) {
+	if !u.Active {
+		logger.Warn("Login refused - account deactivated: %s", u.Email)
+		writeError(w, r, "account is deactivated", http.StatusForbidden)
+		return
+	}
+	res, err := loginResult(u)
+	if err != nil {
+		logger.Error("Failed to generate token for user %s: %v", u.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Successful login for user: %s (mfa: %t, enrollment required: %t)", u.Email, res.MFARequired, res.MFAEnrollmentRequired)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// checkSecondFactor verifies a TOTP code or, failing that, spends a
+// recovery code. A TOTP code is accepted only once.
+func checkSecondFactor(a data.Actor, u data.UserRow, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		secret, err := data.GetTOTPSecret(DB, u.ID)
+		if err != nil {
+			return false, err
+		}
+		counter, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return data.UseTOTPCounter(DB, u.ID, counter)
+	}
+	if recoveryCode != "" {
+		return data.UseRecoveryCode(DB, a, u.ID, hashSecretToken(normaliseRecoveryCode(recoveryCode)))
+	}
+	return false, nil
+}
+
+// newRecoveryCodes returns fresh codes formatted for display, and their
+// hashes for storage
+func newRecoveryCodes() ([]string, []string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(enc.EncodeToString(b))[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = hashSecretToken(c)
+	}
+	return codes, hashes, nil
+}
+
+func normaliseRecoveryCode(c string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(c))
+}
+
+// currentUser loads the account of the signed-in user
+func currentUser(r *http.Request) (data.UserRow, error) {
+	userID, _ := r.Context().Value(logger.CtxUserIDKey).(int)
+	return data.GetUserByID(DB, userID)
+}
+
+// LoginMFA is the second login step: it exchanges the challenge token from
+// /auth/login and a TOTP or recovery code for a session token
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("Invalid MFA login request: %v", err)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		writeError(w, r, "mfa_token and code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseToken(req.MFAToken)
+	if err != nil || claims["typ"] != tokenMFAChallenge {
+		logger.Warn("Invalid MFA challenge token: %v", err)
+		writeError(w, r, "invalid or expired mfa_token", http.StatusUnauthorized)
+		return
+	}
+	userID, _ := claims["sub"].(float64)
+	u, err := data.GetUserByID(DB, int(userID))
+	if err != nil || !u.TOTPEnabled || !u.Active {
+		writeError(w, r, "invalid or expired mfa_token", http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	until, err := loginLocked(accountKey(u.Email), ipKey(ip))
+	if err != nil {
+		logger.Error("Failed to check login lockout for %s: %v", u.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		logger.Warn("MFA login refused - locked out: %s from %s", u.Email, ip)
+		writeLockedOut(w, r, until)
+		return
+	}
+
+	ok, err := checkSecondFactor(actorOf(r), u, req.Code, req.RecoveryCode)
+	if err != nil {
+		logger.Error("Failed to check second factor for %s: %v", u.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		logger.Warn("MFA login failed - invalid code for user: %s", u.Email)
+		recordLoginFailure(u.Email, ip)
+		writeError(w, r, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	if _, err := data.ClearLoginFailures(DB, accountKey(u.Email)); err != nil {
+		logger.Error("Failed to clear login failures for %s: %v", u.Email, err)
+	}
+	if req.RecoveryCode != "" {
+		logger.Warn("User %s signed in with a recovery code", u.Email)
+	}
+
+	token, err := generateToken(u)
+	if err != nil {
+		logger.Error("Failed to generate token for user %s: %v", u.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Successful MFA login for user: %s", u.Email)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authResponse{Token: token})
+}
+
+// secondFactorLocked answers 429 and returns true when the signed-in user's
+// account or address is locked out. Wrong codes on the 2FA settings count
+// against the same lockout as logins, so a stolen session cannot be used to
+// guess codes.
+func secondFactorLocked(w http.ResponseWriter, r *http.Request, u data.UserRow) bool {
+	until, err := loginLocked(accountKey(u.Email), ipKey(clientIP(r)))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check login lockout for %s: %v", u.Email, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return true
+	}
+	if !until.IsZero() {
+		logger.WarnCtx(r.Context(), "Second factor check refused - locked out: %s", u.Email)
+		writeLockedOut(w, r, until)
+		return true
+	}
+	return false
+}
+
+// GetMFAStatus tells the signed-in user whether two-factor authentication
+// is on and how many recovery codes remain
+func GetMFAStatus(w http.ResponseWriter, r *http.Request) {
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	required, err := data.MFARequired(DB, u.Role)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load MFA policy: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	left := 0
+	if u.TOTPEnabled {
+		if left, err = data.CountRecoveryCodes(DB, u.ID); err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to count recovery codes: %v", err)
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":             u.TOTPEnabled,
+		"required":            required,
+		"recovery_codes_left": left,
+	})
+}
+
+// EnrollMFA starts enrollment by generating a secret. It only takes effect
+// once a code from the authenticator app is confirmed.
+func EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if u.TOTPEnabled {
+		writeError(w, r, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err == nil {
+		err = data.SetPendingTOTPSecret(DB, actorOf(r), u.ID, secret)
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to start MFA enrollment for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Started MFA enrollment for user %d", u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(getenvDefault("TOTP_ISSUER", "Pet Clinic"), u.Email, secret),
+	})
+}
+
+// ConfirmMFA enables two-factor authentication once the user proves their
+// app produces valid codes, and returns the recovery codes. They are shown
+// only this once.
+func ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, r, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if u.TOTPEnabled {
+		writeError(w, r, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := data.GetTOTPSecret(DB, u.ID)
+	if err != nil {
+		writeError(w, r, "start enrollment first", http.StatusConflict)
+		return
+	}
+	if secondFactorLocked(w, r, u) {
+		return
+	}
+	counter, ok := totp.Validate(secret, req.Code, time.Now())
+	if !ok {
+		logger.WarnCtx(r.Context(), "Invalid code while confirming MFA for user %d", u.ID)
+		recordLoginFailure(u.Email, clientIP(r))
+		writeError(w, r, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = data.ConfirmTOTP(DB, actorOf(r), u.ID, counter, hashes)
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to enable MFA for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	res := map[string]interface{}{"recovery_codes": codes}
+	// Users who signed in with an enrollment-only token continue with a
+	// normal session
+	if typ, _ := r.Context().Value(ctxTokenTypeKey).(string); typ == tokenMFAEnroll {
+		token, err := generateToken(u)
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to generate token for user %d: %v", u.ID, err)
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		res["token"] = token
+	}
+
+	logger.InfoCtx(r.Context(), "Enabled MFA for user %d", u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// DisableMFA turns two-factor authentication off after checking a current
+// code. Users whose role requires it cannot turn it off.
+func DisableMFA(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		writeError(w, r, "code or recovery_code is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !u.TOTPEnabled {
+		writeError(w, r, "two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	required, err := data.MFARequired(DB, u.Role)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load MFA policy: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		writeError(w, r, "two-factor authentication is required for your role", http.StatusConflict)
+		return
+	}
+
+	if secondFactorLocked(w, r, u) {
+		return
+	}
+	ok, err := checkSecondFactor(actorOf(r), u, req.Code, req.RecoveryCode)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check second factor for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		logger.WarnCtx(r.Context(), "Invalid code while disabling MFA for user %d", u.ID)
+		recordLoginFailure(u.Email, clientIP(r))
+		writeError(w, r, "invalid code", http.StatusBadRequest)
+		return
+	}
+	if err := data.DisableTOTP(DB, actorOf(r), u.ID); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to disable MFA for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Disabled MFA for user %d", u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, r, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !u.TOTPEnabled {
+		writeError(w, r, "two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	if secondFactorLocked(w, r, u) {
+		return
+	}
+	ok, err := checkSecondFactor(actorOf(r), u, req.Code, "")
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check second factor for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		logger.WarnCtx(r.Context(), "Invalid code while regenerating recovery codes for user %d", u.ID)
+		recordLoginFailure(u.Email, clientIP(r))
+		writeError(w, r, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = data.ReplaceRecoveryCodes(DB, actorOf(r), u.ID, hashes)
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to replace recovery codes for user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Regenerated recovery codes for user %d", u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// -------------------- Admin --------------------
+
+// GetMFAPolicy shows which roles must use two-factor authentication
+func GetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := data.GetMFAPolicy(DB)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load MFA policy: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	res := []mfaPolicyRequest{}
+	for _, role := range []string{data.RoleAdmin, data.RoleStaff, data.RoleOwner} {
+		res = append(res, mfaPolicyRequest{Role: role, Required: policy[role]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// PutMFAPolicy sets whether a role must use two-factor authentication.
+// Members of the role without it are sent to enrollment at their next login.
+func PutMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	var req mfaPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Role != data.RoleAdmin && req.Role != data.RoleStaff && req.Role != data.RoleOwner {
+		writeError(w, r, "role must be admin, staff or owner", http.StatusBadRequest)
+		return
+	}
+	if err := data.SetMFAPolicy(DB, actorOf(r), req.Role, req.Required); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to save MFA policy: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoCtx(r.Context(), "MFA required for role %s: %t", req.Role, req.Required)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
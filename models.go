@@ -1,33 +1,218 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Owner struct {
 	ID      int    `json:"id"`
-	Name    string `json:"name"`
-	Phone   string `json:"phone"`
+	Name    string `json:"name" validate:"required,max=100"`
+	Phone   string `json:"phone" validate:"phone,max=20"`
 	Address string `json:"address"`
+	// ClinicID is set from the signed-in account, never from the request
+	ClinicID  int        `json:"clinic_id,omitempty"`
+	Version   int        `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Pet struct {
 	ID       int       `json:"id"`
-	Name     string    `json:"name"`
-	Species  string    `json:"species"`
-	Breed    string    `json:"breed"`
-	Birth    time.Time `json:"birth_date"`
-	OwnerID  int       `json:"owner_id"`
+	Name     string    `json:"name" validate:"required,max=100"`
+	Species  string    `json:"species" validate:"required,max=50"`
+	Breed    string    `json:"breed" validate:"max=50"`
+	Birth    time.Time `json:"birth_date" validate:"past"`
+	OwnerID  int       `json:"owner_id" validate:"required,ref=owners"`
+	SpeciesID *int     `json:"species_id,omitempty"`
+	BreedID   *int     `json:"breed_id,omitempty"`
+	ClinicID  int      `json:"clinic_id,omitempty"`
+	Version   int      `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Visit struct {
 	ID     int       `json:"id"`
-	PetID  int       `json:"pet_id"`
-	VetID  int       `json:"vet_id"`
-	Visit  time.Time `json:"visit_date"`
+	PetID  int       `json:"pet_id" validate:"required,ref=pets"`
+	VetID  int       `json:"vet_id" validate:"required,ref=vets"`
+	Visit  time.Time `json:"visit_date" validate:"required,schedule"`
 	Desc   string    `json:"description"`
+	ClinicID int     `json:"clinic_id,omitempty"`
+	Version  int     `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Vet struct {
 	ID            int    `json:"id"`
-	Name          string `json:"name"`
-	Specialization string `json:"specialization"`
+	Name          string `json:"name" validate:"required,max=100"`
+	Specialization string `json:"specialization" validate:"max=100"`
+	ClinicID      int    `json:"clinic_id,omitempty"`
+	Version       int    `json:"version"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Service is an entry in the clinic's price catalog. Amounts are in minor
+// currency units (cents) and tax rates in basis points (1% = 100).
+type Service struct {
+	ID             int    `json:"id"`
+	Code           string `json:"code"`
+	Name           string `json:"name"`
+	Kind           string `json:"kind"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+	TaxRateBP      int    `json:"tax_rate_bp"`
+	Active         bool   `json:"active"`
+}
+
+type InvoiceLine struct {
+	ID             int    `json:"id,omitempty"`
+	ServiceID      *int   `json:"service_id,omitempty"`
+	Kind           string `json:"kind"`
+	Description    string `json:"description"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+	TaxRateBP      int    `json:"tax_rate_bp"`
+	DiscountCents  int64  `json:"discount_cents"`
+	NetCents       int64  `json:"net_cents"`
+	TaxCents       int64  `json:"tax_cents"`
+}
+
+type Invoice struct {
+	ID            int           `json:"id"`
+	OwnerID       int           `json:"owner_id"`
+	VisitID       *int          `json:"visit_id,omitempty"`
+	Status        string        `json:"status"`
+	Currency      string        `json:"currency"`
+	SubtotalCents int64         `json:"subtotal_cents"`
+	TaxCents      int64         `json:"tax_cents"`
+	DiscountCents int64         `json:"discount_cents"`
+	TotalCents    int64         `json:"total_cents"`
+	PaidCents     int64         `json:"paid_cents"`
+	CreatedAt     time.Time     `json:"created_at"`
+	IssuedAt      *time.Time    `json:"issued_at,omitempty"`
+	Lines         []InvoiceLine `json:"lines,omitempty"`
+}
+
+type Payment struct {
+	ID             int       `json:"id"`
+	InvoiceID      int       `json:"invoice_id"`
+	Kind           string    `json:"kind"`
+	Provider       string    `json:"provider"`
+	Method         string    `json:"method"`
+	AmountCents    int64     `json:"amount_cents"`
+	Status         string    `json:"status"`
+	Reference      string    `json:"reference,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	RefundOf       *int      `json:"refund_of,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type StockLocation struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ClinicID int    `json:"clinic_id,omitempty"`
+}
+
+// StockItem is a drug or supply kept in stock. When ServiceID links it to a
+// catalog entry, issuing invoices for that service consumes stock.
+type StockItem struct {
+	ID               int          `json:"id"`
+	SKU              string       `json:"sku"`
+	Name             string       `json:"name"`
+	Unit             string       `json:"unit"`
+	ReorderThreshold int          `json:"reorder_threshold"`
+	ServiceID        *int         `json:"service_id,omitempty"`
+	Quantity         *int         `json:"quantity,omitempty"`
+	Levels           []StockLevel `json:"levels,omitempty"`
+	ClinicID         int          `json:"clinic_id,omitempty"`
+}
+
+type StockLevel struct {
+	LocationID int `json:"location_id"`
+	Quantity   int `json:"quantity"`
+}
+
+type StockBatch struct {
+	ID         int        `json:"id"`
+	ItemID     int        `json:"item_id"`
+	LocationID int        `json:"location_id"`
+	BatchNo    string     `json:"batch_no"`
+	ExpiresOn  *time.Time `json:"expires_on,omitempty"`
+	Quantity   int        `json:"quantity"`
+	ReceivedAt time.Time  `json:"received_at"`
+	ClinicID   int        `json:"clinic_id,omitempty"`
+}
+
+type Prescription struct {
+	ID           int       `json:"id"`
+	VisitID      int       `json:"visit_id"`
+	ItemID       int       `json:"item_id"`
+	LocationID   *int      `json:"location_id,omitempty"`
+	Quantity     int       `json:"quantity"`
+	Instructions string    `json:"instructions"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type LabOrder struct {
+	ID        int         `json:"id"`
+	VisitID   int         `json:"visit_id"`
+	Panel     string      `json:"panel"`
+	Notes     string      `json:"notes,omitempty"`
+	Accession string      `json:"accession"`
+	Status    string      `json:"status"`
+	OrderedBy *int        `json:"ordered_by,omitempty"`
+	RawFile   string      `json:"raw_file,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	Results   []LabResult `json:"results,omitempty"`
+}
+
+// LabResult is one analyte of a lab order. Flag is L, H or N when the value
+// could be compared with a reference range, and empty otherwise.
+type LabResult struct {
+	Analyte string   `json:"analyte"`
+	Value   string   `json:"value"`
+	Unit    string   `json:"unit"`
+	RefLow  *float64 `json:"ref_low,omitempty"`
+	RefHigh *float64 `json:"ref_high,omitempty"`
+	Flag    string   `json:"flag"`
+}
+
+type ReferenceRange struct {
+	ID      int      `json:"id"`
+	Analyte string   `json:"analyte"`
+	Species string   `json:"species"`
+	Unit    string   `json:"unit"`
+	Low     *float64 `json:"low,omitempty"`
+	High    *float64 `json:"high,omitempty"`
+}
+
+type Species struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+// Breed carries breed-level defaults such as the expected adult weight range
+type Breed struct {
+	ID          int      `json:"id"`
+	SpeciesID   int      `json:"species_id"`
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	MinWeightKg *float64 `json:"min_weight_kg,omitempty"`
+	MaxWeightKg *float64 `json:"max_weight_kg,omitempty"`
+}
+
+// AuditEvent is one recorded change. Before and After hold only the fields
+// that changed; Before is absent for a create and After for a purge.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	ActorID    *int            `json:"actor_id,omitempty"`
+	ActorEmail string          `json:"actor_email,omitempty"`
+	APIKeyID   *int            `json:"api_key_id,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	ClinicID   *int            `json:"clinic_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
 }
@@ -0,0 +1,252 @@
+// Package oidc is a small OpenID Connect relying party: discovery, the
+// authorization code flow with PKCE, and ID token validation against the
+// provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Discovery is the part of the provider's openid-configuration the client
+// uses
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Client talks to one provider on behalf of one registered application
+type Client struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTP         *http.Client
+
+	mu        sync.Mutex
+	discovery *Discovery
+	keys      map[string]interface{}
+	keysAt    time.Time
+}
+
+// NewClient returns a client for the provider at issuer. Discovery happens on
+// first use, so the application can start while the provider is down.
+func NewClient(issuer, clientID, clientSecret, redirectURL string) *Client {
+	return &Client{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		HTTP:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Discover fetches and caches the provider's openid-configuration
+func (c *Client) Discover(ctx context.Context) (*Discovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	var d Discovery
+	if err := c.getJSON(ctx, c.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != c.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", d.Issuer, c.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	c.discovery = &d
+	return c.discovery, nil
+}
+
+// AuthCodeURL returns the provider URL to send the user to. challenge is the
+// PKCE S256 challenge of the verifier later passed to Exchange.
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", c.ClientID)
+	q.Set("redirect_uri", c.RedirectURL)
+	q.Set("scope", strings.Join(c.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems an authorization code and returns the validated claims
+// of the ID token. nonce must be the value sent with AuthCodeURL.
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (jwt.MapClaims, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.RedirectURL)
+	form.Set("client_id", c.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint returned %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	return c.VerifyIDToken(ctx, tr.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims
+func (c *Client) VerifyIDToken(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return c.key(ctx, kid, t.Method.Alg())
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(c.Issuer),
+		jwt.WithAudience(c.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); nonce == "" || got != nonce {
+		return nil, errors.New("oidc: id token nonce does not match")
+	}
+	// With several audiences the token must be issued to us (OIDC Core 3.1.3.7)
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != c.ClientID {
+			return nil, errors.New("oidc: id token azp does not match client")
+		}
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("oidc: id token has no subject")
+	}
+	return claims, nil
+}
+
+// key returns the provider key with the given kid, refetching the key set
+// when the kid is unknown (the provider may have rotated), at most once a
+// minute
+func (c *Client) key(ctx context.Context, kid, alg string) (interface{}, error) {
+	d, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k, ok := c.keys[kid]
+	if !ok && time.Since(c.keysAt) > time.Minute {
+		var set jwkSet
+		if err := c.getJSON(ctx, d.JWKSURI, &set); err != nil {
+			return nil, fmt.Errorf("oidc: fetching keys: %w", err)
+		}
+		keys, err := set.publicKeys()
+		if err != nil {
+			return nil, err
+		}
+		c.keys, c.keysAt = keys, time.Now()
+		k, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+	if !keyMatchesAlg(k, alg) {
+		return nil, fmt.Errorf("oidc: key %q cannot verify %s", kid, alg)
+	}
+	return k, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(into)
+}
+
+// RandomString returns a URL-safe random value for state, nonce and PKCE
+// verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// S256Challenge returns the PKCE code challenge for a verifier (RFC 7636)
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
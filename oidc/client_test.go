@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID = "petclinic"
+	testSecret   = "fake-secret"
+	testRedirect = "http://clinic.test/auth/oidc/callback"
+)
+
+var testUser = FakeUser{Subject: "u-vet", Email: "vet@clinic.test", EmailVerified: true, Name: "Vera Vet", Groups: []string{"clinic-staff"}}
+
+type testProvider struct {
+	*FakeProvider
+	jwksFetches atomic.Int32
+}
+
+// startProvider runs a FakeProvider and returns it with a client registered
+// with it
+func startProvider(t *testing.T) (*testProvider, *Client) {
+	t.Helper()
+	p := &testProvider{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			p.jwksFetches.Add(1)
+		}
+		p.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	fake, err := NewFakeProvider(srv.URL, testClientID, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddUser(testUser)
+	p.FakeProvider = fake
+	return p, NewClient(srv.URL, testClientID, testSecret, testRedirect)
+}
+
+// authorize signs testUser in and returns the authorization code
+func authorize(t *testing.T, c *Client, nonce, verifier string) string {
+	t.Helper()
+	u, err := c.AuthCodeURL(context.Background(), "state-1", nonce, S256Challenge(verifier))
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(u + "&login_hint=" + url.QueryEscape(testUser.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize answered %d", resp.StatusCode)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), testRedirect) || loc.Query().Get("state") != "state-1" {
+		t.Fatalf("redirected to %s", loc)
+	}
+	return loc.Query().Get("code")
+}
+
+// sign returns an ID token for testUser with claims changed by edit, signed
+// with key under kid
+func sign(t *testing.T, p *testProvider, key *rsa.PrivateKey, kid string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   p.Issuer,
+		"sub":   testUser.Subject,
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": "nonce-1",
+		"email": testUser.Email,
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	raw, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestExchangeWithPKCE(t *testing.T) {
+	_, c := startProvider(t)
+	verifier, err := RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, c, "nonce-1", verifier)
+
+	claims, err := c.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims["sub"] != testUser.Subject || claims["email"] != testUser.Email {
+		t.Fatalf("claims = %v", claims)
+	}
+
+	if _, err := c.Exchange(context.Background(), code, verifier, "nonce-1"); err == nil {
+		t.Fatal("a code was redeemed twice")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	_, c := startProvider(t)
+	code := authorize(t, c, "nonce-1", "the-verifier")
+	if _, err := c.Exchange(context.Background(), code, "another-verifier", "nonce-1"); err == nil {
+		t.Fatal("Exchange accepted a code with the wrong PKCE verifier")
+	}
+}
+
+func TestExchangeRejectsBadNonce(t *testing.T) {
+	_, c := startProvider(t)
+	code := authorize(t, c, "nonce-1", "the-verifier")
+	if _, err := c.Exchange(context.Background(), code, "the-verifier", "nonce-2"); err == nil {
+		t.Fatal("Exchange accepted an ID token with another nonce")
+	}
+}
+
+func TestVerifyIDTokenRejectsBadClaims(t *testing.T) {
+	p, c := startProvider(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.VerifyIDToken(context.Background(), sign(t, p, p.key, p.kid, nil), "nonce-1"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	cases := map[string]string{
+		"wrong nonce":    sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { c["nonce"] = "nonce-2" }),
+		"no nonce":       sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { delete(c, "nonce") }),
+		"wrong issuer":   sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { c["iss"] = "https://evil.test" }),
+		"wrong audience": sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { c["aud"] = "another-app" }),
+		"no azp":         sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { c["aud"] = []string{testClientID, "another-app"} }),
+		"expired":        sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }),
+		"no expiry":      sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { delete(c, "exp") }),
+		"no subject":     sign(t, p, p.key, p.kid, func(c jwt.MapClaims) { delete(c, "sub") }),
+		"foreign key":    sign(t, p, otherKey, p.kid, nil),
+		"unknown kid":    sign(t, p, otherKey, "other-1", nil),
+	}
+	for name, raw := range cases {
+		if _, err := c.VerifyIDToken(context.Background(), raw, "nonce-1"); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestKeysAreFetchedFromJWKSAndCached(t *testing.T) {
+	p, c := startProvider(t)
+	if p.jwksFetches.Load() != 0 {
+		t.Fatal("keys fetched before first use")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.VerifyIDToken(context.Background(), sign(t, p, p.key, p.kid, nil), "nonce-1"); err != nil {
+			t.Fatalf("VerifyIDToken: %v", err)
+		}
+	}
+	if n := p.jwksFetches.Load(); n != 1 {
+		t.Fatalf("key set fetched %d times, want 1", n)
+	}
+	if _, ok := c.keys[p.kid]; !ok {
+		t.Fatalf("key %q not cached from the key set", p.kid)
+	}
+
+	// An unknown kid refetches at most once a minute
+	c.VerifyIDToken(context.Background(), sign(t, p, p.key, "rotated-1", nil), "nonce-1")
+	if n := p.jwksFetches.Load(); n != 1 {
+		t.Fatalf("key set fetched %d times within a minute, want 1", n)
+	}
+	c.keysAt = time.Now().Add(-2 * time.Minute)
+	c.VerifyIDToken(context.Background(), sign(t, p, p.key, "rotated-1", nil), "nonce-1")
+	if n := p.jwksFetches.Load(); n != 2 {
+		t.Fatalf("key set fetched %d times after a minute, want 2", n)
+	}
+}
@@ -0,0 +1,239 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// FakeUser is an identity known to FakeProvider
+type FakeUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// FakeProvider is an in-memory OpenID Connect provider for local
+// development and manual testing. It serves discovery, a key set, an
+// authorization endpoint that signs in any known user without a password
+// (pick one on the page or pass login_hint=<email>), and a token endpoint
+// enforcing client credentials, redirect URI and PKCE.
+type FakeProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+	kid string
+
+	mu    sync.Mutex
+	users map[string]FakeUser
+	codes map[string]fakeCode
+}
+
+type fakeCode struct {
+	user        FakeUser
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	expires     time.Time
+}
+
+// NewFakeProvider returns a provider reachable at issuer that accepts one
+// client
+func NewFakeProvider(issuer, clientID, clientSecret string) (*FakeProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &FakeProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		kid:          "fake-1",
+		users:        map[string]FakeUser{},
+		codes:        map[string]fakeCode{},
+	}, nil
+}
+
+// AddUser makes an identity available for sign-in
+func (f *FakeProvider) AddUser(u FakeUser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[strings.ToLower(u.Email)] = u
+}
+
+func (f *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                f.Issuer,
+			"authorization_endpoint":                f.Issuer + "/authorize",
+			"token_endpoint":                        f.Issuer + "/token",
+			"jwks_uri":                              f.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/jwks":
+		b64 := base64.RawURLEncoding
+		writeJSON(w, http.StatusOK, jwkSet{Keys: []jwk{{
+			Kty: "RSA", Kid: f.kid, Use: "sig", Alg: "RS256",
+			N: b64.EncodeToString(f.key.N.Bytes()),
+			E: b64.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+	case "/authorize":
+		f.authorize(w, r)
+	case "/token":
+		f.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var fakeLoginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Fake identity provider</title>
+<h1>Sign in as</h1>
+<ul>{{range .Users}}<li><a href="{{$.Base}}&login_hint={{.Email}}">{{.Email}}</a> {{.Groups}}</li>{{end}}</ul>`))
+
+func (f *FakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != f.ClientID || q.Get("redirect_uri") == "" {
+		http.Error(w, "unknown client or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "only the code flow with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hint := strings.ToLower(q.Get("login_hint"))
+	if hint == "" {
+		var users []FakeUser
+		for _, u := range f.users {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fakeLoginPage.Execute(w, map[string]interface{}{"Users": users, "Base": template.URL(f.Issuer + "/authorize?" + q.Encode())})
+		return
+	}
+	u, ok := f.users[hint]
+	if !ok {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+
+	code, err := RandomString()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	f.codes[code] = fakeCode{
+		user:        u,
+		clientID:    f.ClientID,
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *FakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != f.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(f.ClientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	f.mu.Lock()
+	c, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	f.mu.Unlock()
+	if !ok || time.Now().After(c.expires) || c.redirectURI != r.PostForm.Get("redirect_uri") ||
+		S256Challenge(r.PostForm.Get("code_verifier")) != c.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            f.Issuer,
+		"sub":            c.user.Subject,
+		"aud":            c.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          c.nonce,
+		"email":          c.user.Email,
+		"email_verified": c.user.EmailVerified,
+		"name":           c.user.Name,
+		"groups":         c.user.Groups,
+	})
+	tok.Header["kid"] = f.kid
+	idToken, err := tok.SignedString(f.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	access, _ := RandomString()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
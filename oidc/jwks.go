@@ -0,0 +1,80 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKeys decodes the signing keys of a set by kid. Keys of other types
+// or uses are skipped.
+func (s jwkSet) publicKeys() (map[string]interface{}, error) {
+	b64 := base64.RawURLEncoding
+	keys := map[string]interface{}{}
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, err := b64.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("oidc: key %q: %w", k.Kid, err)
+			}
+			e, err := b64.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("oidc: key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := b64.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("oidc: key %q: %w", k.Kid, err)
+			}
+			y, err := b64.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("oidc: key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := b64.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("oidc: key %q: invalid Ed25519 key", k.Kid)
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		}
+	}
+	return keys, nil
+}
+
+func keyMatchesAlg(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
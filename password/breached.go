@@ -0,0 +1,77 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PrefixLen is the number of hex digits of the SHA-1 that name a range file
+const PrefixLen = 5
+
+// RangeDir is a breached-password list split the way the Pwned Passwords
+// range API serves it: the file named after the first five hex digits of a
+// password's SHA-1 (optionally with .txt) lists the remaining 35 digits of
+// every breached hash with that prefix, one "SUFFIX:COUNT" per line. Only
+// one small file is read per lookup, and nothing leaves the machine.
+type RangeDir struct {
+	Dir string
+}
+
+// OpenRangeDir checks that dir exists
+func OpenRangeDir(dir string) (*RangeDir, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &RangeDir{Dir: dir}, nil
+}
+
+// Hash returns the upper-case hex SHA-1 of plain as used by the lists
+func Hash(plain string) string {
+	sum := sha1.Sum([]byte(plain))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Count returns how often plain appears in the list; 0 means it was not
+// found
+func (d *RangeDir) Count(plain string) (int, error) {
+	h := Hash(plain)
+	prefix, suffix := h[:PrefixLen], h[PrefixLen:]
+
+	f, err := os.Open(filepath.Join(d.Dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(d.Dir, prefix+".txt"))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		s, count, _ := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if !strings.EqualFold(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+	return 0, sc.Err()
+}
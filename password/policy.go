@@ -0,0 +1,89 @@
+// Package password checks new passwords against a configurable policy and
+// against lists of breached passwords kept on disk.
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxBytes is the most bcrypt can hash; longer passwords would be cut
+const MaxBytes = 72
+
+// Character classes a policy can require
+const (
+	ClassUpper  = "upper"
+	ClassLower  = "lower"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// Policy is what a new password must satisfy
+type Policy struct {
+	MinLength int
+	// Classes lists the character classes that must all appear
+	Classes []string
+}
+
+// Violation is one reason a password was refused. Code is stable for
+// clients; Message is for people.
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidClass reports whether c names a character class
+func ValidClass(c string) bool {
+	switch c {
+	case ClassUpper, ClassLower, ClassDigit, ClassSymbol:
+		return true
+	}
+	return false
+}
+
+// Check returns every way plain breaks the policy. email is the account's
+// address; neither it nor its local part may be used as the password.
+func (p Policy) Check(plain, email string) []Violation {
+	var v []Violation
+	if n := utf8.RuneCountInString(plain); n < p.MinLength {
+		v = append(v, Violation{"too_short", fmt.Sprintf("must be at least %d characters", p.MinLength)})
+	}
+	if len(plain) > MaxBytes {
+		v = append(v, Violation{"too_long", fmt.Sprintf("must be at most %d bytes", MaxBytes)})
+	}
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, _, _ := strings.Cut(email, "@")
+	if lp := strings.ToLower(plain); email != "" && (lp == email || lp == local) {
+		v = append(v, Violation{"matches_email", "must not be your email address"})
+	}
+
+	for _, c := range p.Classes {
+		if !hasClass(plain, c) {
+			v = append(v, Violation{"missing_" + c, "must contain " + classNames[c]})
+		}
+	}
+	return v
+}
+
+var classNames = map[string]string{
+	ClassUpper:  "an uppercase letter",
+	ClassLower:  "a lowercase letter",
+	ClassDigit:  "a digit",
+	ClassSymbol: "a symbol",
+}
+
+func hasClass(s, class string) bool {
+	for _, r := range s {
+		switch {
+		case class == ClassUpper && unicode.IsUpper(r),
+			class == ClassLower && unicode.IsLower(r),
+			class == ClassDigit && unicode.IsDigit(r),
+			class == ClassSymbol && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r):
+			return true
+		}
+	}
+	return false
+}
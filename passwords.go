@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"petclinic/logger"
+	"petclinic/password"
+)
+
+var (
+	passwordPolicy    = password.Policy{MinLength: 10}
+	breachedPasswords *password.RangeDir
+)
+
+// initPasswordPolicy reads the password rules from the environment:
+// PASSWORD_MIN_LENGTH (default 10), PASSWORD_REQUIRE (comma-separated
+// character classes: upper, lower, digit, symbol) and BREACHED_PASSWORDS_DIR,
+// a directory of breached-password range files.
+func initPasswordPolicy() error {
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("PASSWORD_MIN_LENGTH must be a positive number, got %q", v)
+		}
+		passwordPolicy.MinLength = n
+	}
+	for _, c := range splitList(os.Getenv("PASSWORD_REQUIRE")) {
+		if !password.ValidClass(c) {
+			return fmt.Errorf("PASSWORD_REQUIRE: unknown character class %q", c)
+		}
+		passwordPolicy.Classes = append(passwordPolicy.Classes, c)
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		d, err := password.OpenRangeDir(dir)
+		if err != nil {
+			return fmt.Errorf("BREACHED_PASSWORDS_DIR: %w", err)
+		}
+		breachedPasswords = d
+		logger.Info("Checking new passwords against breached-password list in %s", dir)
+	}
+	logger.Info("Password policy: at least %d characters, required classes %v", passwordPolicy.MinLength, passwordPolicy.Classes)
+	return nil
+}
+
+// checkNewPassword applies the policy and the breached-password list to a
+// password being set for email. field names the request field in the error.
+// A failing list lookup is logged and does not block the user. On rejection
+// it has already written the response.
+func checkNewPassword(w http.ResponseWriter, r *http.Request, plain, email, field string) bool {
+	v := passwordPolicy.Check(plain, email)
+	if breachedPasswords != nil && len(v) == 0 {
+		n, err := breachedPasswords.Count(plain)
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to check breached passwords: %v", err)
+		} else if n > 0 {
+			v = append(v, password.Violation{Code: "breached",
+				Message: "appears in a list of breached passwords; choose another"})
+		}
+	}
+	if len(v) == 0 {
+		return true
+	}
+
+	codes := make([]string, len(v))
+	errs := make([]FieldError, len(v))
+	for i, x := range v {
+		codes[i] = x.Code
+		errs[i] = FieldError{Field: field, Code: x.Code, Message: x.Message}
+	}
+	logger.InfoCtx(r.Context(), "Rejected new password for %s: %s", email, strings.Join(codes, ", "))
+	writeFieldErrors(w, r, "password does not meet the requirements", http.StatusUnprocessableEntity, errs)
+	return false
+}
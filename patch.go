@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"petclinic/logger"
+)
+
+// PATCH bodies are JSON Merge Patches (RFC 7396), sent as
+// application/merge-patch+json or application/json, or JSON Patches
+// (RFC 6902), sent as application/json-patch+json. Either is applied to the
+// JSON form of the stored record.
+
+// patchBody applies the PATCH request body to current, decodes the result
+// into dst and returns the top-level fields the body touched. On failure it
+// has already written the response.
+func patchBody(w http.ResponseWriter, r *http.Request, current, dst interface{}) ([]string, bool) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var doc interface{}
+	if b, err := json.Marshal(current); err == nil {
+		err = json.Unmarshal(b, &doc)
+	}
+
+	var fields []string
+	switch ct {
+	case "application/merge-patch+json", "application/json", "":
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+			writeError(w, r, "invalid json", http.StatusBadRequest)
+			return nil, false
+		}
+		p, ok := patch.(map[string]interface{})
+		if !ok {
+			writeError(w, r, "a merge patch must be a JSON object", http.StatusBadRequest)
+			return nil, false
+		}
+		for k := range p {
+			fields = append(fields, k)
+		}
+		doc = mergePatch(doc, patch)
+	case "application/json-patch+json":
+		var ops []patchOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+			writeError(w, r, "invalid json", http.StatusBadRequest)
+			return nil, false
+		}
+		var err error
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			if err == errPatchTest {
+				writeError(w, r, err.Error(), http.StatusConflict)
+			} else {
+				writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+			}
+			return nil, false
+		}
+		for _, op := range ops {
+			touched := []string{op.Path}
+			switch op.Op {
+			case "test":
+				continue
+			case "move":
+				touched = append(touched, op.From)
+			}
+			for _, p := range touched {
+				if seg := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]; seg != "" {
+					fields = append(fields, unescapePointer(seg))
+				}
+			}
+		}
+	default:
+		w.Header().Set("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+		writeError(w, r, "send a JSON Merge Patch or a JSON Patch", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	b, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(b, dst)
+	}
+	if err != nil {
+		writeError(w, r, "patched document is not a valid record: "+err.Error(), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	return fields, true
+}
+
+// mergePatch applies an RFC 7396 merge patch: objects merge key by key, null
+// removes a key and anything else replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+var errPatchTest = fmt.Errorf("a test operation of the patch failed")
+
+// applyJSONPatch applies RFC 6902 operations in order; any failure leaves
+// the record unchanged
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = pointerSet(doc, op.Path, op.Value, true)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			if _, err = pointerGet(doc, op.Path); err == nil {
+				doc, err = pointerSet(doc, op.Path, op.Value, false)
+			}
+		case "move", "copy":
+			var v interface{}
+			if op.Op == "move" {
+				doc, v, err = pointerRemove(doc, op.From)
+			} else {
+				v, err = pointerGet(doc, op.From)
+			}
+			if err == nil {
+				doc, err = pointerSet(doc, op.Path, v, true)
+			}
+		case "test":
+			var v interface{}
+			if v, err = pointerGet(doc, op.Path); err == nil && !reflect.DeepEqual(v, op.Value) {
+				return nil, errPatchTest
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("patch operation %d: %v", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func splitPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("path %q must start with /", p)
+	}
+	parts := strings.Split(p[1:], "/")
+	for i := range parts {
+		parts[i] = unescapePointer(parts[i])
+	}
+	return parts, nil
+}
+
+func unescapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+func pointerGet(doc interface{}, p string) (interface{}, error) {
+	parts, err := splitPointer(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range parts {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[k]
+			if !ok {
+				return nil, fmt.Errorf("path %q does not exist", p)
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("path %q does not exist", p)
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", p)
+		}
+	}
+	return doc, nil
+}
+
+// pointerSet sets the value at p and returns the new document. insert adds
+// to arrays (with "-" for the end) instead of replacing an element.
+func pointerSet(doc interface{}, p string, v interface{}, insert bool) (interface{}, error) {
+	parts, err := splitPointer(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return v, nil
+	}
+	parentPath := "/" + strings.Join(escapeAll(parts[:len(parts)-1]), "/")
+	parent := doc
+	if len(parts) > 1 {
+		if parent, err = pointerGet(doc, parentPath); err != nil {
+			return nil, err
+		}
+	}
+	last := parts[len(parts)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		c[last] = v
+		return doc, nil
+	case []interface{}:
+		i := len(c)
+		if last != "-" {
+			if i, err = strconv.Atoi(last); err != nil || i < 0 || i > len(c) || (!insert && i == len(c)) {
+				return nil, fmt.Errorf("path %q does not exist", p)
+			}
+		} else if !insert {
+			return nil, fmt.Errorf("path %q does not exist", p)
+		}
+		if insert {
+			c = append(c[:i], append([]interface{}{v}, c[i:]...)...)
+		} else {
+			c[i] = v
+		}
+		if len(parts) == 1 {
+			return c, nil
+		}
+		return pointerSet(doc, parentPath, c, false)
+	}
+	return nil, fmt.Errorf("path %q does not exist", p)
+}
+
+func pointerRemove(doc interface{}, p string) (interface{}, interface{}, error) {
+	old, err := pointerGet(doc, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts, _ := splitPointer(p)
+	if len(parts) == 0 {
+		return nil, old, nil
+	}
+	parentPath := "/" + strings.Join(escapeAll(parts[:len(parts)-1]), "/")
+	parent := doc
+	if len(parts) > 1 {
+		parent, _ = pointerGet(doc, parentPath)
+	}
+	last := parts[len(parts)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		delete(c, last)
+		return doc, old, nil
+	case []interface{}:
+		i, _ := strconv.Atoi(last)
+		c = append(c[:i:i], c[i+1:]...)
+		if len(parts) == 1 {
+			return c, old, nil
+		}
+		doc, err = pointerSet(doc, parentPath, c, false)
+		return doc, old, err
+	}
+	return nil, nil, fmt.Errorf("path %q does not exist", p)
+}
+
+func escapeAll(parts []string) []string {
+	out := make([]string, len(parts))
+	for i, s := range parts {
+		out[i] = strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+	}
+	return out
+}
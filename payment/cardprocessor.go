@@ -0,0 +1,196 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the webhook signature: "t=<unix>,v1=<hex hmac>"
+const SignatureHeader = "X-Processor-Signature"
+
+// webhookTolerance bounds how old a signed webhook may be, to limit replays
+const webhookTolerance = 5 * time.Minute
+
+// ErrBadSignature is returned for webhooks that fail verification
+var ErrBadSignature = errors.New("payment: invalid webhook signature")
+
+// CardProcessor talks to an online card processor over HTTP. Charges are
+// created with the processor's idempotency support and usually come back
+// pending; the final outcome is delivered to the webhook endpoint.
+type CardProcessor struct {
+	BaseURL       string
+	APIKey        string
+	WebhookSecret string
+	Client        *http.Client
+}
+
+// NewCardProcessor returns a processor client for baseURL
+func NewCardProcessor(baseURL, apiKey, webhookSecret string) *CardProcessor {
+	return &CardProcessor{
+		BaseURL:       strings.TrimRight(baseURL, "/"),
+		APIKey:        apiKey,
+		WebhookSecret: webhookSecret,
+		Client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (c *CardProcessor) Name() string {
+	return "card"
+}
+
+type chargeRequest struct {
+	Amount   int64             `json:"amount"`
+	Currency string            `json:"currency"`
+	Source   string            `json:"source"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type refundRequest struct {
+	Charge string `json:"charge"`
+	Amount int64  `json:"amount"`
+}
+
+type processorObject struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type webhookPayload struct {
+	Type string          `json:"type"`
+	Data processorObject `json:"data"`
+}
+
+func (c *CardProcessor) Capture(ctx context.Context, req CaptureRequest) (Result, error) {
+	if req.Token == "" {
+		return Result{}, errors.New("payment: card token is required")
+	}
+	return c.post(ctx, "/v1/charges", req.IdempotencyKey, chargeRequest{
+		Amount:   req.AmountCents,
+		Currency: strings.ToLower(req.Currency),
+		Source:   req.Token,
+		Metadata: map[string]string{"invoice_id": strconv.Itoa(req.InvoiceID)},
+	})
+}
+
+func (c *CardProcessor) Refund(ctx context.Context, req RefundRequest) (Result, error) {
+	return c.post(ctx, "/v1/refunds", req.IdempotencyKey, refundRequest{
+		Charge: req.Reference,
+		Amount: req.AmountCents,
+	})
+}
+
+func (c *CardProcessor) post(ctx context.Context, path, idempotencyKey string, body interface{}) (Result, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return Result{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(buf))
+	if err != nil {
+		return Result{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	httpReq.Header.Set("Idempotency-Key", idempotencyKey)
+
+	resp, err := c.Client.Do(httpReq)
+	if err != nil {
+		return Result{}, fmt.Errorf("payment: processor request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Result{}, fmt.Errorf("payment: processor returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var obj processorObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return Result{}, fmt.Errorf("payment: invalid processor response: %w", err)
+	}
+	return Result{Reference: obj.ID, Status: normaliseStatus(obj.Status)}, nil
+}
+
+// ParseWebhook verifies the signature and timestamp of a processor webhook
+// and returns the payment outcome it reports
+func (c *CardProcessor) ParseWebhook(r *http.Request) (Event, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return Event{}, err
+	}
+	if err := VerifySignature(c.WebhookSecret, r.Header.Get(SignatureHeader), body, time.Now()); err != nil {
+		return Event{}, err
+	}
+
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Event{}, fmt.Errorf("payment: invalid webhook body: %w", err)
+	}
+	if p.Data.ID == "" {
+		return Event{}, errors.New("payment: webhook without object id")
+	}
+	return Event{Reference: p.Data.ID, Status: normaliseStatus(p.Data.Status)}, nil
+}
+
+// Sign returns the signature header value for body at time t
+func Sign(secret string, body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(computeMAC(secret, ts, body))
+}
+
+// VerifySignature checks a signature header produced by Sign
+func VerifySignature(secret, header string, body []byte, now time.Time) error {
+	if secret == "" {
+		return ErrBadSignature
+	}
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return ErrBadSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, computeMAC(secret, ts, body)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func computeMAC(secret, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func normaliseStatus(s string) string {
+	switch s {
+	case "succeeded", "paid", "captured":
+		return StatusSucceeded
+	case "failed", "declined", "canceled":
+		return StatusFailed
+	default:
+		return StatusPending
+	}
+}
@@ -0,0 +1,149 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+// startFake runs a FakeProcessor whose webhooks are parsed by the returned
+// CardProcessor and delivered on the channel
+func startFake(t *testing.T) (*CardProcessor, <-chan Event) {
+	t.Helper()
+	events := make(chan Event, 10)
+	var card *CardProcessor
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev, err := card.ParseWebhook(r)
+		if err != nil {
+			t.Errorf("webhook rejected: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- ev
+	}))
+	t.Cleanup(hook.Close)
+
+	fake := NewFakeProcessor(hook.URL, testSecret)
+	fake.Delay = 10 * time.Millisecond
+	api := httptest.NewServer(fake)
+	t.Cleanup(api.Close)
+
+	card = NewCardProcessor(api.URL, "sk_test", testSecret)
+	return card, events
+}
+
+func waitEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+		return Event{}
+	}
+}
+
+func capture(t *testing.T, card *CardProcessor, token, key string) Result {
+	t.Helper()
+	res, err := card.Capture(context.Background(), CaptureRequest{
+		InvoiceID: 1, AmountCents: 2500, Currency: "USD", Method: "card", Token: token, IdempotencyKey: key,
+	})
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if res.Status != StatusPending || res.Reference == "" {
+		t.Fatalf("Capture = %+v, want a pending charge", res)
+	}
+	return res
+}
+
+func TestCaptureSucceeds(t *testing.T) {
+	card, events := startFake(t)
+	res := capture(t, card, "tok_visa", "key-1")
+
+	ev := waitEvent(t, events)
+	if ev.Reference != res.Reference || ev.Status != StatusSucceeded {
+		t.Fatalf("webhook = %+v, want %s succeeded", ev, res.Reference)
+	}
+
+	ref, err := card.Refund(context.Background(), RefundRequest{Reference: res.Reference, AmountCents: 1000, IdempotencyKey: "key-2"})
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if ev := waitEvent(t, events); ev.Reference != ref.Reference || ev.Status != StatusSucceeded {
+		t.Fatalf("refund webhook = %+v, want %s succeeded", ev, ref.Reference)
+	}
+}
+
+func TestCaptureDeclined(t *testing.T) {
+	card, events := startFake(t)
+	res := capture(t, card, "tok_decline", "key-1")
+
+	ev := waitEvent(t, events)
+	if ev.Reference != res.Reference || ev.Status != StatusFailed {
+		t.Fatalf("webhook = %+v, want %s failed", ev, res.Reference)
+	}
+	if _, err := card.Refund(context.Background(), RefundRequest{Reference: res.Reference, AmountCents: 100, IdempotencyKey: "key-2"}); err == nil {
+		t.Fatal("Refund of a declined charge succeeded")
+	}
+}
+
+func TestCaptureRetryIsIdempotent(t *testing.T) {
+	card, events := startFake(t)
+	first := capture(t, card, "tok_visa", "key-1")
+	retry := capture(t, card, "tok_visa", "key-1")
+	if retry.Reference != first.Reference {
+		t.Fatalf("retry created charge %s, want %s", retry.Reference, first.Reference)
+	}
+
+	waitEvent(t, events)
+	select {
+	case ev := <-events:
+		t.Fatalf("retry settled a second time: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	other := capture(t, card, "tok_visa", "key-2")
+	if other.Reference == first.Reference {
+		t.Fatal("a new key reused the earlier charge")
+	}
+}
+
+func TestParseWebhookRejectsBadSignature(t *testing.T) {
+	card := NewCardProcessor("http://processor.invalid", "sk_test", testSecret)
+	body := []byte(`{"type":"object.succeeded","data":{"id":"ch_000001","status":"succeeded"}}`)
+	now := time.Now()
+
+	cases := map[string]struct {
+		body      []byte
+		signature string
+	}{
+		"missing":      {body, ""},
+		"wrong secret": {body, Sign("whsec_other", body, now)},
+		"altered body": {bytes.Replace(body, []byte("succeeded"), []byte("failed"), 1), Sign(testSecret, body, now)},
+		"too old":      {body, Sign(testSecret, body, now.Add(-time.Hour))},
+		"malformed":    {body, "t=abc,v1=zz"},
+	}
+	for name, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/payments/webhook", bytes.NewReader(c.body))
+		if c.signature != "" {
+			r.Header.Set(SignatureHeader, c.signature)
+		}
+		if _, err := card.ParseWebhook(r); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: err = %v, want ErrBadSignature", name, err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/payments/webhook", bytes.NewReader(body))
+	r.Header.Set(SignatureHeader, Sign(testSecret, body, now))
+	ev, err := card.ParseWebhook(r)
+	if err != nil || ev.Reference != "ch_000001" || ev.Status != StatusSucceeded {
+		t.Fatalf("ParseWebhook = %+v, %v; want ch_000001 succeeded", ev, err)
+	}
+}
@@ -0,0 +1,124 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeProcessor is an in-memory stand-in for the card processor API, for
+// local development and manual testing. Charges and refunds are answered as
+// pending and settled shortly afterwards with a signed webhook to WebhookURL.
+// A source of "tok_decline" is declined; anything else succeeds.
+type FakeProcessor struct {
+	WebhookURL    string
+	WebhookSecret string
+	Delay         time.Duration
+
+	mu      sync.Mutex
+	seq     int
+	byKey   map[string]processorObject
+	objects map[string]processorObject
+}
+
+// NewFakeProcessor returns a fake that reports outcomes to webhookURL
+func NewFakeProcessor(webhookURL, webhookSecret string) *FakeProcessor {
+	return &FakeProcessor{
+		WebhookURL:    webhookURL,
+		WebhookSecret: webhookSecret,
+		Delay:         500 * time.Millisecond,
+		byKey:         map[string]processorObject{},
+		objects:       map[string]processorObject{},
+	}
+}
+
+func (f *FakeProcessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var outcome, prefix string
+	switch r.URL.Path {
+	case "/v1/charges":
+		var req chargeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+			http.Error(w, "invalid charge", http.StatusBadRequest)
+			return
+		}
+		prefix, outcome = "ch", "succeeded"
+		if req.Source == "tok_decline" {
+			outcome = "failed"
+		}
+	case "/v1/refunds":
+		var req refundRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+			http.Error(w, "invalid refund", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		charge, ok := f.objects[req.Charge]
+		f.mu.Unlock()
+		if !ok || charge.Status != "succeeded" {
+			http.Error(w, "no such charge", http.StatusBadRequest)
+			return
+		}
+		prefix, outcome = "re", "succeeded"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	f.mu.Lock()
+	obj, replay := f.byKey[key]
+	if !replay {
+		f.seq++
+		obj = processorObject{ID: fmt.Sprintf("%s_%06d", prefix, f.seq), Status: "pending"}
+		f.objects[obj.ID] = obj
+		if key != "" {
+			f.byKey[key] = obj
+		}
+	}
+	f.mu.Unlock()
+
+	if !replay {
+		go f.settle(obj.ID, outcome)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *FakeProcessor) settle(id, outcome string) {
+	time.Sleep(f.Delay)
+	f.mu.Lock()
+	obj := f.objects[id]
+	obj.Status = outcome
+	f.objects[id] = obj
+	f.mu.Unlock()
+
+	body, _ := json.Marshal(webhookPayload{Type: "object." + outcome, Data: obj})
+	req, err := http.NewRequest(http.MethodPost, f.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("fake processor: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(f.WebhookSecret, body, time.Now()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("fake processor: webhook for %s failed: %v", id, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("fake processor: %s %s, webhook answered %d", id, outcome, resp.StatusCode)
+}
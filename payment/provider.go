@@ -0,0 +1,67 @@
+// Package payment defines the PaymentProvider abstraction used to capture and
+// refund invoice payments, together with the providers the clinic supports.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Result statuses reported by providers
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrUnknownReference is returned when a provider does not recognise a
+// payment reference
+var ErrUnknownReference = errors.New("payment: unknown reference")
+
+// CaptureRequest asks a provider to collect AmountCents for an invoice.
+// Providers must treat IdempotencyKey so that retrying the same request never
+// charges twice.
+type CaptureRequest struct {
+	InvoiceID      int
+	AmountCents    int64
+	Currency       string
+	Method         string
+	Token          string
+	IdempotencyKey string
+}
+
+// RefundRequest asks a provider to return AmountCents of an earlier capture
+type RefundRequest struct {
+	Reference      string
+	AmountCents    int64
+	Currency       string
+	IdempotencyKey string
+}
+
+// Result is a provider's answer to a capture or refund. Status is pending when
+// the final outcome will arrive later through a webhook.
+type Result struct {
+	Reference string
+	Status    string
+}
+
+// Event is a payment outcome delivered asynchronously by a provider
+type Event struct {
+	Reference string
+	Status    string
+}
+
+// PaymentProvider captures and refunds payments
+type PaymentProvider interface {
+	Name() string
+	Capture(ctx context.Context, req CaptureRequest) (Result, error)
+	Refund(ctx context.Context, req RefundRequest) (Result, error)
+}
+
+// WebhookProvider is implemented by providers that report outcomes
+// asynchronously. ParseWebhook authenticates the request and decodes it.
+type WebhookProvider interface {
+	PaymentProvider
+	ParseWebhook(r *http.Request) (Event, error)
+}
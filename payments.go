@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"petclinic/data"
+	"petclinic/logger"
+	"petclinic/payment"
+)
+
+// paymentProviders holds the configured providers by name
+var paymentProviders = map[string]payment.PaymentProvider{}
+
+// initPaymentProviders registers the manual provider and, when
+// CARD_PROCESSOR_URL is set, the online card processor
+func initPaymentProviders() {
+	manual := payment.NewManual()
+	paymentProviders[manual.Name()] = manual
+
+	if url := os.Getenv("CARD_PROCESSOR_URL"); url != "" {
+		card := payment.NewCardProcessor(url, os.Getenv("CARD_PROCESSOR_API_KEY"), os.Getenv("CARD_PROCESSOR_WEBHOOK_SECRET"))
+		paymentProviders[card.Name()] = card
+		logger.Info("Card processor configured at %s", url)
+	}
+}
+
+type paymentRequest struct {
+	AmountCents    int64  `json:"amount_cents"`
+	Method         string `json:"method"`
+	Provider       string `json:"provider"`
+	Token          string `json:"token"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type refundPaymentRequest struct {
+	PaymentID      int    `json:"payment_id"`
+	AmountCents    int64  `json:"amount_cents"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+func paymentFromRow(p data.PaymentRow) Payment {
+	return Payment{
+		ID:             p.ID,
+		InvoiceID:      p.InvoiceID,
+		Kind:           p.Kind,
+		Provider:       p.Provider,
+		Method:         p.Method,
+		AmountCents:    p.AmountCents,
+		Status:         p.Status,
+		Reference:      p.Reference,
+		IdempotencyKey: p.IdempotencyKey,
+		RefundOf:       p.RefundOf,
+		CreatedAt:      p.CreatedAt,
+	}
+}
+
+// idempotencyKey prefers the Idempotency-Key header, then the body field.
+// Without either a random key is used, so the request is not retry-safe.
+func idempotencyKey(r *http.Request, fromBody string) (string, error) {
+	if k := r.Header.Get("Idempotency-Key"); k != "" {
+		return k, nil
+	}
+	if fromBody != "" {
+		return fromBody, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writePaymentError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, data.ErrAmountExceedsBalance):
+		writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, data.ErrIdempotencyKeyReuse):
+		writeError(w, r, err.Error(), http.StatusConflict)
+	default:
+		writeInvoiceError(w, r, err, action)
+	}
+}
+
+// finishPayment applies a provider result to a pending payment and writes
+// the payment back to the client
+func finishPayment(w http.ResponseWriter, r *http.Request, p data.PaymentRow, res payment.Result, providerErr error) {
+	if providerErr != nil {
+		logger.ErrorCtx(r.Context(), "Provider %s rejected payment %d: %v", p.Provider, p.ID, providerErr)
+		if err := data.CompletePayment(DB, actorOf(r), p.ID, data.PaymentFailed, ""); err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to mark payment %d failed: %v", p.ID, err)
+		}
+		writeError(w, r, "payment provider error", http.StatusBadGateway)
+		return
+	}
+
+	var err error
+	if res.Status == payment.StatusPending {
+		// The outcome arrives by webhook, which finds the payment by reference
+		err = data.SetPaymentReference(DB, actorOf(r), p.ID, res.Reference)
+	} else {
+		err = data.CompletePayment(DB, actorOf(r), p.ID, res.Status, res.Reference)
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to record provider result for payment %d: %v", p.ID, err)
+		writeError(w, r, "failed to record payment", http.StatusInternalServerError)
+		return
+	}
+
+	p, err = data.GetPaymentByID(DB, tenantOf(r), p.ID)
+	if err != nil {
+		dataError(w, r, err, "payment")
+		return
+	}
+	logger.InfoCtx(r.Context(), "Payment %d on invoice %d is %s", p.ID, p.InvoiceID, p.Status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(paymentFromRow(p))
+}
+
+// GetInvoicePayments lists payments and refunds recorded on an invoice
+func GetInvoicePayments(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := data.ListPaymentsByInvoice(DB, tenantOf(r), id)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch payments for invoice %d: %v", id, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	payments := make([]Payment, len(rows))
+	for i, p := range rows {
+		payments[i] = paymentFromRow(p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payments)
+}
+
+// RecordPayment captures a full or partial payment on an issued invoice.
+// Retrying with the same idempotency key returns the original payment.
+func RecordPayment(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req paymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.AmountCents <= 0 {
+		writeError(w, r, "amount_cents must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = "manual"
+	}
+	if req.Method == "" {
+		req.Method = "cash"
+	}
+	provider, ok := paymentProviders[req.Provider]
+	if !ok {
+		writeError(w, r, "unknown payment provider", http.StatusBadRequest)
+		return
+	}
+
+	inv, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+
+	key, err := idempotencyKey(r, req.IdempotencyKey)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to generate idempotency key: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p, created, err := data.BeginPayment(DB, tenantOf(r), actorOf(r), data.PaymentInput{
+		InvoiceID:      id,
+		Kind:           data.PaymentKindPayment,
+		Provider:       provider.Name(),
+		Method:         req.Method,
+		AmountCents:    req.AmountCents,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		writePaymentError(w, r, err, "record payment")
+		return
+	}
+	if !created {
+		logger.InfoCtx(r.Context(), "Replaying payment %d for idempotency key", p.ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(paymentFromRow(p))
+		return
+	}
+
+	res, err := provider.Capture(r.Context(), payment.CaptureRequest{
+		InvoiceID:      id,
+		AmountCents:    p.AmountCents,
+		Currency:       inv.Currency,
+		Method:         p.Method,
+		Token:          req.Token,
+		IdempotencyKey: p.IdempotencyKey,
+	})
+	finishPayment(w, r, p, res, err)
+}
+
+// RefundPayment returns all or part of a successful payment through the
+// provider that captured it
+func RefundPayment(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid invoice ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req refundPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.PaymentID == 0 || req.AmountCents <= 0 {
+		writeError(w, r, "payment_id and a positive amount_cents are required", http.StatusBadRequest)
+		return
+	}
+
+	original, err := data.GetPaymentByID(DB, tenantOf(r), req.PaymentID)
+	if err != nil {
+		dataError(w, r, err, "payment")
+		return
+	}
+	if original.InvoiceID != id {
+		writeError(w, r, "payment not found", http.StatusNotFound)
+		return
+	}
+	provider, ok := paymentProviders[original.Provider]
+	if !ok {
+		logger.ErrorCtx(r.Context(), "Provider %s for payment %d is not configured", original.Provider, original.ID)
+		writeError(w, r, "payment provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	inv, err := data.GetInvoiceByID(DB, tenantOf(r), id)
+	if err != nil {
+		writeInvoiceError(w, r, err, "fetch invoice")
+		return
+	}
+
+	key, err := idempotencyKey(r, req.IdempotencyKey)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to generate idempotency key: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p, created, err := data.BeginPayment(DB, tenantOf(r), actorOf(r), data.PaymentInput{
+		InvoiceID:      id,
+		Kind:           data.PaymentKindRefund,
+		Provider:       original.Provider,
+		Method:         original.Method,
+		AmountCents:    req.AmountCents,
+		IdempotencyKey: key,
+		RefundOf:       original.ID,
+	})
+	if err != nil {
+		writePaymentError(w, r, err, "record refund")
+		return
+	}
+	if !created {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(paymentFromRow(p))
+		return
+	}
+
+	res, err := provider.Refund(r.Context(), payment.RefundRequest{
+		Reference:      original.Reference,
+		AmountCents:    p.AmountCents,
+		Currency:       inv.Currency,
+		IdempotencyKey: p.IdempotencyKey,
+	})
+	finishPayment(w, r, p, res, err)
+}
+
+// PaymentWebhook receives asynchronous outcomes from a provider. It is not
+// behind AuthMiddleware; providers authenticate by signing the request.
+func PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("provider")
+	if name == "" {
+		name = "card"
+	}
+	provider, ok := paymentProviders[name].(payment.WebhookProvider)
+	if !ok {
+		writeError(w, r, "unknown payment provider", http.StatusNotFound)
+		return
+	}
+
+	ev, err := provider.ParseWebhook(r)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Rejected %s webhook: %v", name, err)
+		writeError(w, r, "invalid webhook", http.StatusBadRequest)
+		return
+	}
+	if ev.Status == payment.StatusPending {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = data.CompletePaymentByReference(DB, actorOf(r), provider.Name(), ev.Reference, ev.Status)
+	if errors.Is(err, data.ErrNotFound) {
+		// The webhook can beat the capture response; a 404 makes the provider retry
+		logger.WarnCtx(r.Context(), "Webhook for unknown %s reference %s", name, ev.Reference)
+		writeError(w, r, "unknown reference", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to apply %s webhook for %s: %v", name, ev.Reference, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Payment %s reported %s by %s", ev.Reference, ev.Status, name)
+	w.WriteHeader(http.StatusNoContent)
+}
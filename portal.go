@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// ownerInvitationTTL is how long an invitation link stays valid
+const ownerInvitationTTL = 72 * time.Hour
+
+type acceptInvitationRequest struct {
+	Token    string `json:"token"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// CreateOwnerInvitation generates a one-time link that lets the owner
+// create a portal account for an existing owner record
+func CreateOwnerInvitation(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid owner ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetOwnerByID(DB, tenantOf(r), id, false); err != nil {
+		dataError(w, r, err, "owner")
+		return
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to generate invitation token: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	inv, err := data.CreateOwnerInvitation(DB, actorOf(r), id, hash, time.Now().Add(ownerInvitationTTL))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to create invitation for owner %d: %v", id, err)
+		dataError(w, r, err, "invitation")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Created portal invitation %d for owner %d", inv.ID, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"owner_id":   id,
+		"url":        tokenLink("PORTAL_INVITE_URL", "http://localhost:8080/auth/accept-invitation", token),
+		"expires_at": inv.ExpiresAt,
+	})
+}
+
+// AcceptInvitation redeems an invitation token and creates the owner
+// account
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req acceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("Invalid invitation request: %v", err)
+		writeError(w, r, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Email == "" || req.Password == "" {
+		writeError(w, r, "token, email and password are required", http.StatusBadRequest)
+		return
+	}
+	if !checkNewPassword(w, r, req.Password, req.Email, "password") {
+		return
+	}
+
+	exists, err := data.EmailExists(DB, req.Email)
+	if err != nil {
+		logger.Error("Failed to check email %s: %v", req.Email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		writeError(w, r, "email is already registered", http.StatusConflict)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		logger.Error("Failed to hash password: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := data.AcceptOwnerInvitation(DB, actorOf(r), hashSecretToken(req.Token), req.Email, hash)
+	if err != nil {
+		if errors.Is(err, data.ErrInvitationInvalid) {
+			logger.Warn("Rejected portal invitation for %s", req.Email)
+			writeError(w, r, err.Error(), http.StatusGone)
+			return
+		}
+		logger.Error("Failed to accept invitation for %s: %v", req.Email, err)
+		writeError(w, r, "failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Owner portal account %s (ID: %d) created for owner %d", user.Email, user.ID, *user.OwnerID)
+	respondNewAccount(w, r, user, http.StatusCreated)
+}
+
+// -------------------- Owner portal --------------------
+
+// GetMyPets lists the signed-in owner's pets
+func GetMyPets(w http.ResponseWriter, r *http.Request) {
+	ownerID, _ := r.Context().Value(ctxOwnerIDKey).(int)
+	rows, err := data.ListPetsByOwner(DB, tenantOf(r), ownerID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch pets for owner %d: %v", ownerID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	pets := make([]Pet, len(rows))
+	for i, rp := range rows {
+		pets[i] = petFromRow(rp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pets)
+}
+
+// GetMyVisits lists the visits of the signed-in owner's pets
+func GetMyVisits(w http.ResponseWriter, r *http.Request) {
+	ownerID, _ := r.Context().Value(ctxOwnerIDKey).(int)
+	rows, err := data.ListVisitsByOwner(DB, tenantOf(r), ownerID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch visits for owner %d: %v", ownerID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	visits := make([]Visit, len(rows))
+	for i, rv := range rows {
+		visits[i] = Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visits)
+}
+
+// GetMyInvoices lists the signed-in owner's invoices, leaving out drafts
+// that have not been issued yet
+func GetMyInvoices(w http.ResponseWriter, r *http.Request) {
+	ownerID, _ := r.Context().Value(ctxOwnerIDKey).(int)
+	rows, err := data.ListInvoicesByOwner(DB, tenantOf(r), ownerID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch invoices for owner %d: %v", ownerID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	balance, err := data.OwnerBalance(DB, tenantOf(r), ownerID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to compute balance for owner %d: %v", ownerID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	invoices := []Invoice{}
+	for _, ri := range rows {
+		if ri.Status == data.InvoiceDraft {
+			continue
+		}
+		invoices = append(invoices, invoiceFromRow(ri))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"balance_cents": balance,
+		"invoices":      invoices,
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// Problem is the body of every error response, an RFC 7807 problem details
+// object served as application/problem+json
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is one invalid field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// problemTypeValidation is the type of problems listing invalid fields; the
+// others use about:blank, so their title is the HTTP status text
+const problemTypeValidation = "/problems/validation"
+
+// writeProblem fills in what p leaves out and writes it
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.RequestID == "" {
+		p.RequestID = requestIDOf(r)
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeError answers with a problem of the given status; detail says what
+// went wrong in terms the client can act on
+func writeError(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	writeProblem(w, r, Problem{Status: status, Detail: detail})
+}
+
+// writeFieldErrors answers with the invalid fields of a request body
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, detail string, status int, errs []FieldError) {
+	writeProblem(w, r, Problem{
+		Type:   problemTypeValidation,
+		Title:  "Invalid request",
+		Status: status,
+		Detail: detail,
+		Errors: errs,
+	})
+}
+
+// problemWriter turns the plain-text 404 and 405 answers of a ServeMux into
+// problems, keeping headers such as Allow
+type problemWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	written bool
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if status < 400 {
+		p.ResponseWriter.WriteHeader(status)
+		return
+	}
+	writeError(p.ResponseWriter, p.r, strings.ToLower(http.StatusText(status)), status)
+	p.written = true
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.written {
+		return len(b), nil
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// requestIDMiddleware gives every request an id, taken from a well-formed
+// X-Request-ID header or generated, and echoes it in the response. Logs and
+// problems carry it so a client's report can be matched to the logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), logger.CtxRequestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(logger.CtxRequestIDKey).(string)
+	return id
+}
+
+// dataError answers an error of the data package: a missing record 404, a
+// duplicate or a record still in use 409, a reference to a missing record
+// 422 and a database outage 503. what names the record in the detail.
+func dataError(w http.ResponseWriter, r *http.Request, err error, what string) {
+	switch {
+	case tenantError(w, r, err):
+	case errors.Is(err, data.ErrNotFound):
+		writeError(w, r, what+" not found", http.StatusNotFound)
+	case errors.Is(err, data.ErrVersionMismatch):
+		writeError(w, r, what+" was changed since you read it; fetch it again", http.StatusPreconditionFailed)
+	case errors.Is(err, data.ErrNotDeleted):
+		writeError(w, r, what+" is not deleted", http.StatusConflict)
+	case errors.Is(err, data.ErrParentDeleted):
+		writeError(w, r, what+" belongs to a deleted record; restore that first", http.StatusConflict)
+	case errors.Is(err, data.ErrInUse):
+		writeError(w, r, what+" is still referenced by other records", http.StatusConflict)
+	case errors.Is(err, data.ErrConflict):
+		writeError(w, r, what+" conflicts with an existing record", http.StatusConflict)
+	case errors.Is(err, data.ErrForeignKey):
+		writeError(w, r, "a referenced record does not exist", http.StatusUnprocessableEntity)
+	case errors.Is(err, data.ErrUnavailable):
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, "database unavailable, try again later", http.StatusServiceUnavailable)
+	default:
+		logger.ErrorCtx(r.Context(), "Unexpected error with %s: %v", what, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"petclinic/logger"
+)
+
+// registerRoutes adds every endpoint to mux. Patterns name their method, so
+// the mux itself answers other methods with 405 and an Allow header. Creates
+// are wrapped in Idempotent so that clients can retry them safely.
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /.well-known/jwks.json", GetJWKS)
+
+	// Authentication
+	mux.HandleFunc("POST /auth/register", Register)
+	mux.HandleFunc("POST /auth/login", Login)
+	mux.HandleFunc("POST /auth/login/mfa", LoginMFA)
+
+	// Two-factor enrollment also accepts the enrollment-only login token
+	mux.HandleFunc("GET /auth/mfa", MFAEnrollMiddleware(GetMFAStatus))
+	mux.HandleFunc("DELETE /auth/mfa", MFAEnrollMiddleware(DisableMFA))
+	mux.HandleFunc("POST /auth/mfa/enroll", MFAEnrollMiddleware(EnrollMFA))
+	mux.HandleFunc("POST /auth/mfa/confirm", MFAEnrollMiddleware(ConfirmMFA))
+	mux.HandleFunc("POST /auth/mfa/recovery-codes", MFAEnrollMiddleware(RegenerateRecoveryCodes))
+
+	mux.HandleFunc("GET /auth/oidc/login", OIDCLogin)
+	mux.HandleFunc("GET /auth/oidc/callback", OIDCCallback)
+
+	mux.HandleFunc("GET /auth/verify-email", VerifyEmail)
+	mux.HandleFunc("POST /auth/verify-email", VerifyEmail)
+	mux.HandleFunc("POST /auth/resend-verification", ResendVerification)
+	mux.HandleFunc("POST /auth/forgot-password", ForgotPassword)
+	mux.HandleFunc("POST /auth/reset-password", ResetPassword)
+	mux.HandleFunc("POST /auth/accept-invitation", AcceptInvitation)
+
+	// Owners
+	mux.HandleFunc("GET /owners", AuthMiddleware(GetOwners))
+	mux.HandleFunc("POST /owners", AuthMiddleware(Idempotent(CreateOwner)))
+	mux.HandleFunc("GET /owners/{id}", AuthMiddleware(GetOwnerByID))
+	mux.HandleFunc("PUT /owners/{id}", AuthMiddleware(UpdateOwner))
+	mux.HandleFunc("PATCH /owners/{id}", AuthMiddleware(PatchOwner))
+	mux.HandleFunc("DELETE /owners/{id}", AuthMiddleware(DeleteOwner))
+	mux.HandleFunc("POST /owners/{id}/restore", AdminMiddleware(RestoreOwner))
+	mux.HandleFunc("GET /owners/{id}/pets", AuthMiddleware(GetOwnerPets))
+	mux.HandleFunc("GET /owners/{id}/invoices", AuthMiddleware(GetOwnerInvoices))
+	mux.HandleFunc("POST /owners/{id}/invitations", AuthMiddleware(CreateOwnerInvitation))
+
+	// Files (local storage)
+	mux.HandleFunc("GET /files", AuthMiddleware(DownloadFile))
+	mux.HandleFunc("POST /files", AuthMiddleware(UploadFile))
+
+	// Pets
+	mux.HandleFunc("GET /pets", AuthMiddleware(GetPets))
+	mux.HandleFunc("POST /pets", AuthMiddleware(Idempotent(CreatePet)))
+	mux.HandleFunc("GET /pets/{id}", AuthMiddleware(GetPetByID))
+	mux.HandleFunc("PUT /pets/{id}", AuthMiddleware(UpdatePet))
+	mux.HandleFunc("PATCH /pets/{id}", AuthMiddleware(PatchPet))
+	mux.HandleFunc("DELETE /pets/{id}", AuthMiddleware(DeletePet))
+	mux.HandleFunc("POST /pets/{id}/restore", AdminMiddleware(RestorePet))
+	mux.HandleFunc("GET /pets/{id}/visits", AuthMiddleware(GetPetVisits))
+
+	// Vets
+	mux.HandleFunc("GET /vets", AuthMiddleware(GetVets))
+	mux.HandleFunc("POST /vets", AuthMiddleware(Idempotent(CreateVet)))
+	mux.HandleFunc("GET /vets/{id}", AuthMiddleware(GetVetByID))
+	mux.HandleFunc("PUT /vets/{id}", AuthMiddleware(UpdateVet))
+	mux.HandleFunc("PATCH /vets/{id}", AuthMiddleware(PatchVet))
+	mux.HandleFunc("DELETE /vets/{id}", AuthMiddleware(DeleteVet))
+	mux.HandleFunc("POST /vets/{id}/restore", AdminMiddleware(RestoreVet))
+
+	// Visits
+	mux.HandleFunc("GET /visits", AuthMiddleware(GetVisits))
+	mux.HandleFunc("POST /visits", AuthMiddleware(Idempotent(CreateVisit)))
+	mux.HandleFunc("GET /visits/{id}", AuthMiddleware(GetVisitByID))
+	mux.HandleFunc("PUT /visits/{id}", AuthMiddleware(UpdateVisit))
+	mux.HandleFunc("PATCH /visits/{id}", AuthMiddleware(PatchVisit))
+	mux.HandleFunc("DELETE /visits/{id}", AuthMiddleware(DeleteVisit))
+	mux.HandleFunc("POST /visits/{id}/restore", AdminMiddleware(RestoreVisit))
+
+	// Audit trail
+	mux.HandleFunc("GET /audit", AdminMiddleware(GetAuditEvents))
+
+	// Service catalog. The catalogs are shared by every clinic, so only
+	// super-admins change them.
+	mux.HandleFunc("GET /services", AuthMiddleware(GetServices))
+	mux.HandleFunc("POST /services", SuperAdminMiddleware(CreateService))
+	mux.HandleFunc("GET /services/{id}", AuthMiddleware(GetServiceByID))
+	mux.HandleFunc("PUT /services/{id}", SuperAdminMiddleware(UpdateService))
+	mux.HandleFunc("DELETE /services/{id}", SuperAdminMiddleware(DeleteService))
+
+	// Invoices and payments
+	mux.HandleFunc("GET /invoices", AuthMiddleware(GetInvoices))
+	mux.HandleFunc("POST /invoices", AuthMiddleware(Idempotent(CreateInvoice)))
+	mux.HandleFunc("GET /invoices/{id}", AuthMiddleware(GetInvoiceByID))
+	mux.HandleFunc("PUT /invoices/{id}", AuthMiddleware(UpdateInvoice))
+	mux.HandleFunc("POST /invoices/{id}/lines", AuthMiddleware(AddInvoiceLine))
+	mux.HandleFunc("POST /invoices/{id}/issue", AuthMiddleware(IssueInvoice))
+	mux.HandleFunc("POST /invoices/{id}/void", AuthMiddleware(VoidInvoice))
+	mux.HandleFunc("GET /invoices/{id}/payments", AuthMiddleware(GetInvoicePayments))
+	mux.HandleFunc("POST /invoices/{id}/payments", AuthMiddleware(RecordPayment))
+	mux.HandleFunc("POST /invoices/{id}/refunds", AuthMiddleware(RefundPayment))
+
+	// Provider webhooks are signed by the provider instead of carrying a JWT
+	mux.HandleFunc("POST /payments/webhook", PaymentWebhook)
+
+	// Inventory
+	mux.HandleFunc("GET /inventory/items", AuthMiddleware(GetStockItems))
+	mux.HandleFunc("POST /inventory/items", AuthMiddleware(CreateStockItem))
+	mux.HandleFunc("GET /inventory/items/{id}", AuthMiddleware(GetStockItemByID))
+	mux.HandleFunc("PUT /inventory/items/{id}", AuthMiddleware(UpdateStockItem))
+	mux.HandleFunc("GET /inventory/locations", AuthMiddleware(GetStockLocations))
+	mux.HandleFunc("POST /inventory/locations", AuthMiddleware(CreateStockLocation))
+	mux.HandleFunc("POST /inventory/receive", AuthMiddleware(ReceiveStock))
+	mux.HandleFunc("POST /inventory/adjust", AuthMiddleware(AdjustStock))
+	mux.HandleFunc("GET /inventory/low-stock", AuthMiddleware(GetLowStock))
+	mux.HandleFunc("GET /inventory/expiring", AuthMiddleware(GetExpiringStock))
+
+	// Prescriptions
+	mux.HandleFunc("GET /prescriptions", AuthMiddleware(GetPrescriptions))
+	mux.HandleFunc("POST /prescriptions", AuthMiddleware(Idempotent(CreatePrescription)))
+
+	// Lab orders and results
+	mux.HandleFunc("GET /lab/orders", AuthMiddleware(GetLabOrders))
+	mux.HandleFunc("POST /lab/orders", AuthMiddleware(Idempotent(CreateLabOrder)))
+	mux.HandleFunc("GET /lab/orders/{id}", AuthMiddleware(GetLabOrderByID))
+	mux.HandleFunc("DELETE /lab/orders/{id}", AuthMiddleware(CancelLabOrder))
+	mux.HandleFunc("POST /lab/results/import", AuthMiddleware(ImportLabResults))
+	mux.HandleFunc("GET /lab/reference-ranges", AuthMiddleware(GetReferenceRanges))
+	mux.HandleFunc("PUT /lab/reference-ranges", SuperAdminMiddleware(PutReferenceRange))
+
+	// Species and breed catalog
+	mux.HandleFunc("GET /species", AuthMiddleware(GetSpecies))
+	mux.HandleFunc("POST /species", SuperAdminMiddleware(CreateSpecies))
+	mux.HandleFunc("GET /species/{id}", AuthMiddleware(GetSpeciesByID))
+	mux.HandleFunc("PUT /species/{id}", SuperAdminMiddleware(UpdateSpecies))
+	mux.HandleFunc("DELETE /species/{id}", SuperAdminMiddleware(DeleteSpecies))
+	mux.HandleFunc("POST /species/migrate", AuthMiddleware(MigrateSpecies))
+	mux.HandleFunc("GET /breeds", AuthMiddleware(GetBreeds))
+	mux.HandleFunc("POST /breeds", SuperAdminMiddleware(CreateBreed))
+	mux.HandleFunc("GET /breeds/{id}", AuthMiddleware(GetBreedByID))
+	mux.HandleFunc("PUT /breeds/{id}", SuperAdminMiddleware(UpdateBreed))
+	mux.HandleFunc("DELETE /breeds/{id}", SuperAdminMiddleware(DeleteBreed))
+
+	// Owner portal
+	mux.HandleFunc("GET /me/pets", OwnerMiddleware(GetMyPets))
+	mux.HandleFunc("GET /me/visits", OwnerMiddleware(GetMyVisits))
+	mux.HandleFunc("GET /me/invoices", OwnerMiddleware(GetMyInvoices))
+
+	// Accounts
+	mux.HandleFunc("GET /me", UserMiddleware(GetMe))
+	mux.HandleFunc("PUT /me", UserMiddleware(UpdateMe))
+	mux.HandleFunc("POST /me/password", UserMiddleware(ChangePassword))
+	mux.HandleFunc("GET /users", AdminMiddleware(GetUsers))
+	mux.HandleFunc("POST /users", AdminMiddleware(CreateUser))
+	mux.HandleFunc("GET /users/{id}", AdminMiddleware(GetUserByID))
+	mux.HandleFunc("PUT /users/{id}", AdminMiddleware(UpdateUser))
+	mux.HandleFunc("DELETE /users/{id}", AdminMiddleware(DeleteUser))
+	mux.HandleFunc("POST /users/{id}/deactivate", AdminMiddleware(SetUserActive(false)))
+	mux.HandleFunc("POST /users/{id}/activate", AdminMiddleware(SetUserActive(true)))
+
+	// Admin. Lockouts and the MFA policy span every clinic.
+	mux.HandleFunc("GET /admin/lockouts", SuperAdminMiddleware(GetLoginLockouts))
+	mux.HandleFunc("DELETE /admin/lockouts", SuperAdminMiddleware(ClearLoginLockout))
+	mux.HandleFunc("GET /admin/mfa-policy", SuperAdminMiddleware(GetMFAPolicy))
+	mux.HandleFunc("PUT /admin/mfa-policy", SuperAdminMiddleware(PutMFAPolicy))
+	mux.HandleFunc("GET /admin/api-keys", AdminMiddleware(GetAPIKeys))
+	mux.HandleFunc("POST /admin/api-keys", AdminMiddleware(CreateAPIKey))
+	mux.HandleFunc("GET /admin/api-keys/{id}", AdminMiddleware(GetAPIKeyByID))
+	mux.HandleFunc("DELETE /admin/api-keys/{id}", AdminMiddleware(RevokeAPIKey))
+	mux.HandleFunc("GET /admin/api-versions", SuperAdminMiddleware(GetAPIVersions))
+
+	// Clinics
+	mux.HandleFunc("GET /clinics", SuperAdminMiddleware(GetClinics))
+	mux.HandleFunc("POST /clinics", SuperAdminMiddleware(CreateClinic))
+	mux.HandleFunc("GET /clinics/{id}", SuperAdminMiddleware(GetClinicByID))
+	mux.HandleFunc("PUT /clinics/{id}", SuperAdminMiddleware(UpdateClinic))
+}
+
+// queryAlias is a route from before path parameters, which took the id as
+// ?id=. It serves the same handler as the route that replaced it.
+type queryAlias struct {
+	method    string
+	path      string
+	successor string
+}
+
+// queryAliases are kept for a transition period; responses carry a
+// Deprecation header and a Link to the successor
+var queryAliases = []queryAlias{
+	{"GET", "/owners/id", "/owners/{id}"},
+	{"PUT", "/owners/id", "/owners/{id}"},
+	{"DELETE", "/owners/id", "/owners/{id}"},
+	{"GET", "/owners/id/invoices", "/owners/{id}/invoices"},
+	{"POST", "/owners/id/invitations", "/owners/{id}/invitations"},
+	{"GET", "/pets/id", "/pets/{id}"},
+	{"PUT", "/pets/id", "/pets/{id}"},
+	{"DELETE", "/pets/id", "/pets/{id}"},
+	{"GET", "/vets/id", "/vets/{id}"},
+	{"PUT", "/vets/id", "/vets/{id}"},
+	{"DELETE", "/vets/id", "/vets/{id}"},
+	{"GET", "/visits/id", "/visits/{id}"},
+	{"PUT", "/visits/id", "/visits/{id}"},
+	{"DELETE", "/visits/id", "/visits/{id}"},
+	{"GET", "/services/id", "/services/{id}"},
+	{"PUT", "/services/id", "/services/{id}"},
+	{"DELETE", "/services/id", "/services/{id}"},
+	{"GET", "/invoices/id", "/invoices/{id}"},
+	{"PUT", "/invoices/id", "/invoices/{id}"},
+	{"POST", "/invoices/lines", "/invoices/{id}/lines"},
+	{"POST", "/invoices/issue", "/invoices/{id}/issue"},
+	{"POST", "/invoices/void", "/invoices/{id}/void"},
+	{"GET", "/invoices/payments", "/invoices/{id}/payments"},
+	{"POST", "/invoices/payments", "/invoices/{id}/payments"},
+	{"POST", "/invoices/refunds", "/invoices/{id}/refunds"},
+	{"GET", "/inventory/items/id", "/inventory/items/{id}"},
+	{"PUT", "/inventory/items/id", "/inventory/items/{id}"},
+	{"GET", "/lab/orders/id", "/lab/orders/{id}"},
+	{"DELETE", "/lab/orders/id", "/lab/orders/{id}"},
+	{"GET", "/species/id", "/species/{id}"},
+	{"PUT", "/species/id", "/species/{id}"},
+	{"DELETE", "/species/id", "/species/{id}"},
+	{"GET", "/breeds/id", "/breeds/{id}"},
+	{"PUT", "/breeds/id", "/breeds/{id}"},
+	{"DELETE", "/breeds/id", "/breeds/{id}"},
+	{"GET", "/users/id", "/users/{id}"},
+	{"PUT", "/users/id", "/users/{id}"},
+	{"DELETE", "/users/id", "/users/{id}"},
+	{"POST", "/users/deactivate", "/users/{id}/deactivate"},
+	{"POST", "/users/activate", "/users/{id}/activate"},
+	{"GET", "/admin/api-keys/id", "/admin/api-keys/{id}"},
+	{"DELETE", "/admin/api-keys/id", "/admin/api-keys/{id}"},
+	{"GET", "/clinics/id", "/clinics/{id}"},
+	{"PUT", "/clinics/id", "/clinics/{id}"},
+}
+
+// registerQueryAliases routes each alias to the handler of its successor,
+// found by matching a request for the successor with a sample id
+func registerQueryAliases(mux *http.ServeMux) {
+	for _, a := range queryAliases {
+		sample, _ := http.NewRequest(a.method, pathWithID(a.successor, "0"), nil)
+		h, pattern := mux.Handler(sample)
+		if pattern == "" {
+			panic(fmt.Sprintf("alias %s %s: no route for %s", a.method, a.path, a.successor))
+		}
+		mux.Handle(a.method+" "+a.path, deprecatedAlias(a, h))
+	}
+}
+
+func deprecatedAlias(a queryAlias, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", pathWithID(a.successor, id)))
+		logger.Warn("Deprecated route %s %s called; use %s", r.Method, a.path, a.successor)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathWithID fills the {id} of a route pattern
+func pathWithID(pattern, id string) string {
+	if id == "" {
+		return pattern
+	}
+	return strings.Replace(pattern, "{id}", id, 1)
+}
+
+// idParam returns the {id} path value, or ?id= on the deprecated
+// query-style routes
+func idParam(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("id")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// Deleting an owner, pet, vet or visit only marks it deleted. Admins see
+// deleted records with ?include_deleted=true and bring them back with
+// POST .../restore. Once a day, records deleted more than
+// DELETED_RETENTION_DAYS (30 by default) ago are purged; visits, being
+// medical records, also stay until MEDICAL_RECORD_RETENTION_YEARS (7 by
+// default) after the visit.
+
+var (
+	deletedRetention       = 30 * 24 * time.Hour
+	medicalRecordRetention = 7
+)
+
+func initRetention() error {
+	v := getenvDefault("DELETED_RETENTION_DAYS", "30")
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 0 {
+		return fmt.Errorf("DELETED_RETENTION_DAYS %q is not a number of days", v)
+	}
+	deletedRetention = time.Duration(days) * 24 * time.Hour
+
+	v = getenvDefault("MEDICAL_RECORD_RETENTION_YEARS", "7")
+	years, err := strconv.Atoi(v)
+	if err != nil || years < 0 {
+		return fmt.Errorf("MEDICAL_RECORD_RETENTION_YEARS %q is not a number of years", v)
+	}
+	medicalRecordRetention = years
+
+	go purgeDeletedRecords()
+	return nil
+}
+
+func purgeDeletedRecords() {
+	for range time.Tick(24 * time.Hour) {
+		now := time.Now()
+		n, err := data.PurgeDeleted(DB, now.Add(-deletedRetention), now.AddDate(-medicalRecordRetention, 0, 0))
+		if err != nil {
+			logger.Error("Failed to purge deleted records: %v", err)
+			continue
+		}
+		logger.Info("Purged deleted records: %d owners, %d pets, %d vets, %d visits", n.Owners, n.Pets, n.Vets, n.Visits)
+	}
+}
+
+// includeDeleted reads ?include_deleted=true, which only admins may send.
+// On failure it has already written the response.
+func includeDeleted(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, true
+	}
+	withDeleted, err := strconv.ParseBool(v)
+	if err != nil {
+		writeError(w, r, "include_deleted must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+	role, _ := r.Context().Value(ctxRoleKey).(string)
+	if withDeleted && role != data.RoleAdmin && role != data.RoleSuperAdmin {
+		logger.WarnCtx(r.Context(), "Auth: role %q may not list deleted records", role)
+		writeError(w, r, "only admins may see deleted records", http.StatusForbidden)
+		return false, false
+	}
+	return withDeleted, true
+}
+
+// RestoreOwner undoes the deletion of an owner and of the pets and visits
+// deleted with it
+func RestoreOwner(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := data.RestoreOwner(DB, tenantOf(r), actorOf(r), id); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to restore owner %d: %v", id, err)
+		dataError(w, r, err, "owner")
+		return
+	}
+	ro, err := data.GetOwnerByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		dataError(w, r, err, "owner")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Restored owner %d", id)
+	setETag(w, ro.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Owner{ID: ro.ID, Name: ro.Name, Phone: ro.Phone, Address: ro.Address, ClinicID: ro.ClinicID, Version: ro.Version})
+}
+
+// RestorePet undoes the deletion of a pet and of the visits deleted with it
+func RestorePet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := data.RestorePet(DB, tenantOf(r), actorOf(r), id); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to restore pet %d: %v", id, err)
+		dataError(w, r, err, "pet")
+		return
+	}
+	rp, err := data.GetPetByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		dataError(w, r, err, "pet")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Restored pet %d", id)
+	setETag(w, rp.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(petFromRow(rp))
+}
+
+// RestoreVet undoes the deletion of a vet
+func RestoreVet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := data.RestoreVet(DB, tenantOf(r), actorOf(r), id); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to restore vet %d: %v", id, err)
+		dataError(w, r, err, "vet")
+		return
+	}
+	rv, err := data.GetVetByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		dataError(w, r, err, "vet")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Restored vet %d", id)
+	setETag(w, rv.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Vet{ID: rv.ID, Name: rv.Name, Specialization: rv.Specialization, ClinicID: rv.ClinicID, Version: rv.Version})
+}
+
+// RestoreVisit undoes the deletion of a visit
+func RestoreVisit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(idParam(r))
+	if err != nil {
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := data.RestoreVisit(DB, tenantOf(r), actorOf(r), id); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to restore visit %d: %v", id, err)
+		dataError(w, r, err, "visit")
+		return
+	}
+	rv, err := data.GetVisitByID(DB, tenantOf(r), id, false)
+	if err != nil {
+		dataError(w, r, err, "visit")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Restored visit %d", id)
+	setETag(w, rv.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Visit{ID: rv.ID, PetID: rv.PetID, VetID: rv.VetID, Visit: rv.Visit, Desc: rv.Desc, ClinicID: rv.ClinicID, Version: rv.Version})
+}
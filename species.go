@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+func speciesFromRow(s data.SpeciesRow) Species {
+	return Species{ID: s.ID, Name: s.Name, Aliases: s.Aliases}
+}
+
+func breedFromRow(b data.BreedRow) Breed {
+	return Breed{
+		ID:          b.ID,
+		SpeciesID:   b.SpeciesID,
+		Name:        b.Name,
+		Aliases:     b.Aliases,
+		MinWeightKg: b.MinWeightKg,
+		MaxWeightKg: b.MaxWeightKg,
+	}
+}
+
+func petFromRow(rp data.PetRow) Pet {
+	return Pet{
+		ID:        rp.ID,
+		Name:      rp.Name,
+		Species:   rp.Species,
+		Breed:     rp.Breed,
+		Birth:     rp.Birth,
+		OwnerID:   rp.OwnerID,
+		SpeciesID: rp.SpeciesID,
+		BreedID:   rp.BreedID,
+		ClinicID:  rp.ClinicID,
+		Version:   rp.Version,
+		DeletedAt: rp.DeletedAt,
+	}
+}
+
+// petInput checks the species and breed of p against the catalog and returns
+// the input to store, with canonical names and catalog ids. A non-nil field
+// error means the pet was rejected.
+func petInput(p *Pet) (data.PetInput, *FieldError, error) {
+	if strings.TrimSpace(p.Species) == "" {
+		return data.PetInput{}, &FieldError{Field: "species", Code: "required", Message: "is required"}, nil
+	}
+	s, err := data.ResolveSpecies(DB, p.Species)
+	if errors.Is(err, data.ErrNotFound) {
+		return data.PetInput{}, &FieldError{Field: "species", Code: "unknown",
+			Message: fmt.Sprintf("unknown species %q", p.Species)}, nil
+	}
+	if err != nil {
+		return data.PetInput{}, nil, err
+	}
+	in := data.PetInput{
+		Name:      p.Name,
+		Species:   s.Name,
+		Birth:     p.Birth,
+		OwnerID:   p.OwnerID,
+		SpeciesID: s.ID,
+	}
+	if strings.TrimSpace(p.Breed) != "" {
+		b, err := data.ResolveBreed(DB, s.ID, p.Breed)
+		if errors.Is(err, data.ErrNotFound) {
+			return data.PetInput{}, &FieldError{Field: "breed", Code: "unknown",
+				Message: fmt.Sprintf("unknown breed %q for species %s", p.Breed, s.Name)}, nil
+		}
+		if err != nil {
+			return data.PetInput{}, nil, err
+		}
+		in.Breed, in.BreedID = b.Name, b.ID
+	}
+
+	p.Species, p.Breed = in.Species, in.Breed
+	p.SpeciesID = &in.SpeciesID
+	p.BreedID = nil
+	if in.BreedID != 0 {
+		p.BreedID = &in.BreedID
+	}
+	return in, nil, nil
+}
+
+// checkPet validates a pet body, including its species and breed, and
+// answers 422 with every failing field. It returns the input to store and
+// whether the handler may go on.
+func checkPet(w http.ResponseWriter, r *http.Request, p *Pet) (data.PetInput, bool) {
+	errs, err := validate(tenantOf(r), p)
+	var in data.PetInput
+	if err == nil && !hasFieldError(errs, "species") && !hasFieldError(errs, "breed") {
+		var fe *FieldError
+		in, fe, err = petInput(p)
+		if fe != nil {
+			errs = append(errs, *fe)
+		}
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to validate pet: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return in, false
+	}
+	return in, !rejectInvalid(w, r, errs)
+}
+
+func hasFieldError(errs []FieldError, field string) bool {
+	for _, e := range errs {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validAliases rejects aliases the catalog cannot store
+func validAliases(aliases []string) bool {
+	for _, a := range aliases {
+		if strings.Contains(a, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// -------------------- Species --------------------
+
+func GetSpecies(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListSpecies(DB)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch species: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	species := make([]Species, len(rows))
+	for i, s := range rows {
+		species[i] = speciesFromRow(s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(species)
+}
+
+func GetSpeciesByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid species ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	s, err := data.GetSpeciesByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(speciesFromRow(s))
+}
+
+func CreateSpecies(w http.ResponseWriter, r *http.Request) {
+	var s Species
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rejectInvalid(w, r, speciesErrors(s)) {
+		return
+	}
+
+	id, err := data.CreateSpecies(DB, actorOf(r), data.SpeciesInput{Name: s.Name, Aliases: s.Aliases})
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	created, err := data.GetSpeciesByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Created species %d (%s)", id, created.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(speciesFromRow(created))
+}
+
+// UpdateSpecies renames a species and replaces its aliases. Pets of the
+// species are renamed with it.
+func UpdateSpecies(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid species ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var s Species
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if rejectInvalid(w, r, speciesErrors(s)) {
+		return
+	}
+
+	if _, err := data.GetSpeciesByID(DB, id); err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	if err := data.UpdateSpecies(DB, actorOf(r), id, data.SpeciesInput{Name: s.Name, Aliases: s.Aliases}); err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	updated, err := data.GetSpeciesByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(speciesFromRow(updated))
+}
+
+// DeleteSpecies removes a species that no pet or breed refers to
+func DeleteSpecies(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid species ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetSpeciesByID(DB, id); err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	if err := data.DeleteSpecies(DB, actorOf(r), id); err != nil {
+		if errors.Is(err, data.ErrInUse) {
+			writeError(w, r, "species is still used by pets or breeds", http.StatusConflict)
+		} else {
+			dataError(w, r, err, "species")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MigrateSpecies links pets with free-text species and breeds to the
+// catalog and reports the values that could not be mapped. With
+// ?dry_run=true nothing is changed.
+func MigrateSpecies(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := data.MigratePetSpecies(DB, tenantOf(r), actorOf(r), dryRun)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Species migration failed: %v", err)
+		writeError(w, r, "species migration failed", http.StatusInternalServerError)
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Species migration (dry run %t): %d species and %d breeds mapped, %d/%d values unmapped",
+		dryRun, report.MappedSpecies, report.MappedBreeds, len(report.UnmappedSpecies), len(report.UnmappedBreeds))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":          dryRun,
+		"already_linked":   report.AlreadyLinked,
+		"mapped_species":   report.MappedSpecies,
+		"mapped_breeds":    report.MappedBreeds,
+		"unmapped_species": report.UnmappedSpecies,
+		"unmapped_breeds":  report.UnmappedBreeds,
+	})
+}
+
+// -------------------- Breeds --------------------
+
+// GetBreeds lists breeds, optionally filtered by ?species_id
+func GetBreeds(w http.ResponseWriter, r *http.Request) {
+	speciesID := 0
+	if s := r.URL.Query().Get("species_id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			logger.WarnCtx(r.Context(), "Invalid species ID format: %s", s)
+			writeError(w, r, "invalid species_id", http.StatusBadRequest)
+			return
+		}
+		speciesID = id
+	}
+
+	rows, err := data.ListBreeds(DB, speciesID)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch breeds: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	breeds := make([]Breed, len(rows))
+	for i, b := range rows {
+		breeds[i] = breedFromRow(b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breeds)
+}
+
+func GetBreedByID(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid breed ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	b, err := data.GetBreedByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breedFromRow(b))
+}
+
+// breedInput checks a breed request body and returns its invalid fields
+func breedInput(b Breed) (data.BreedInput, []FieldError, error) {
+	var errs []FieldError
+	if strings.TrimSpace(b.Name) == "" {
+		errs = append(errs, FieldError{Field: "name", Code: "required", Message: "is required"})
+	}
+	if !validAliases(b.Aliases) {
+		errs = append(errs, FieldError{Field: "aliases", Code: "invalid", Message: "must not contain commas"})
+	}
+	if b.MinWeightKg != nil && *b.MinWeightKg <= 0 {
+		errs = append(errs, FieldError{Field: "min_weight_kg", Code: "not_positive", Message: "must be positive"})
+	}
+	if b.MaxWeightKg != nil && *b.MaxWeightKg <= 0 {
+		errs = append(errs, FieldError{Field: "max_weight_kg", Code: "not_positive", Message: "must be positive"})
+	}
+	if b.MinWeightKg != nil && b.MaxWeightKg != nil && *b.MinWeightKg > *b.MaxWeightKg {
+		errs = append(errs, FieldError{Field: "min_weight_kg", Code: "too_large", Message: "must not exceed max_weight_kg"})
+	}
+	if b.SpeciesID == 0 {
+		errs = append(errs, FieldError{Field: "species_id", Code: "required", Message: "is required"})
+	} else if _, err := data.GetSpeciesByID(DB, b.SpeciesID); errors.Is(err, data.ErrNotFound) {
+		errs = append(errs, FieldError{Field: "species_id", Code: "not_found", Message: "does not exist"})
+	} else if err != nil {
+		return data.BreedInput{}, nil, err
+	}
+	return data.BreedInput{
+		SpeciesID:   b.SpeciesID,
+		Name:        b.Name,
+		Aliases:     b.Aliases,
+		MinWeightKg: b.MinWeightKg,
+		MaxWeightKg: b.MaxWeightKg,
+	}, errs, nil
+}
+
+// speciesErrors checks a species request body and returns its invalid fields
+func speciesErrors(s Species) []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(s.Name) == "" {
+		errs = append(errs, FieldError{Field: "name", Code: "required", Message: "is required"})
+	}
+	if !validAliases(s.Aliases) {
+		errs = append(errs, FieldError{Field: "aliases", Code: "invalid", Message: "must not contain commas"})
+	}
+	return errs
+}
+
+func CreateBreed(w http.ResponseWriter, r *http.Request) {
+	var b Breed
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in, errs, err := breedInput(b)
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	if rejectInvalid(w, r, errs) {
+		return
+	}
+
+	id, err := data.CreateBreed(DB, actorOf(r), in)
+	if err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	created, err := data.GetBreedByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+
+	logger.InfoCtx(r.Context(), "Created breed %d (%s)", id, created.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(breedFromRow(created))
+}
+
+func UpdateBreed(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid breed ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var b Breed
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in, errs, err := breedInput(b)
+	if err != nil {
+		dataError(w, r, err, "species")
+		return
+	}
+	if rejectInvalid(w, r, errs) {
+		return
+	}
+
+	if _, err := data.GetBreedByID(DB, id); err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	if err := data.UpdateBreed(DB, actorOf(r), id, in); err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	updated, err := data.GetBreedByID(DB, id)
+	if err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breedFromRow(updated))
+}
+
+// DeleteBreed removes a breed that no pet refers to
+func DeleteBreed(w http.ResponseWriter, r *http.Request) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid breed ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := data.GetBreedByID(DB, id); err != nil {
+		dataError(w, r, err, "breed")
+		return
+	}
+	if err := data.DeleteBreed(DB, actorOf(r), id); err != nil {
+		if errors.Is(err, data.ErrInUse) {
+			writeError(w, r, "breed is still used by pets", http.StatusConflict)
+		} else {
+			dataError(w, r, err, "breed")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"petclinic/data"
+	"petclinic/logger"
+	"petclinic/oidc"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcStateTTL bounds how long a user may spend at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// sso is the single sign-on configuration; nil when OIDC_ISSUER is not set
+var sso *ssoConfig
+
+type ssoConfig struct {
+	client      *oidc.Client
+	roleClaim   string
+	adminValues []string
+	staffValues []string
+	defaultRole string
+	clinicID    int
+}
+
+// initOIDC configures staff single sign-on from the environment. Provider
+// claims map to roles through OIDC_ROLE_CLAIM (default "groups") and the
+// comma-separated OIDC_ADMIN_VALUES and OIDC_STAFF_VALUES; identities
+// matching neither get OIDC_DEFAULT_ROLE or are refused. New accounts join
+// clinic OIDC_CLINIC_ID, by default DEFAULT_CLINIC_ID.
+func initOIDC() {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return
+	}
+	sso = &ssoConfig{
+		client: oidc.NewClient(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"),
+			getenvDefault("OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback")),
+		roleClaim:   getenvDefault("OIDC_ROLE_CLAIM", "groups"),
+		adminValues: splitList(os.Getenv("OIDC_ADMIN_VALUES")),
+		staffValues: splitList(os.Getenv("OIDC_STAFF_VALUES")),
+		defaultRole: os.Getenv("OIDC_DEFAULT_ROLE"),
+		clinicID:    defaultClinicID,
+	}
+	if v := os.Getenv("OIDC_CLINIC_ID"); v != "" {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			sso.clinicID = id
+		} else {
+			logger.Warn("Ignoring OIDC_CLINIC_ID %q; new accounts join clinic %d", v, sso.clinicID)
+		}
+	}
+	if sso.defaultRole != "" && sso.defaultRole != data.RoleStaff && sso.defaultRole != data.RoleAdmin {
+		logger.Warn("Ignoring OIDC_DEFAULT_ROLE %q; only staff and admin can sign in through SSO", sso.defaultRole)
+		sso.defaultRole = ""
+	}
+	logger.Info("Single sign-on enabled with provider %s", issuer)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mapRole picks the account role for an identity. Admin wins over staff;
+// SSO never yields owner accounts, which belong to the portal.
+func (c *ssoConfig) mapRole(claims jwt.MapClaims) string {
+	var values []string
+	switch v := claims[c.roleClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	has := func(want []string) bool {
+		for _, v := range values {
+			for _, w := range want {
+				if v == w {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case has(c.adminValues):
+		return data.RoleAdmin
+	case has(c.staffValues):
+		return data.RoleStaff
+	}
+	return c.defaultRole
+}
+
+// OIDCLogin starts a sign-in by redirecting to the provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if sso == nil {
+		writeError(w, r, "single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	state, err := oidc.RandomString()
+	var nonce, verifier string
+	if err == nil {
+		nonce, err = oidc.RandomString()
+	}
+	if err == nil {
+		verifier, err = oidc.RandomString()
+	}
+	if err == nil {
+		err = data.CreateOIDCState(DB, hashSecretToken(state), nonce, verifier, time.Now().Add(oidcStateTTL))
+	}
+	if err != nil {
+		logger.Error("Failed to start single sign-on: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := sso.client.AuthCodeURL(r.Context(), state, nonce, oidc.S256Challenge(verifier))
+	if err != nil {
+		logger.Error("Failed to reach identity provider: %v", err)
+		writeError(w, r, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// OIDCCallback finishes a sign-in: it redeems the code, maps the identity to
+// a role, provisions the account and answers like a password login
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if sso == nil {
+		writeError(w, r, "single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		logger.Warn("Identity provider refused sign-in: %s %s", e, q.Get("error_description"))
+		writeError(w, r, "sign-in was cancelled or refused", http.StatusUnauthorized)
+		return
+	}
+	if q.Get("state") == "" || q.Get("code") == "" {
+		writeError(w, r, "state and code are required", http.StatusBadRequest)
+		return
+	}
+
+	nonce, verifier, err := data.ConsumeOIDCState(DB, hashSecretToken(q.Get("state")))
+	if err != nil {
+		if errors.Is(err, data.ErrOIDCStateInvalid) {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Error("Failed to load sign-in state: %v", err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := sso.client.Exchange(r.Context(), q.Get("code"), verifier, nonce)
+	if err != nil {
+		logger.Warn("Single sign-on failed: %v", err)
+		writeError(w, r, "sign-in could not be verified", http.StatusUnauthorized)
+		return
+	}
+	sub, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	if email == "" {
+		logger.Warn("Identity %s has no email claim", sub)
+		writeError(w, r, "identity provider did not share an email address", http.StatusForbidden)
+		return
+	}
+	role := sso.mapRole(claims)
+	if role == "" {
+		logger.Warn("Refused single sign-on for %s: no role matches claim %q", email, sso.roleClaim)
+		writeError(w, r, "your account is not allowed to use this application", http.StatusForbidden)
+		return
+	}
+
+	u, err := data.ProvisionOIDCUser(DB, actorOf(r), sso.clinicID, sso.client.Issuer, sub, email, role, verified)
+	if err != nil {
+		if errors.Is(err, data.ErrOIDCAccountConflict) {
+			writeError(w, r, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Error("Failed to provision user %s: %v", email, err)
+		writeError(w, r, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Single sign-on for %s as %s (ID: %d)", u.Email, u.Role, u.ID)
+	respondLogin(w, r, u)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+type userRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	OwnerID  *int   `json:"owner_id"`
+}
+
+type updateMeRequest struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func userFromRow(u data.UserRow) User {
+	return User{
+		ID:            u.ID,
+		Email:         u.Email,
+		Role:          u.Role,
+		OwnerID:       u.OwnerID,
+		EmailVerified: u.EmailVerified,
+		MFAEnabled:    u.TOTPEnabled,
+		Active:        u.Active,
+		CreatedAt:     u.CreatedAt,
+		ClinicID:      u.ClinicID,
+	}
+}
+
+func writeUser(w http.ResponseWriter, status int, u data.UserRow) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(userFromRow(u))
+}
+
+// userInput checks an admin's account request. A non-empty message means
+// it was rejected.
+func userInput(t data.Tenant, req userRequest) (data.UserInput, string, error) {
+	in := data.UserInput{Email: strings.TrimSpace(req.Email), Role: req.Role, OwnerID: req.OwnerID}
+	if in.Email == "" || len(in.Email) > 255 {
+		return in, "email is required and must be at most 255 characters", nil
+	}
+	switch in.Role {
+	case data.RoleAdmin, data.RoleStaff:
+	case data.RoleOwner:
+		if in.OwnerID == nil {
+			return in, "owner_id is required for owner accounts", nil
+		}
+		if _, err := data.GetOwnerByID(DB, t, *in.OwnerID, false); err != nil {
+			if errors.Is(err, data.ErrNotFound) {
+				return in, "owner not found", nil
+			}
+			return in, "", err
+		}
+	default:
+		return in, "role must be admin, staff or owner", nil
+	}
+	return in, "", nil
+}
+
+// emailTaken reports whether email belongs to an account other than id
+func emailTaken(email string, id int) (bool, error) {
+	u, err := data.FindUserByEmail(DB, email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil && u.ID != id, err
+}
+
+func pathUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	idStr := idParam(r)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WarnCtx(r.Context(), "Invalid user ID format: %s", idStr)
+		writeError(w, r, "invalid id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// isSelf refuses changes an admin could lock themselves out with
+func isSelf(w http.ResponseWriter, r *http.Request, id int, what string) bool {
+	if me, _ := r.Context().Value(logger.CtxUserIDKey).(int); me == id {
+		writeError(w, r, "you cannot "+what+" your own account", http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// -------------------- Admin --------------------
+
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := data.ListUsers(DB, tenantOf(r))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to fetch users: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	users := make([]User, len(rows))
+	for i, u := range rows {
+		users[i] = userFromRow(u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func GetUserByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	u, err := data.GetClinicUser(DB, tenantOf(r), id)
+	if err != nil {
+		dataError(w, r, err, "user")
+		return
+	}
+	writeUser(w, http.StatusOK, u)
+}
+
+// CreateUser lets an admin open an account with any role
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in, msg, err := userInput(tenantOf(r), req)
+	if err == nil && msg == "" && req.Password == "" {
+		msg = "password is required"
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		writeError(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	if !checkNewPassword(w, r, req.Password, in.Email, "password") {
+		return
+	}
+	if taken, err := emailTaken(in.Email, 0); err != nil || taken {
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to check email %s: %v", in.Email, err)
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+		} else {
+			writeError(w, r, "email already registered", http.StatusConflict)
+		}
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to hash password: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	u, err := data.CreateUserAccount(DB, tenantOf(r), actorOf(r), in, hash)
+	if err != nil {
+		if tenantError(w, r, err) {
+			return
+		}
+		if errors.Is(err, data.ErrConflict) {
+			writeError(w, r, "email already registered", http.StatusConflict)
+			return
+		}
+		logger.ErrorCtx(r.Context(), "Failed to create user %s: %v", in.Email, err)
+		dataError(w, r, err, "user")
+		return
+	}
+	if err := sendVerificationEmail(r.Context(), u); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to send verification email to %s: %v", u.Email, err)
+	}
+	logger.InfoCtx(r.Context(), "Created %s account %s (ID: %d)", u.Role, u.Email, u.ID)
+	writeUser(w, http.StatusCreated, u)
+}
+
+// UpdateUser changes an account's email, role and owner link. Passwords
+// are only changed by their holder or through a reset link.
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in, msg, err := userInput(tenantOf(r), req)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		writeError(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	if in.Role != data.RoleAdmin && isSelf(w, r, id, "demote") {
+		return
+	}
+	if taken, err := emailTaken(in.Email, id); err != nil || taken {
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to check email %s: %v", in.Email, err)
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+		} else {
+			writeError(w, r, "email already registered", http.StatusConflict)
+		}
+		return
+	}
+
+	u, err := data.UpdateUser(DB, tenantOf(r), actorOf(r), id, in)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFound):
+			writeError(w, r, "user not found", http.StatusNotFound)
+		case errors.Is(err, data.ErrConflict):
+			writeError(w, r, "email already registered", http.StatusConflict)
+		default:
+			logger.ErrorCtx(r.Context(), "Failed to update user %d: %v", id, err)
+			dataError(w, r, err, "user")
+		}
+		return
+	}
+	logger.InfoCtx(r.Context(), "Updated user %d (%s, %s)", u.ID, u.Email, u.Role)
+	writeUser(w, http.StatusOK, u)
+}
+
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathUserID(w, r)
+	if !ok || isSelf(w, r, id, "delete") {
+		return
+	}
+	found, err := data.DeleteUser(DB, tenantOf(r), actorOf(r), id)
+	if err != nil {
+		dataError(w, r, err, "user")
+		return
+	}
+	if !found {
+		writeError(w, r, "user not found", http.StatusNotFound)
+		return
+	}
+	logger.InfoCtx(r.Context(), "Deleted user %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetUserActive returns a handler that deactivates or reactivates the
+// account in ?id=. Deactivation takes effect on the account's next request.
+func SetUserActive(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathUserID(w, r)
+		if !ok || (!active && isSelf(w, r, id, "deactivate")) {
+			return
+		}
+		u, err := data.SetUserActive(DB, tenantOf(r), actorOf(r), id, active)
+		if err != nil {
+			dataError(w, r, err, "user")
+			return
+		}
+		logger.InfoCtx(r.Context(), "Set user %d (%s) active=%t", u.ID, u.Email, active)
+		writeUser(w, http.StatusOK, u)
+	}
+}
+
+// -------------------- Profile --------------------
+
+// GetMe returns the signed-in account
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeUser(w, http.StatusOK, u)
+}
+
+// checkCurrentPassword verifies the password of the signed-in user for a
+// sensitive change. Wrong guesses count towards the login lockout. On
+// failure it has already written the response.
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, u data.UserRow, password string) bool {
+	ip := clientIP(r)
+	until, err := loginLocked(accountKey(u.Email), ipKey(ip))
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to check login lockout for %s: %v", u.Email, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if !until.IsZero() {
+		writeLockedOut(w, r, until)
+		return false
+	}
+	if password == "" || checkPassword(u.PasswordHash, password) != nil {
+		logger.WarnCtx(r.Context(), "Wrong current password for user %d", u.ID)
+		recordLoginFailure(u.Email, ip)
+		writeError(w, r, "current password is incorrect", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// UpdateMe changes the signed-in user's email. The new address gets a
+// verification link; the current password is required.
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req updateMeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || len(req.Email) > 255 {
+		writeError(w, r, "email is required and must be at most 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Email == u.Email {
+		writeUser(w, http.StatusOK, u)
+		return
+	}
+	if !checkCurrentPassword(w, r, u, req.CurrentPassword) {
+		return
+	}
+	if taken, err := emailTaken(req.Email, u.ID); err != nil || taken {
+		if err != nil {
+			logger.ErrorCtx(r.Context(), "Failed to check email %s: %v", req.Email, err)
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+		} else {
+			writeError(w, r, "email already registered", http.StatusConflict)
+		}
+		return
+	}
+
+	id := u.ID
+	u, err = data.UpdateUserEmail(DB, actorOf(r), id, req.Email)
+	if err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			writeError(w, r, "email already registered", http.StatusConflict)
+			return
+		}
+		logger.ErrorCtx(r.Context(), "Failed to update email of user %d: %v", id, err)
+		dataError(w, r, err, "user")
+		return
+	}
+	if err := sendVerificationEmail(r.Context(), u); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to send verification email to %s: %v", u.Email, err)
+	}
+	logger.InfoCtx(r.Context(), "User %d changed email to %s", u.ID, u.Email)
+	writeUser(w, http.StatusOK, u)
+}
+
+// ChangePassword sets a new password for the signed-in user after checking
+// the current one
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WarnCtx(r.Context(), "Invalid JSON in request: %v", err)
+		writeError(w, r, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		writeError(w, r, "new_password is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := currentUser(r)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to load current user: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !checkCurrentPassword(w, r, u, req.CurrentPassword) ||
+		!checkNewPassword(w, r, req.NewPassword, u.Email, "new_password") {
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err == nil {
+		err = data.SetUserPassword(DB, actorOf(r), u.ID, hash)
+	}
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to change password of user %d: %v", u.ID, err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := data.ClearLoginFailures(DB, accountKey(u.Email)); err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to clear login failures for %s: %v", u.Email, err)
+	}
+	logger.InfoCtx(r.Context(), "User %d changed their password", u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"petclinic/data"
+	"petclinic/logger"
+)
+
+// Request models declare their rules in a validate tag, checked in order
+// until one fails:
+//
+//	required   not empty or zero; strings are trimmed first
+//	max=N      at most N characters, as the VARCHAR(N) column
+//	phone      an E.164 number such as +15551234567; the field is rewritten
+//	           in that form
+//	past       a date not in the future and not before 1900
+//	schedule   a date from 1900 to one year ahead
+//	ref=TABLE  the id of a row of TABLE in the request's clinic
+//
+// Fields without a value skip every rule but required.
+
+// phoneCountryCode is the calling code given to phone numbers without one
+// (PHONE_COUNTRY_CODE, e.g. 1 or 91); when empty they are rejected
+var phoneCountryCode string
+
+// initValidation reads the settings of the validation rules
+func initValidation() error {
+	cc := strings.TrimPrefix(strings.TrimSpace(os.Getenv("PHONE_COUNTRY_CODE")), "+")
+	if cc != "" && (len(cc) > 3 || cc[0] == '0' || strings.Trim(cc, "0123456789") != "") {
+		return fmt.Errorf("PHONE_COUNTRY_CODE %q is not a calling code", cc)
+	}
+	phoneCountryCode = cc
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// earliestDate bounds every date a client can send
+var earliestDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// validate applies the rules of the struct v points to and returns every
+// failing field. The error is only set when a reference could not be looked
+// up.
+func validate(t data.Tenant, v interface{}) ([]FieldError, error) {
+	var errs []FieldError
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(rt.Field(i).Tag.Get("json"), ",")
+		fe, err := checkField(t, rv.Field(i), name, strings.Split(tag, ","))
+		if err != nil {
+			return nil, err
+		}
+		if fe != nil {
+			errs = append(errs, *fe)
+		}
+	}
+	return errs, nil
+}
+
+func checkField(t data.Tenant, f reflect.Value, name string, rules []string) (*FieldError, error) {
+	if f.Kind() == reflect.String {
+		f.SetString(strings.TrimSpace(f.String()))
+	}
+	if f.IsZero() {
+		for _, rule := range rules {
+			if rule == "required" {
+				return &FieldError{Field: name, Code: "required", Message: "is required"}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for _, rule := range rules {
+		rule, arg, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "required":
+		case "max":
+			n, _ := strconv.Atoi(arg)
+			if utf8.RuneCountInString(f.String()) > n {
+				return &FieldError{Field: name, Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", n)}, nil
+			}
+		case "phone":
+			p, ok := normalizePhone(f.String())
+			if !ok {
+				msg := "must be a phone number with country code, such as +15551234567"
+				if phoneCountryCode != "" {
+					msg = "must be a phone number, such as +15551234567"
+				}
+				return &FieldError{Field: name, Code: "invalid_phone", Message: msg}, nil
+			}
+			f.SetString(p)
+		case "past":
+			d := f.Interface().(time.Time)
+			if d.After(time.Now()) {
+				return &FieldError{Field: name, Code: "in_future", Message: "must not be in the future"}, nil
+			}
+			if d.Before(earliestDate) {
+				return &FieldError{Field: name, Code: "too_early", Message: "must not be before 1900"}, nil
+			}
+		case "schedule":
+			d := f.Interface().(time.Time)
+			if d.After(time.Now().AddDate(1, 0, 0)) {
+				return &FieldError{Field: name, Code: "too_late", Message: "must be within a year from now"}, nil
+			}
+			if d.Before(earliestDate) {
+				return &FieldError{Field: name, Code: "too_early", Message: "must not be before 1900"}, nil
+			}
+		case "ref":
+			ok, err := data.ExistsInTenant(DB, t, arg, int(f.Int()))
+			if err != nil {
+				return nil, fmt.Errorf("check %s %d: %w", arg, f.Int(), err)
+			}
+			if !ok {
+				return &FieldError{Field: name, Code: "not_found", Message: "does not exist"}, nil
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q on %s", rule, name))
+		}
+	}
+	return nil, nil
+}
+
+// normalizePhone returns s in E.164 form. Spaces, dots, dashes and
+// parentheses are dropped, a leading 00 counts as +, and numbers without a
+// country code get phoneCountryCode.
+func normalizePhone(s string) (string, bool) {
+	digits := strings.Map(func(c rune) rune {
+		switch c {
+		case ' ', '.', '-', '(', ')':
+			return -1
+		}
+		return c
+	}, s)
+	switch {
+	case strings.HasPrefix(digits, "+"):
+		digits = digits[1:]
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case phoneCountryCode != "":
+		digits = phoneCountryCode + strings.TrimPrefix(digits, "0")
+	default:
+		return "", false
+	}
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+		return "", false
+	}
+	return "+" + digits, true
+}
+
+// checkBody validates a decoded request body and answers 422 with every
+// failing field. It reports whether the handler may go on.
+func checkBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	errs, err := validate(tenantOf(r), v)
+	if err != nil {
+		logger.ErrorCtx(r.Context(), "Failed to validate request: %v", err)
+		writeError(w, r, "internal server error", http.StatusInternalServerError)
+		return false
+	}
+	return !rejectInvalid(w, r, errs)
+}
+
+// rejectInvalid answers 422 when errs is not empty
+func rejectInvalid(w http.ResponseWriter, r *http.Request, errs []FieldError) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	logger.WarnCtx(r.Context(), "Rejected %s %s: invalid %s", r.Method, r.URL.Path, strings.Join(fields, ", "))
+	writeFieldErrors(w, r, "the request has invalid fields", http.StatusUnprocessableEntity, errs)
+	return true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"petclinic/logger"
+)
+
+// apiVersion is one version of the API, served under /api/<name>/. A version
+// only registers the routes that changed since its base; requests for any
+// other route fall through to the base, so old and new handlers live side
+// by side.
+type apiVersion struct {
+	name   string
+	routes func(mux *http.ServeMux)
+	base   *apiVersion
+
+	mux         *http.ServeMux
+	deprecation time.Time
+	sunset      time.Time
+	successor   string
+	requests    atomic.Int64
+}
+
+// apiVersions lists every version, oldest first
+var apiVersions []*apiVersion
+
+// unversionedAPI serves the routes from before /api/v1 existed, with the
+// handlers of v1 and the query-style aliases. It is counted and deprecated
+// like a version.
+var unversionedAPI = &apiVersion{name: "unversioned"}
+
+// initAPIVersions builds each version's routes and mounts the versions on
+// mux. Deprecation and sunset dates come from API_<NAME>_DEPRECATION and
+// API_<NAME>_SUNSET (YYYY-MM-DD), e.g. API_V1_SUNSET or
+// API_UNVERSIONED_DEPRECATION.
+func initAPIVersions(mux *http.ServeMux) error {
+	// To change the JSON shape of a resource, add a version whose routes
+	// only cover what changed, e.g. {name: "v2", routes: registerV2Routes},
+	// and deprecate the old one with API_V1_DEPRECATION and API_V1_SUNSET.
+	apiVersions = []*apiVersion{
+		{name: "v1", routes: registerRoutes},
+	}
+
+	var prev *apiVersion
+	for _, v := range apiVersions {
+		v.mux = http.NewServeMux()
+		v.routes(v.mux)
+		v.base = prev
+		prev = v
+	}
+	latest := apiVersions[len(apiVersions)-1]
+	unversionedAPI.mux = http.NewServeMux()
+	apiVersions[0].routes(unversionedAPI.mux)
+	registerQueryAliases(unversionedAPI.mux)
+
+	for _, v := range append(apiVersions, unversionedAPI) {
+		if err := v.loadDates(); err != nil {
+			return err
+		}
+		if v != latest {
+			v.successor = "/api/" + latest.name
+		}
+		if !v.deprecation.IsZero() {
+			logger.Info("API %s is deprecated since %s", v.name, v.deprecation.Format("2006-01-02"))
+		}
+	}
+
+	for _, v := range apiVersions {
+		prefix := "/api/" + v.name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, v))
+	}
+	mux.Handle("/", unversionedAPI)
+	return nil
+}
+
+func (v *apiVersion) loadDates() error {
+	key := "API_" + strings.ToUpper(v.name)
+	for _, d := range []struct {
+		env string
+		to  *time.Time
+	}{{key + "_DEPRECATION", &v.deprecation}, {key + "_SUNSET", &v.sunset}} {
+		s := os.Getenv(d.env)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return fmt.Errorf("%s %q is not a YYYY-MM-DD date", d.env, s)
+		}
+		*d.to = t
+	}
+	return nil
+}
+
+// ServeHTTP counts the request, marks responses of deprecated versions and
+// hands the request to the newest version that has a route for it
+func (v *apiVersion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.requests.Add(1)
+	if !v.deprecation.IsZero() {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", v.deprecation.Unix()))
+		if v.successor != "" {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", v.successor))
+		}
+	}
+	if !v.sunset.IsZero() {
+		w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+	}
+
+	for cur := v; cur != nil; cur = cur.base {
+		_, pattern := cur.mux.Handler(r)
+		if pattern != "" {
+			cur.mux.ServeHTTP(w, r)
+			return
+		}
+		if cur.base == nil {
+			cur.mux.ServeHTTP(&problemWriter{ResponseWriter: w, r: r}, r)
+			return
+		}
+	}
+}
+
+type apiVersionStats struct {
+	Version     string     `json:"version"`
+	Requests    int64      `json:"requests"`
+	Deprecation *time.Time `json:"deprecation,omitempty"`
+	Sunset      *time.Time `json:"sunset,omitempty"`
+}
+
+// GetAPIVersions reports how many requests each version has served since
+// the server started, to tell when an old version can be removed
+func GetAPIVersions(w http.ResponseWriter, r *http.Request) {
+	res := []apiVersionStats{}
+	for _, v := range append(apiVersions, unversionedAPI) {
+		s := apiVersionStats{Version: v.name, Requests: v.requests.Load()}
+		if !v.deprecation.IsZero() {
+			s.Deprecation = &v.deprecation
+		}
+		if !v.sunset.IsZero() {
+			s.Sunset = &v.sunset
+		}
+		res = append(res, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}